@@ -2,4 +2,7 @@ module github.com/jba/muxpatterns
 
 go 1.20
 
-require golang.org/x/exp v0.0.0-20230519143937-03e91628a987
+require (
+	golang.org/x/exp v0.0.0-20230519143937-03e91628a987
+	golang.org/x/text v0.14.0
+)
@@ -0,0 +1,91 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package muxpatterns
+
+import "strings"
+
+// A hostTree maps host names to values. A name matches the key that is the
+// same name, and every wildcard key "*.suffix" where the name ends in
+// ".suffix". The tree is a trie over the labels of the keys, last label
+// first, so a lookup takes time proportional to the number of labels in the
+// name, however many keys there are.
+//
+// A hostTree is immutable. The zero hostTree, or a nil one, is empty.
+type hostTree[V any] struct {
+	children mapping[string, *hostTree[V]]
+	exact    V // for the key that ends here
+	wild     V // for the wildcard key whose suffix ends here
+	hasExact bool
+	hasWild  bool
+}
+
+// isWildcardHost reports whether host is a wildcard host, like "*.example.com".
+func isWildcardHost(host string) bool {
+	return strings.HasPrefix(host, "*.")
+}
+
+// with returns a copy of t in which key maps to v, replacing any existing
+// value for key. t is unchanged; the copy shares all of its nodes except
+// those for the labels of key.
+func (t *hostTree[V]) with(key string, v V) *hostTree[V] {
+	wild := isWildcardHost(key)
+	if wild {
+		key = key[2:]
+	}
+	return t.withName(key, wild, v)
+}
+
+// withName is like with, for the key name or, if wild is true, "*."+name.
+func (t *hostTree[V]) withName(name string, wild bool, v V) *hostTree[V] {
+	var c hostTree[V]
+	if t != nil {
+		c = *t
+	}
+	if name == "" {
+		if wild {
+			c.wild, c.hasWild = v, true
+		} else {
+			c.exact, c.hasExact = v, true
+		}
+		return &c
+	}
+	label, rest := lastLabel(name)
+	child, _ := c.children.find(label)
+	c.children = c.children.with(label, child.withName(rest, wild, v), maxSlice)
+	return &c
+}
+
+// lookup returns the values whose keys match host, most specific first:
+// the value for host itself, then those for wildcard keys, longest suffix
+// first.
+func (t *hostTree[V]) lookup(host string) []V {
+	var wilds []V
+	for t != nil && host != "" {
+		label, rest := lastLabel(host)
+		if t.hasWild {
+			wilds = append(wilds, t.wild)
+		}
+		t, _ = t.children.find(label)
+		host = rest
+	}
+	var vs []V
+	if t != nil && t.hasExact {
+		vs = append(vs, t.exact)
+	}
+	for i := len(wilds) - 1; i >= 0; i-- {
+		vs = append(vs, wilds[i])
+	}
+	return vs
+}
+
+// lastLabel splits host into its last label and the rest, without
+// the dot between them.
+func lastLabel(host string) (label, rest string) {
+	i := strings.LastIndexByte(host, '.')
+	if i < 0 {
+		return host, ""
+	}
+	return host[i+1:], host[:i]
+}
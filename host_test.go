@@ -0,0 +1,50 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package muxpatterns
+
+import (
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestHostTree(t *testing.T) {
+	var tree *hostTree[string]
+	keys := []string{"example.com", "*.example.com", "a.example.com", "*.a.example.com",
+		"*.com", "localhost", "10.0.0.1", "*.org"}
+	for _, k := range keys {
+		tree = tree.with(k, k)
+	}
+	old := tree
+	tree = tree.with("localhost", "replaced")
+	if got := old.lookup("localhost"); !slices.Equal(got, []string{"localhost"}) {
+		t.Errorf("with changed the original tree: got %q", got)
+	}
+	for _, test := range []struct {
+		host string
+		want []string
+	}{
+		{"example.com", []string{"example.com", "*.com"}},
+		{"b.example.com", []string{"*.example.com", "*.com"}},
+		{"a.example.com", []string{"a.example.com", "*.example.com", "*.com"}},
+		{"x.y.a.example.com", []string{"*.a.example.com", "*.example.com", "*.com"}},
+		{"other.com", []string{"*.com"}},
+		{"com", nil},
+		{"localhost", []string{"replaced"}},
+		{"10.0.0.1", []string{"10.0.0.1"}},
+		{"10.0.0.2", nil},
+		{"go.dev", nil},
+		{"", nil},
+	} {
+		got := tree.lookup(test.host)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.host, got, test.want)
+		}
+	}
+	var empty *hostTree[string]
+	if got := empty.lookup("example.com"); got != nil {
+		t.Errorf("empty tree: got %q, want nil", got)
+	}
+}
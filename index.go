@@ -19,7 +19,12 @@ type indexKey struct {
 }
 
 func newIndex() *index {
-	return &index{segments: map[indexKey][]*Pattern{}}
+	return newIndexSize(0)
+}
+
+// newIndexSize returns an index with room for about n patterns.
+func newIndexSize(n int) *index {
+	return &index{segments: make(map[indexKey][]*Pattern, n)}
 }
 
 func (idx *index) addPattern(pat *Pattern) {
@@ -56,6 +61,13 @@ func (idx *index) possiblyConflictingPatterns(pat *Pattern, f func(*Pattern) err
 	}
 
 	switch {
+	case pat.hasSuffix():
+		// The literals after a multi wildcard can be at any position, so
+		// any pattern might conflict.
+		for _, pats := range idx.segments {
+			apply(pats)
+		}
+		apply(idx.multis)
 	case pat.lastSegment().s == "/":
 		// All paths that a dollar pattern matches end in a slash; no paths that an ordinary
 		// pattern matches do. So only other dollar or multi patterns can conflict with a dollar pattern.
@@ -102,7 +114,7 @@ func (idx *index) possiblyConflictingPatterns(pat *Pattern, f func(*Pattern) err
 			// If it doesn't, then it's more general than any of those dollar patterns.
 			// But if it has a method we have to consider patterns without a method.
 			// TODO: make this more precise.
-			if pat.method != "" {
+			if len(pat.methods) > 0 {
 				for _, pats := range idx.segments {
 					apply(pats)
 				}
@@ -4,27 +4,39 @@
 
 package muxpatterns
 
+import (
+	"sort"
+
+	"golang.org/x/exp/constraints"
+)
+
 // A mapping is a set of key-value pairs.
 // An zero mapping is empty and ready to use.
 //
 // Mappings try to pick a representation that makes [mapping.find] most efficient.
-type mapping[K comparable, V any] struct {
-	s []entry[K, V] // for few pairs
-	m map[K]V       // for many pairs
+type mapping[K constraints.Ordered, V any] struct {
+	s      []entry[K, V] // for few pairs
+	m      map[K]V       // for many pairs
+	sorted bool          // s is sorted by key; see withSorted
 }
 
-type entry[K comparable, V any] struct {
+type entry[K constraints.Ordered, V any] struct {
 	key   K
 	value V
 }
 
-// maxSlice is the maximum number of pairs for which a slice is used.
+// maxSlice is the default maximum number of pairs for which a slice is used.
 // It is a variable for benchmarking.
 var maxSlice int = 8
 
 // add adds a key-value pair to the mapping.
 func (h *mapping[K, V]) add(k K, v V) {
-	if h.m == nil && len(h.s) < maxSlice {
+	h.addMax(k, v, maxSlice)
+}
+
+// addMax is like add, but uses a slice for at most max pairs.
+func (h *mapping[K, V]) addMax(k K, v V, max int) {
+	if h.m == nil && len(h.s) < max {
 		h.s = append(h.s, entry[K, V]{k, v})
 	} else {
 		if h.m == nil {
@@ -38,6 +50,93 @@ func (h *mapping[K, V]) add(k K, v V) {
 	}
 }
 
+// with returns a copy of h in which k maps to v, replacing any existing
+// value for k. The copy uses a slice for at most max pairs. h is unchanged.
+func (h *mapping[K, V]) with(k K, v V, max int) mapping[K, V] {
+	var c mapping[K, V]
+	if h.m != nil {
+		c.m = make(map[K]V, len(h.m)+1)
+		for k2, v2 := range h.m {
+			c.m[k2] = v2
+		}
+		c.m[k] = v
+		return c
+	}
+	c.s = make([]entry[K, V], len(h.s), len(h.s)+1)
+	copy(c.s, h.s)
+	for i, e := range c.s {
+		if e.key == k {
+			c.s[i].value = v
+			return c
+		}
+	}
+	c.addMax(k, v, max)
+	return c
+}
+
+// set makes k map to v in h, replacing any existing value for k, using a
+// slice for at most max pairs. Unlike with, it changes h in place, so h must
+// not share its storage with another mapping; see clone.
+func (h *mapping[K, V]) set(k K, v V, max int) {
+	if h.m != nil {
+		h.m[k] = v
+		return
+	}
+	for i, e := range h.s {
+		if e.key == k {
+			h.s[i].value = v
+			return
+		}
+	}
+	h.addMax(k, v, max)
+}
+
+// clone returns a copy of h that shares no storage with it.
+func (h *mapping[K, V]) clone() mapping[K, V] {
+	c := mapping[K, V]{sorted: h.sorted}
+	if h.m != nil {
+		c.m = make(map[K]V, len(h.m)+1)
+		for k, v := range h.m {
+			c.m[k] = v
+		}
+	} else if len(h.s) > 0 {
+		c.s = make([]entry[K, V], len(h.s), len(h.s)+1)
+		copy(c.s, h.s)
+	}
+	return c
+}
+
+// withSorted is like with, but the copy is a slice sorted by key, however
+// many pairs it has, which find searches by binary search. h must be empty
+// or come from withSorted.
+func (h *mapping[K, V]) withSorted(k K, v V) mapping[K, V] {
+	i := sort.Search(len(h.s), func(i int) bool { return h.s[i].key >= k })
+	c := mapping[K, V]{sorted: true}
+	if i < len(h.s) && h.s[i].key == k {
+		c.s = append([]entry[K, V](nil), h.s...)
+		c.s[i].value = v
+		return c
+	}
+	c.s = make([]entry[K, V], 0, len(h.s)+1)
+	c.s = append(c.s, h.s[:i]...)
+	c.s = append(c.s, entry[K, V]{k, v})
+	c.s = append(c.s, h.s[i:]...)
+	return c
+}
+
+// setSorted is like withSorted, but changes h in place, as set does.
+func (h *mapping[K, V]) setSorted(k K, v V) {
+	i := sort.Search(len(h.s), func(i int) bool { return h.s[i].key >= k })
+	h.sorted = true
+	if i < len(h.s) && h.s[i].key == k {
+		h.s[i].value = v
+		return
+	}
+	h.s = append(h.s, entry[K, V]{})
+	copy(h.s[i+1:], h.s[i:])
+	h.s[i] = entry[K, V]{k, v}
+}
+
 // find returns the value corresponding to the given key.
 // The second return value is false if there is no value
 // with that key.
@@ -49,6 +148,13 @@ func (h *mapping[K, V]) find(k K) (v V, found bool) {
 		v, found = h.m[k]
 		return v, found
 	}
+	if h.sorted {
+		i := sort.Search(len(h.s), func(i int) bool { return h.s[i].key >= k })
+		if i < len(h.s) && h.s[i].key == k {
+			return h.s[i].value, true
+		}
+		return v, false
+	}
 	for _, e := range h.s {
 		if e.key == k {
 			return e.value, true
@@ -77,3 +183,26 @@ func (h *mapping[K, V]) pairs(f func(k K, v V) bool) {
 		}
 	}
 }
+
+// pairsSorted is like pairs, but calls f in key order, so the order
+// is the same whichever representation h uses.
+func (h *mapping[K, V]) pairsSorted(f func(k K, v V) bool) {
+	if h == nil {
+		return
+	}
+	var es []entry[K, V]
+	if h.m != nil {
+		es = make([]entry[K, V], 0, len(h.m))
+		for k, v := range h.m {
+			es = append(es, entry[K, V]{k, v})
+		}
+	} else {
+		es = append(es, h.s...)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].key < es[j].key })
+	for _, e := range es {
+		if !f(e.key, e.value) {
+			return
+		}
+	}
+}
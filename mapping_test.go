@@ -6,8 +6,11 @@ package muxpatterns
 
 import (
 	"fmt"
+	"net/http"
 	"strconv"
 	"testing"
+
+	"golang.org/x/exp/slices"
 )
 
 func TestMapping(t *testing.T) {
@@ -40,6 +43,176 @@ func TestMapping(t *testing.T) {
 	}
 }
 
+// Check that WithMaxSlice sets the number of children above which a node
+// uses a map.
+func TestWithMaxSlice(t *testing.T) {
+	for _, max := range []int{0, 2, 100} {
+		mux := NewServeMux(WithMaxSlice(max))
+		for i := 0; i < 10; i++ {
+			mux.Handle(fmt.Sprintf("/p%d", i), http.NotFoundHandler())
+		}
+		// The path level is below the host and method levels.
+		n := mux.tree.Load().emptyChild.emptyChild
+		if got, want := n.children.m != nil, max < 10; got != want {
+			t.Errorf("max=%d: using map is %t, want %t", max, got, want)
+		}
+		if p, _ := mux.Match("GET", "", "/p7"); p == nil {
+			t.Errorf("max=%d: no match", max)
+		}
+	}
+}
+
+// Benchmark lookups in routing tables of various sizes, with various
+// values of maxSlice.
+func BenchmarkMaxSlice(b *testing.B) {
+	for _, size := range []int{4, 8, 16, 32, 64} {
+		for _, max := range []int{0, 8, 16, 64} {
+			mux := NewServeMux(WithMaxSlice(max))
+			for i := 0; i < size; i++ {
+				mux.Handle(fmt.Sprintf("/p%d", i), http.NotFoundHandler())
+			}
+			path := fmt.Sprintf("/p%d", size-1)
+			b.Run(fmt.Sprintf("size=%d/max=%d", size, max), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					mux.tree.Load().match("GET", "", path)
+				}
+			})
+		}
+	}
+}
+
+func TestMappingSorted(t *testing.T) {
+	var h mapping[string, int]
+	keys := []string{"m", "c", "x", "a", "q", "c", "z", "b"}
+	for i, k := range keys {
+		old := h
+		h = h.withSorted(k, i)
+		if v, _ := old.find(k); k == "c" && i == 5 && v != 1 {
+			t.Errorf("older copy changed: got %d for c, want 1", v)
+		}
+	}
+	var got []string
+	h.pairs(func(k string, _ int) bool {
+		got = append(got, k)
+		return true
+	})
+	if want := []string{"a", "b", "c", "m", "q", "x", "z"}; !slices.Equal(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+	for i, k := range keys {
+		if k == "c" && i == 1 {
+			continue // replaced
+		}
+		if v, ok := h.find(k); !ok || v != i {
+			t.Errorf("find(%q) = %d, %t, want %d, true", k, v, ok, i)
+		}
+	}
+	for _, k := range []string{"", "0", "d", "zz"} {
+		if _, ok := h.find(k); ok {
+			t.Errorf("find(%q): found", k)
+		}
+	}
+}
+
+func TestMappingSet(t *testing.T) {
+	for _, sorted := range []bool{false, true} {
+		var h mapping[string, int]
+		keys := []string{"m", "c", "x", "a", "q", "c", "z", "b", "k", "e"}
+		var old mapping[string, int]
+		for i, k := range keys {
+			if i == 4 {
+				old = h.clone()
+			}
+			if sorted {
+				h.setSorted(k, i)
+			} else {
+				h.set(k, i, 4)
+			}
+		}
+		if v, _ := old.find("c"); v != 1 {
+			t.Errorf("sorted=%t: clone changed: got %d for c, want 1", sorted, v)
+		}
+		if _, ok := old.find("q"); ok {
+			t.Errorf("sorted=%t: clone changed: found q", sorted)
+		}
+		for i, k := range keys {
+			if k == "c" && i == 1 {
+				continue // replaced
+			}
+			if v, ok := h.find(k); !ok || v != i {
+				t.Errorf("sorted=%t: find(%q) = %d, %t, want %d, true", sorted, k, v, ok, i)
+			}
+		}
+		n := 0
+		h.pairs(func(string, int) bool { n++; return true })
+		if n != 9 {
+			t.Errorf("sorted=%t: got %d pairs, want 9", sorted, n)
+		}
+	}
+}
+
+func TestWithChildLookup(t *testing.T) {
+	for _, l := range []ChildLookup{HybridLookup, LinearLookup, MapLookup, SortedLookup} {
+		mux := NewServeMux(WithChildLookup(l))
+		for i := 0; i < 20; i++ {
+			mux.Handle(fmt.Sprintf("/p%d/{x}", i), http.NotFoundHandler())
+		}
+		mux.Handle("/p3/x", http.NotFoundHandler())
+		n := mux.tree.Load().emptyChild.emptyChild
+		if got, want := n.children.m != nil, l == HybridLookup || l == MapLookup; got != want {
+			t.Errorf("lookup %d: using map is %t, want %t", l, got, want)
+		}
+		if got, want := n.children.sorted, l == SortedLookup; got != want {
+			t.Errorf("lookup %d: sorted is %t, want %t", l, got, want)
+		}
+		mux.Compile()
+		for _, test := range []struct{ path, want string }{
+			{"/p0/a", "/p0/{x}"},
+			{"/p19/a", "/p19/{x}"},
+			{"/p3/x", "/p3/x"},
+			{"/p3/y", "/p3/{x}"},
+			{"/p20/a", ""},
+		} {
+			var got string
+			if p, _ := mux.Match("GET", "", test.path); p != nil {
+				got = p.String()
+			}
+			if got != test.want {
+				t.Errorf("lookup %d: %s: got %q, want %q", l, test.path, got, test.want)
+			}
+		}
+	}
+}
+
+// Benchmark lookups in routing trees whose nodes have various numbers of
+// children, for each way of finding a child.
+func BenchmarkChildLookup(b *testing.B) {
+	lookups := []struct {
+		name string
+		l    ChildLookup
+	}{
+		{"hybrid", HybridLookup},
+		{"linear", LinearLookup},
+		{"map", MapLookup},
+		{"sorted", SortedLookup},
+	}
+	for _, size := range []int{2, 4, 8, 16, 32, 64, 256} {
+		for _, lk := range lookups {
+			mux := NewServeMux(WithChildLookup(lk.l))
+			for i := 0; i < size; i++ {
+				mux.Handle(fmt.Sprintf("/p%d/q%d", i, i), http.NotFoundHandler())
+			}
+			path := fmt.Sprintf("/p%d/q%d", size-1, size-1)
+			tree := mux.tree.Load()
+			b.Run(fmt.Sprintf("size=%d/lookup=%s", size, lk.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					tree.match("GET", "", path)
+				}
+			})
+		}
+	}
+}
+
 func BenchmarkFindChild(b *testing.B) {
 	key := "articles"
 	children := []string{
@@ -105,6 +278,18 @@ func BenchmarkFindChild(b *testing.B) {
 				}
 				_ = x
 			})
+			b.Run("rep=sorted", func(b *testing.B) {
+				var h mapping[string, *node]
+				for _, c := range list {
+					h = h.withSorted(c, nil)
+				}
+				var x *node
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					x, _ = h.find(key)
+				}
+				_ = x
+			})
 			b.Run(fmt.Sprintf("rep=hybrid%d", maxSlice), func(b *testing.B) {
 				var h mapping[string, *node]
 				for _, c := range list {
@@ -129,3 +314,37 @@ func findChildLinear(key string, entries []entry[string, *node]) *node {
 	}
 	return nil
 }
+
+func TestPairsSorted(t *testing.T) {
+	// Use enough keys to switch to a map, whose iteration order varies.
+	var h mapping[string, int]
+	var want []string
+	for i := 0; i < 3*maxSlice; i++ {
+		k := fmt.Sprintf("k%02d", i)
+		want = append(want, k)
+		h.add(k, i)
+	}
+	// Add in reverse order to the slice representation.
+	var s mapping[string, int]
+	for i := maxSlice - 1; i >= 0; i-- {
+		s.add(want[i], i)
+	}
+	for i := 0; i < 10; i++ {
+		var got []string
+		h.pairsSorted(func(k string, _ int) bool {
+			got = append(got, k)
+			return true
+		})
+		if !slices.Equal(got, want) {
+			t.Fatalf("map: got %v, want %v", got, want)
+		}
+		got = nil
+		s.pairsSorted(func(k string, _ int) bool {
+			got = append(got, k)
+			return true
+		})
+		if !slices.Equal(got, want[:maxSlice]) {
+			t.Fatalf("slice: got %v, want %v", got, want[:maxSlice])
+		}
+	}
+}
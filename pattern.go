@@ -11,126 +11,937 @@
 package muxpatterns
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/exp/slices"
 )
 
 // A Pattern is something that can be matched against an HTTP request.
 type Pattern struct {
-	str    string // original string
-	method string
-	host   string
+	str     string   // original string
+	methods []string // nil means any method
+	scheme  string   // "https" or "" for any scheme
+	host    string
+	prefix  netip.Prefix // for a CIDR host, the masked prefix; otherwise invalid
 	// The representation of a path differs from the surface syntax.
 	// Paths ending in '/' are represented with an anonymous "..." wildcard.
 	// Paths ending in "{$}" are represented with the literal segment "/".
 	// This makes most algorithms simpler.
 	segments []segment
-	loc      string // source location of registering call, for helpful messages
+	loc      string   // source location of registering call, for helpful messages
+	omitted  string   // name of the optional wildcard left out by expand
+	orig     *Pattern // for a copy made by expand or ServeMux.keyed, the pattern it came from
+	// omittedValue is the value bound to omitted: the default from
+	// "{name=default}", or "".
+	omittedValue string
+	seq          int  // order of registration on a ServeMux, starting at 1
+	delim        byte // segment delimiter from ParseWithDelimiter, or 0 for '/'
+	// mediaType, if not empty, is a media type like "application/json" that
+	// the request's Accept header must allow. See [ServeMux.HandleMediaType].
+	mediaType string
+	// headers are the request headers the pattern requires, sorted by key.
+	// See [ServeMux.HandleHeaders].
+	headers []headerMatch
+	hits    *atomic.Uint64 // matches, for ServeMux.Counts; set on registration
+	// repeats holds pairs of indexes of match values that must be equal,
+	// because their wildcards have the same name.
+	repeats [][2]int
+	meta    *sync.Map // from SetMeta; shared by the patterns from expand
+	pinned  bool      // registered with ServeMux.HandleExact
+	// middleware is from ServeMux.HandleWith. ReHandle wraps the new handler
+	// in it too.
+	middleware []Middleware
+}
 
+// A headerMatch requires a request header. The request must have a header
+// with the key, and if value is not empty, one of its values must be value.
+type headerMatch struct {
+	key   string // in canonical form
+	value string
 }
 
 // A segment is a pattern piece that matches one or more path segments, or
 // a trailing slash.
 // If wild is false, it matches a literal segment, or, if s == "/", a trailing slash.
 // If wild is true and multi is false, it matches a single path segment.
-// If both wild and multi are true, it matches all remaining path segments.
+// If both wild and multi are true, it matches all remaining path segments,
+// or, if it has a suffix, one or more segments followed by the suffix.
 type segment struct {
 	s     string // literal or wildcard name or "/" for "/{$}".
 	wild  bool
 	multi bool // "..." wildcard
+	// suffix holds the literal segments that follow a "{name...}" wildcard,
+	// each after a slash, as in "/files/{path...}/download". It is empty for
+	// other segments.
+	suffix string
+	// optional is true for a final "{name?}" or "{name=default}" wildcard,
+	// and for the final "/?" of a path, which is a segment like that for
+	// "{$}". It is set only on parsed patterns; see [Pattern.expand].
+	optional bool
+	// def is the default of a "{name=default}" wildcard.
+	def string
+	// A "{name:N}" wildcard is represented by N single wildcards with the
+	// same name. span is N, and part is the index of this one among them.
+	// Both are zero for other segments.
+	span, part int
 }
 
+// MaxSpan is the largest N in a "{name:N}" wildcard.
+const MaxSpan = 64
+
+// httpsPrefix begins a pattern that matches only secure requests.
+const httpsPrefix = "https://"
+
+// String returns the string p was parsed from. Parsing it again yields a
+// pattern equal to p. Parsing p.Canonical() yields one that matches the same
+// requests, and has the same canonical form.
 func (p *Pattern) String() string { return p.str }
 
-func (p *Pattern) Method() string { return p.method }
+// Method returns the pattern's method, or a comma-separated list of methods
+// if it has more than one. It returns the empty string if the pattern matches
+// any method.
+func (p *Pattern) Method() string { return strings.Join(p.methods, ",") }
+
+// MediaType returns the media type p was registered for with
+// [ServeMux.HandleMediaType], or the empty string if there is none.
+func (p *Pattern) MediaType() string { return p.mediaType }
+
+// Headers returns the request headers p was registered with by
+// [ServeMux.HandleHeaders], with canonical keys, or nil if it has none.
+// A header with an empty value need only be present.
+func (p *Pattern) Headers() map[string]string {
+	if len(p.headers) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(p.headers))
+	for _, h := range p.headers {
+		m[h.key] = h.value
+	}
+	return m
+}
+
+// SetMeta associates value with key in p's metadata, which is for use by
+// code that consults it after a match, like middleware checking an auth
+// scope. As with context keys, key should be of a type defined by that
+// code. Match returns the pattern from HandlePattern, so a value set on it
+// can be read after each match. SetMeta is safe to call concurrently with
+// Meta and with matching.
+func (p *Pattern) SetMeta(key, value any) {
+	if p.meta == nil {
+		// A Pattern that didn't come from Parse.
+		p.meta = new(sync.Map)
+	}
+	p.meta.Store(key, value)
+}
+
+// Meta returns the value associated with key by SetMeta, or nil if there
+// is none.
+func (p *Pattern) Meta(key any) any {
+	if p.meta == nil {
+		return nil
+	}
+	v, _ := p.meta.Load(key)
+	return v
+}
+
+// checkPinnable returns an error if p can't be registered with
+// [ServeMux.HandleExact].
+func (p *Pattern) checkPinnable() error {
+	for _, s := range p.segments {
+		if s.wild {
+			return fmt.Errorf("pattern %q (registered at %s): exact pattern has a wildcard or trailing slash", p, p.location())
+		}
+	}
+	if isWildcardHost(p.host) || p.prefix.IsValid() {
+		return fmt.Errorf("pattern %q (registered at %s): exact pattern has a wildcard or CIDR host", p, p.location())
+	}
+	if p.scheme != "" {
+		return fmt.Errorf("pattern %q (registered at %s): exact pattern has a scheme", p, p.location())
+	}
+	return nil
+}
+
+// constrained reports whether p has a media type or header constraints,
+// which the request's headers must meet.
+func (p *Pattern) constrained() bool {
+	return p.mediaType != "" || len(p.headers) > 0
+}
+
+// headersMatch reports whether header meets p's header constraints.
+func (p *Pattern) headersMatch(header http.Header) bool {
+	for _, hm := range p.headers {
+		vs, ok := header[hm.key]
+		if !ok {
+			return false
+		}
+		if hm.value != "" && !slices.Contains(vs, hm.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// compareHeaders returns the relationship between the sets of requests
+// that the header constraints of p1 and p2 allow. Constraints with different
+// values for the same key are taken as disjoint, though a request could
+// carry both values.
+func (p1 *Pattern) compareHeaders(p2 *Pattern) relationship {
+	rel := equivalent
+	h1, h2 := p1.headers, p2.headers
+	for len(h1) > 0 || len(h2) > 0 {
+		var keyRel relationship
+		switch {
+		case len(h2) == 0 || len(h1) > 0 && h1[0].key < h2[0].key:
+			keyRel = moreSpecific
+			h1 = h1[1:]
+		case len(h1) == 0 || h2[0].key < h1[0].key:
+			keyRel = moreGeneral
+			h2 = h2[1:]
+		default:
+			switch v1, v2 := h1[0].value, h2[0].value; {
+			case v1 == v2:
+				keyRel = equivalent
+			case v1 == "":
+				keyRel = moreGeneral
+			case v2 == "":
+				keyRel = moreSpecific
+			default:
+				keyRel = disjoint
+			}
+			h1, h2 = h1[1:], h2[1:]
+		}
+		rel = combineRelationships(keyRel, rel)
+	}
+	return rel
+}
 
 func (p *Pattern) debugString() string {
 	var b strings.Builder
-	if p.method != "" {
-		b.WriteString(p.method)
+	if len(p.methods) > 0 {
+		b.WriteString(p.Method())
 		b.WriteByte(' ')
 	}
+	if p.scheme != "" {
+		b.WriteString(p.scheme)
+		b.WriteString("://")
+	}
 	if p.host != "" {
 		b.WriteString(p.host)
 	}
-	for _, s := range p.segments {
+	b.WriteString(p.debugPath())
+	return b.String()
+}
+
+// debugPath returns p's path in the syntax of Parse.
+func (p *Pattern) debugPath() string {
+	var b strings.Builder
+	for i := 0; i < len(p.segments); i++ {
+		s := p.segments[i]
+		if s.span > 0 && s.part == 0 && p.hasSpan(i) {
+			fmt.Fprintf(&b, "/{%s:%d}", s.s, s.span)
+			i += s.span - 1
+			continue
+		}
 		b.WriteString(s.debugString())
 	}
 	return b.String()
 }
 
+// hasSpan reports whether all the parts of the "{name:N}" wildcard starting
+// at p.segments[i] follow it. That may not be true of segments built from
+// those of other patterns.
+func (p *Pattern) hasSpan(i int) bool {
+	s := p.segments[i]
+	if i+s.span > len(p.segments) {
+		return false
+	}
+	for k, t := range p.segments[i : i+s.span] {
+		if t.s != s.s || t.span != s.span || t.part != k {
+			return false
+		}
+	}
+	return true
+}
+
+// Canonical returns a normalized form of p, so that patterns that match
+// the same requests have the same canonical form, which can serve as a key
+// for removing duplicates. The form is itself a pattern. It differs from p's
+// string in these ways:
+//   - Methods are sorted and separated by commas, and HEAD is omitted if GET
+//     is present, since GET matches HEAD too.
+//   - Wildcards are named "w1", "w2" and so on, in order, and a "{name:N}"
+//     wildcard is written as N single wildcards. A repeated wildcard keeps
+//     the name of its first occurrence.
+//   - A final multi wildcard is written as a trailing slash.
+//   - Literal braces are escaped as "{{" and "}}".
+//
+// Hosts and literals are not otherwise changed; in particular, their case
+// is kept.
+func (p *Pattern) Canonical() string {
+	var b strings.Builder
+	if len(p.methods) > 0 {
+		get := false
+		for _, m := range p.methods {
+			get = get || m == "GET"
+		}
+		var ms []string
+		for _, m := range p.methods {
+			if m != "HEAD" || !get {
+				ms = append(ms, m)
+			}
+		}
+		sort.Strings(ms)
+		b.WriteString(strings.Join(ms, ","))
+		b.WriteByte(' ')
+	}
+	if p.scheme != "" {
+		b.WriteString(httpsPrefix)
+	}
+	b.WriteString(p.host)
+	n := 0
+	nums := map[string]int{} // for repeated wildcards
+	for _, s := range p.segments {
+		switch {
+		case s.multi && s.suffix != "":
+			n++
+			fmt.Fprintf(&b, "/{w%d...}", n)
+			writeSuffix(&b, s.suffixLits())
+		case s.multi:
+			b.WriteByte('/')
+		case s.wild:
+			k, ok := nums[s.s]
+			if !ok || s.span > 0 {
+				n++
+				k = n
+				nums[s.s] = k
+			}
+			fmt.Fprintf(&b, "/{w%d", k)
+			if s.optional {
+				b.WriteByte('?')
+			}
+			b.WriteByte('}')
+		case s.optional:
+			b.WriteString("/?")
+		case s.s == "/":
+			b.WriteString("/{$}")
+		default:
+			b.WriteByte('/')
+			b.WriteString(escapeBraces(s.s))
+		}
+	}
+	return b.String()
+}
+
+// suffixLits returns the literal segments of s.suffix.
+func (s segment) suffixLits() []string {
+	if s.suffix == "" {
+		return nil
+	}
+	return strings.Split(s.suffix[1:], "/")
+}
+
+// writeSuffix writes the literal segments of a multi wildcard's suffix to b.
+func writeSuffix(b *strings.Builder, suffix []string) {
+	for _, lit := range suffix {
+		b.WriteByte('/')
+		b.WriteString(escapeBraces(lit))
+	}
+}
+
+// escapeBraces is the inverse of unescapeBraces.
+func escapeBraces(s string) string {
+	if strings.IndexAny(s, "{}") < 0 {
+		return s
+	}
+	return strings.NewReplacer("{", "{{", "}", "}}").Replace(s)
+}
+
 func (s segment) debugString() string {
 	switch {
+	case s.multi && s.s == "":
+		return "/"
 	case s.multi:
-		return fmt.Sprintf("/{%s...}", s.s)
+		var b strings.Builder
+		fmt.Fprintf(&b, "/{%s...}", s.s)
+		writeSuffix(&b, s.suffixLits())
+		return b.String()
+	case s.optional && !s.wild:
+		return "/?"
+	case s.optional && s.def != "":
+		return fmt.Sprintf("/{%s=%s}", s.s, s.def)
+	case s.optional:
+		return fmt.Sprintf("/{%s?}", s.s)
 	case s.wild:
 		return fmt.Sprintf("/{%s}", s.s)
 	case s.s == "/":
-		return "/"
+		return "/{$}"
 	default: // Literal.
-		return "/" + s.s
+		return "/" + escapeBraces(s.s)
+	}
+}
+
+// Wildcards returns the names of p's wildcards, in the order they appear.
+// The anonymous wildcard of a pattern ending in a slash is omitted, and a
+// name that is repeated (see [WithRepeatedWildcards]) is listed once.
+func (p *Pattern) Wildcards() []string {
+	var names []string
+	for _, seg := range p.segments {
+		if seg.wild && seg.s != "" && seg.part == 0 {
+			if len(p.repeats) > 0 && slices.Contains(names, seg.s) {
+				continue
+			}
+			names = append(names, seg.s)
+		}
+	}
+	return names
+}
+
+// OpenAPIPath returns p's path in the form of an OpenAPI path template,
+// without p's method or host. Each wildcard becomes "{name}".
+// OpenAPI has no wildcard that matches several segments, so a multi
+// wildcard "{name...}" also becomes "{name}", as does "{name:N}"; the
+// parameter's value may then contain slashes. A trailing slash and "{$}"
+// both become "/". Literals after a multi wildcard are kept.
+func (p *Pattern) OpenAPIPath() string {
+	var b strings.Builder
+	for _, seg := range p.segments {
+		switch {
+		case seg.part > 0:
+			// Written with the first part.
+		case seg.wild && seg.s == "":
+			b.WriteByte('/')
+		case seg.wild:
+			b.WriteString("/{")
+			b.WriteString(seg.s)
+			b.WriteByte('}')
+			b.WriteString(seg.suffix)
+		case seg.s == "/":
+			b.WriteByte('/')
+		default:
+			b.WriteByte('/')
+			b.WriteString(seg.s)
+		}
+	}
+	return b.String()
+}
+
+// OpenAPIParameters returns the names of the path parameters in
+// p.OpenAPIPath(), in order.
+func (p *Pattern) OpenAPIParameters() []string {
+	return p.Wildcards()
+}
+
+// Build returns a path that p matches, with each wildcard replaced by its
+// value in values. Values are escaped, so a slash in the value of a single
+// wildcard becomes "%2F"; the value of a multi wildcard may contain slashes
+// that separate segments, but must not be empty if literals follow it. The
+// value of a "{name:N}" wildcard must consist of N non-empty segments
+// separated by slashes. The value of an optional wildcard may be missing or
+// empty, in which case its segment is omitted, as it is if the value is the
+// wildcard's default. Build returns an error if any other wildcard lacks a
+// non-empty value. Extra values are ignored.
+// The result does not include p's method or host.
+// For a pattern from [ParseWithDelimiter], the result uses the pattern's
+// delimiter, and nothing is escaped.
+func (p *Pattern) Build(values map[string]string) (string, error) {
+	escape := url.PathEscape
+	if p.delim != 0 {
+		escape = func(s string) string { return s }
+	}
+	var b strings.Builder
+	for _, seg := range p.segments {
+		switch {
+		case seg.optional && !seg.wild:
+			// Build the path without the optional slash.
+		case !seg.wild:
+			b.WriteByte('/')
+			if seg.s != "/" {
+				b.WriteString(escape(seg.s))
+			}
+		case seg.s == "":
+			// Trailing slash.
+			b.WriteByte('/')
+		case seg.part > 0:
+			// Written with the first part.
+		default:
+			v, ok := values[seg.s]
+			if seg.optional && (v == "" || v == seg.def) {
+				continue
+			}
+			if !ok {
+				return "", fmt.Errorf("pattern %q: missing value for wildcard %q", p, seg.s)
+			}
+			if v == "" && (!seg.multi || seg.suffix != "") {
+				return "", fmt.Errorf("pattern %q: empty value for wildcard %q", p, seg.s)
+			}
+			if p.delim != 0 {
+				// Work in terms of slashes, like the rest of p.
+				v = swapDelim(v, p.delim)
+			}
+			if seg.span > 0 {
+				if n := strings.Count(v, "/") + 1; n != seg.span || strings.Contains("/"+v+"/", "//") {
+					return "", fmt.Errorf("pattern %q: value %q for wildcard %q is not %d non-empty segments", p, values[seg.s], seg.s, seg.span)
+				}
+			}
+			b.WriteByte('/')
+			if seg.multi || seg.span > 0 {
+				parts := strings.Split(v, "/")
+				for i, part := range parts {
+					parts[i] = escape(part)
+				}
+				b.WriteString(strings.Join(parts, "/"))
+				for _, lit := range seg.suffixLits() {
+					b.WriteByte('/')
+					b.WriteString(escape(lit))
+				}
+			} else {
+				b.WriteString(escape(v))
+			}
+		}
+	}
+	if b.Len() == 0 {
+		// An optional wildcard was the only segment.
+		b.WriteByte('/')
+	}
+	if p.delim != 0 {
+		return swapDelim(b.String()[1:], p.delim), nil
+	}
+	return b.String(), nil
+}
+
+// WithRenamedWildcards returns a copy of p in which each wildcard whose name
+// is a key of rename has the corresponding value as its name instead.
+// The copy has the same media type and headers as p, but is not registered
+// on any ServeMux and has none of p's metadata. Its string is built from its
+// parts, so it may differ from p's in ways that don't affect matching.
+// WithRenamedWildcards returns an error if a new name is invalid or would be
+// the name of another wildcard.
+func (p *Pattern) WithRenamedWildcards(rename map[string]string) (*Pattern, error) {
+	q := *p
+	q.segments = make([]segment, len(p.segments))
+	olds := map[string]string{} // from new name to old
+	for i, s := range p.segments {
+		if s.wild && s.s != "" {
+			name := s.s
+			if n, ok := rename[name]; ok {
+				name = n
+			}
+			if old, ok := olds[name]; ok && old != s.s {
+				return nil, fmt.Errorf("pattern %q: renaming %q and %q to %q gives duplicate wildcard names", p, old, s.s, name)
+			}
+			olds[name] = s.s
+			s.s = name
+		}
+		q.segments[i] = s
+	}
+	str, d := q.debugString(), byte('/')
+	if p.delim != 0 {
+		// Patterns with a delimiter have no host.
+		methods := ""
+		if len(p.methods) > 0 {
+			methods = p.Method() + " "
+		}
+		str, d = methods+swapPatternDelim(q.debugPath()[1:], p.delim, '/'), p.delim
+	}
+	r, err := parseWithDelimiter(str, d, len(p.repeats) > 0)
+	if err != nil {
+		return nil, fmt.Errorf("pattern %q: renaming wildcards: %w", p, err)
+	}
+	r.mediaType = p.mediaType
+	r.headers = p.headers
+	return r, nil
+}
+
+// NumWildcards returns the number of p's named wildcards, which is
+// len(p.Wildcards()).
+func (p *Pattern) NumWildcards() int {
+	// Each repeat of a name adds a pair to p.repeats.
+	n := -len(p.repeats)
+	for _, seg := range p.segments {
+		if seg.wild && seg.s != "" && seg.part == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// IsStatic reports whether p's path has no wildcards, counting a trailing
+// slash as one, so that p matches only one path. A response for such a
+// pattern may be safe to cache by path. The host and method aren't
+// considered.
+func (p *Pattern) IsStatic() bool {
+	for _, s := range p.segments {
+		if s.wild {
+			return false
+		}
+	}
+	return true
+}
+
+// HasMultiWildcard reports whether p ends in a "{name...}" wildcard.
+// A trailing slash, though it matches like one, does not count.
+func (p *Pattern) HasMultiWildcard() bool {
+	last := p.lastSegment()
+	return last.multi && last.s != ""
+}
+
+// MatchPath reports whether p matches a request with the given method, host
+// and path, as if it were the only pattern registered on a ServeMux, and
+// returns the values of its wildcards as Match does. The request is taken to
+// meet any scheme, media type and header constraints of p. For a pattern
+// from [ParseWithDelimiter], path uses p's delimiter.
+func (p *Pattern) MatchPath(method, host, path string) (map[string]string, bool) {
+	root := &node{}
+	for _, q := range p.expand() {
+		var err error
+		if root, err = root.addPattern(0, q, nil); err != nil {
+			return nil, false
+		}
+	}
+	if p.delim != 0 {
+		path = "/" + swapDelim(path, p.delim)
+	}
+	n, matches := root.matchSchemeInto(nil, true, method, host, path, nil)
+	if n == nil {
+		return nil, false
+	}
+	return n.pattern.bind(matches, false), true
+}
+
+// bind returns a map from the names of p's wildcards to the corresponding
+// values in matches, which are in the order the wildcards appear.
+// The values are percent-decoded unless raw is true.
+// It returns nil if p has no named wildcards.
+func (p *Pattern) bind(matches []string, raw bool) map[string]string {
+	if len(matches) == 0 && p.omitted == "" {
+		return nil
+	}
+	m := make(map[string]string, len(matches)+1)
+	if p.omitted != "" {
+		m[p.omitted] = p.omittedValue
+	}
+	i := 0
+	for _, seg := range p.segments {
+		if seg.wild && seg.s != "" {
+			v := matches[i]
+			if !raw {
+				v = matchValue(v)
+			}
+			if seg.part > 0 {
+				v = m[seg.s] + "/" + v
+			}
+			m[seg.s] = v
+			i++
+		}
+	}
+	if p.delim != 0 {
+		for k, v := range m {
+			m[k] = swapDelim(v, p.delim)
+		}
+	}
+	return m
+}
+
+// A Binding is the name of a wildcard and the value it matched.
+type Binding struct {
+	Name, Value string
+}
+
+// BindSlice returns, given the values from [ServeMux.MatchInto], the name
+// and value of each of p's wildcards in the order they appear, which is that
+// of the names from [Pattern.Wildcards], so a repeated name appears once.
+// The values are percent-decoded. The value of a "{name:N}" wildcard is its
+// segments joined by slashes, and an omitted optional wildcard is bound to
+// its default, or "" if it has none.
+// BindSlice returns nil if p has no named wildcards.
+func (p *Pattern) BindSlice(matches []string) []Binding {
+	var bs []Binding
+	i := 0
+	for _, seg := range p.segments {
+		if !seg.wild || seg.s == "" {
+			continue
+		}
+		if seg.optional && i == len(matches) {
+			// The request matched the form of p without the wildcard.
+			bs = append(bs, Binding{seg.s, seg.def})
+			continue
+		}
+		v := matchValue(matches[i])
+		i++
+		if seg.part > 0 {
+			bs[len(bs)-1].Value += "/" + v
+			continue
+		}
+		if len(p.repeats) > 0 && slices.ContainsFunc(bs, func(b Binding) bool { return b.Name == seg.s }) {
+			// A repeated name, whose values all agree.
+			continue
+		}
+		bs = append(bs, Binding{seg.s, v})
+	}
+	if p.omitted != "" {
+		bs = append(bs, Binding{p.omitted, p.omittedValue})
+	}
+	return bs
+}
+
+// BindMulti splits the value of p's multi wildcard into path segments.
+// Given the values from [ServeMux.MatchInto], it returns a map from the name
+// of the multi wildcard to the segments it matched. Each segment is
+// percent-decoded separately, so an encoded slash stays within its segment.
+// A multi wildcard that matched nothing, as when "/a/{rest...}" matches "/a/",
+// maps to an empty slice.
+// BindMulti returns nil if p has no named multi wildcard.
+func (p *Pattern) BindMulti(matches []string) map[string][]string {
+	last := p.lastSegment()
+	if !last.multi || last.s == "" || len(matches) == 0 {
+		return nil
+	}
+	v := matches[len(matches)-1]
+	segs := []string{}
+	if v != "" {
+		segs = strings.Split(v, "/")
+		for i, s := range segs {
+			segs[i] = unescapeSegment(s)
+		}
+	}
+	return map[string][]string{last.s: segs}
+}
+
+// location returns where p was registered, for messages.
+func (p *Pattern) location() string {
+	if p.loc == "" {
+		return "unknown location"
+	}
+	return p.loc
+}
+
+// repeatsAgree reports whether the values that p's repeated wildcards
+// match are equal.
+func (p *Pattern) repeatsAgree(matches []string) bool {
+	for _, r := range p.repeats {
+		if matches[r[0]] != matches[r[1]] {
+			return false
+		}
 	}
+	return true
 }
 
 func (p *Pattern) lastSegment() segment {
 	return p.segments[len(p.segments)-1]
 }
 
+// Errors that Parse and ParseWithDelimiter report, wrapped in a
+// [*ParseError]. Test for them with [errors.Is].
+var (
+	ErrEmptyPattern      = errors.New("empty pattern")
+	ErrBadMethod         = errors.New("bad method")
+	ErrMissingSlash      = errors.New("missing slash")
+	ErrBadHost           = errors.New("bad host")
+	ErrUncleanPath       = errors.New("unclean path")
+	ErrBadWildcard       = errors.New("bad wildcard")
+	ErrDuplicateWildcard = errors.New("duplicate wildcard name")
+	ErrBadDelimiter      = errors.New("bad segment delimiter")
+)
+
+// A ParseError describes why a pattern string could not be parsed.
+type ParseError struct {
+	Kind   error // one of the Err variables above
+	Err    error // the details
+	Offset int   // byte offset in the pattern string, or -1 if none applies
+}
+
+func (e *ParseError) Error() string {
+	if e.Offset < 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("at offset %d: %v", e.Offset, e.Err)
+}
+
+// Unwrap returns e.Kind and e.Err, so that errors.Is and errors.As see
+// both the kind of the error and any error that caused it.
+func (e *ParseError) Unwrap() []error { return []error{e.Kind, e.Err} }
+
+// parseError returns a *ParseError of the given kind at offset, with
+// details formatted as by fmt.Errorf.
+func parseError(kind error, offset int, format string, args ...any) error {
+	return &ParseError{Kind: kind, Err: fmt.Errorf(format, args...), Offset: offset}
+}
+
+// shiftOffset adds n to the offset of err, a *ParseError from parsing part
+// of a pattern string, so that it is an offset in the whole string.
+func shiftOffset(err error, n int) error {
+	if e, ok := err.(*ParseError); ok && e.Offset >= 0 {
+		c := *e
+		c.Offset += n
+		return &c
+	}
+	return err
+}
+
 // Parse parses a string into a Pattern.
 // The string's syntax is
 //
-//	[METHOD] [HOST]/[PATH]
+//	[METHOD] [https://][HOST]/[PATH]
 //
 // where:
-//   - METHOD is the uppercase name of an HTTP method
-//   - HOST is a hostname
+//   - METHOD is the uppercase name of an HTTP method, or a list of them
+//     separated by commas or spaces
+//   - "https://" restricts the pattern to secure requests
+//   - HOST is a hostname, a wildcard host like "*.example.com", an IP
+//     address, or a CIDR block in brackets, like "[10.0.0.0/8]"
 //   - PATH consists of slash-separated segments, where each segment is either
-//     a literal or a wildcard of the form "{name}", "{name...}", or "{$}".
+//     a literal or a wildcard of the form "{name}", "{name:N}", "{name...}",
+//     "{name?}", "{name=default}" or "{$}".
 //
 // METHOD, HOST and PATH are all optional; that is, the string can be "/".
-// If METHOD is present, it must be followed by a single space.
+// If PATH is empty, the slash before it may be omitted too, so
+// "maintenance.example.com" is the same as "maintenance.example.com/" and
+// matches every path on that host, with lower precedence than any other
+// pattern for the host. This short form requires a host that contains a
+// '.' or ':', or is in brackets.
+// If METHOD is present, it must be followed by one or more spaces.
+// A pattern with several methods matches a request with any of them.
+// A pattern with a CIDR host matches requests whose host is an IP address
+// in the block. A pattern whose host is more specific than another's wins,
+// so "[10.1.0.0/16]" takes precedence over "[10.0.0.0/8]", and "10.1.2.3"
+// over both. Similarly, a pattern with the host "*.example.com" matches
+// requests to every host that ends in ".example.com", and "a.example.com"
+// takes precedence over it, as it does over "*.com".
 // Wildcard names must be valid Go identifiers.
-// The "{$}" and "{name...}" wildcard must occur at the end of PATH.
+// In a literal segment, "{{" and "}}" stand for "{" and "}", so
+// "/files/{{name}}" matches the path "/files/{name}".
+// The "{$}", "{name?}" and "{name=default}" wildcards must occur at the end
+// of PATH.
+// The "{name...}" wildcard must too, or else be followed only by literal
+// segments. Then it matches one or more segments before them, so
+// "/files/{path...}/download" matches "/files/a/b/download" with path bound
+// to "a/b".
+// A pattern ending in the optional wildcard "{name?}" matches paths with or
+// without the final segment; for instance, "/items/{id?}" matches both
+// "/items" and "/items/42". When the segment is absent, name is bound to
+// the empty string. The wildcard "{name=default}" is the same, except that
+// name is bound to default instead, so "/list/{page=1}" matches "/list" with
+// page bound to "1". The default may contain any characters but '/' and '}'.
+// A path ending in "/?" after a literal or a wildcard other than "{name...}"
+// matches with or without a trailing slash, so "/items/?" matches "/items"
+// and "/items/", and nothing else. "?" is otherwise an ordinary literal
+// segment.
+// The wildcard "{name:N}", where N is a positive integer no greater than
+// [MaxSpan], matches exactly N segments, and name is bound to them joined by
+// slashes. For example, "/archive/{date:3}/article" matches
+// "/archive/2024/01/15/article" with date bound to "2024/01/15". It is
+// equivalent to N single wildcards for the purposes of precedence and
+// conflicts.
 // PATH may end with a '/'.
-// Wildcard names in a path must be distinct.
+// Wildcard names in a path must be distinct, except in patterns registered
+// on a ServeMux created with [WithRepeatedWildcards].
 func Parse(s string) (*Pattern, error) {
+	return parse(s, false)
+}
+
+// parse implements Parse. If repeats is true, a single wildcard's name may
+// be that of an earlier single wildcard; see [WithRepeatedWildcards].
+func parse(s string, repeats bool) (*Pattern, error) {
 	if len(s) == 0 {
-		return nil, errors.New("empty pattern")
+		return nil, parseError(ErrEmptyPattern, 0, "empty pattern")
 	}
-	method, rest, found := strings.Cut(s, " ")
-	if !found {
-		rest = method
-		method = ""
+	// The methods are separated from the host and path by the last space
+	// before the first slash.
+	rest := s
+	slash := strings.IndexByte(s, '/')
+	if slash < 0 {
+		slash = len(s)
 	}
-	if method != "" && !isValidHTTPToken(method) {
-		return nil, fmt.Errorf("bad method %q", method)
+	var methods []string
+	if i := strings.LastIndexByte(s[:slash], ' '); i >= 0 {
+		var err error
+		methods, err = parseMethods(s[:i])
+		if err != nil {
+			return nil, err
+		}
+		rest = s[i+1:]
 	}
-	p := &Pattern{str: s, method: method}
+	p := &Pattern{str: s, methods: methods, meta: new(sync.Map)}
+	hostOff := len(s) - len(rest)
 
-	i := strings.IndexByte(rest, '/')
+	if r, ok := strings.CutPrefix(rest, httpsPrefix); ok {
+		p.scheme = "https"
+		rest = r
+		hostOff += len(httpsPrefix)
+	}
+	// A bracketed host may contain a slash.
+	hostStart := 0
+	if strings.HasPrefix(rest, "[") {
+		if j := strings.IndexByte(rest, ']'); j >= 0 {
+			hostStart = j
+		}
+	}
+	i := strings.IndexByte(rest[hostStart:], '/')
 	if i < 0 {
-		return nil, errors.New("host/path missing /")
+		// A host alone is short for the host followed by "/", but insist
+		// on something that looks like a host, so that a lone method is
+		// still an error.
+		if !strings.ContainsAny(rest, ".:]") || strings.ContainsAny(rest, " {") {
+			return nil, parseError(ErrMissingSlash, len(s), "host/path missing /")
+		}
+		i = len(rest)
+		rest += "/"
+	} else {
+		i += hostStart
 	}
 	p.host = rest[:i]
 	rest = rest[i:]
-	if strings.IndexByte(p.host, '{') >= 0 {
-		return nil, errors.New("host contains '{' (missing initial '/'?")
+	pathOff := hostOff + i
+	if j := strings.IndexByte(p.host, '{'); j >= 0 {
+		return nil, parseError(ErrBadHost, hostOff+j, "host contains '{' (missing initial '/'?")
+	}
+	if i := strings.IndexByte(p.host, '*'); i >= 0 && (i > 0 || len(p.host) <= 2 || p.host[1] != '.' || strings.IndexByte(p.host[1:], '*') >= 0) {
+		return nil, parseError(ErrBadHost, hostOff+i, "bad wildcard host %q (must be \"*.\" followed by a name)", p.host)
+	}
+	if strings.HasPrefix(p.host, "[") && strings.IndexByte(p.host, '/') >= 0 {
+		if !strings.HasSuffix(p.host, "]") {
+			return nil, parseError(ErrBadHost, hostOff, "bad CIDR host (missing ']')")
+		}
+		prefix, err := netip.ParsePrefix(p.host[1 : len(p.host)-1])
+		if err != nil {
+			return nil, parseError(ErrBadHost, hostOff, "bad CIDR host: %w", err)
+		}
+		// Use a canonical form, because the host is a key in the routing tree.
+		p.prefix = prefix.Masked()
+		p.host = "[" + p.prefix.String() + "]"
 	}
 	// At this point, rest is the path.
 
 	// An unclean path with a method that is not CONNECT can never match,
 	// because paths are cleaned before matching.
-	if method != "" && method != "CONNECT" && rest != cleanPath(rest) {
-		return nil, errors.New("non-CONNECT pattern with unclean path can never match")
+	if len(p.methods) > 0 && !p.onlyConnect() && rest != cleanPath(rest) {
+		return nil, parseError(ErrUncleanPath, pathOff+firstDifference(rest, cleanPath(rest)), "non-CONNECT pattern with unclean path can never match")
 	}
 
-	seenNames := map[string]bool{}
+	// seenNames maps the name of each wildcard to the index of its value
+	// among the match values, or to -1 if it is not a single wildcard.
+	seenNames := map[string]int{}
+	nvalues := 0
+	path := rest
 	for len(rest) > 0 {
 		// Invariant: rest[0] == '/'.
 		rest = rest[1:]
+		segOff := pathOff + len(path) - len(rest)
 		if len(rest) == 0 {
 			// Trailing slash.
 			p.segments = append(p.segments, segment{wild: true, multi: true})
@@ -142,49 +953,406 @@ func Parse(s string) (*Pattern, error) {
 		}
 		var seg string
 		seg, rest = rest[:i], rest[i:]
-		if i := strings.IndexByte(seg, '{'); i < 0 {
+		if seg == "?" && len(rest) == 0 {
+			// Optional trailing slash.
+			if len(p.segments) == 0 {
+				return nil, parseError(ErrBadWildcard, segOff, "optional slash \"/?\" must follow a segment")
+			}
+			p.segments = append(p.segments, segment{s: "/", optional: true})
+			break
+		}
+		if seg == "" || seg[0] != '{' || strings.HasPrefix(seg, "{{") {
 			// Literal.
-			p.segments = append(p.segments, segment{s: seg})
+			lit, err := unescapeBraces(seg)
+			if err != nil {
+				return nil, shiftOffset(err, segOff)
+			}
+			p.segments = append(p.segments, segment{s: lit})
 		} else {
 			// Wildcard.
-			if i != 0 {
-				return nil, errors.New("bad wildcard segment (must start with '{')")
-			}
 			if seg[len(seg)-1] != '}' {
-				return nil, errors.New("bad wildcard segment (must end with '}')")
+				return nil, parseError(ErrBadWildcard, segOff, "bad wildcard segment (must end with '}')")
 			}
 			name := seg[1 : len(seg)-1]
 			if name == "$" {
 				if len(rest) != 0 {
-					return nil, errors.New("{$} not at end")
+					return nil, parseError(ErrBadWildcard, segOff+len(seg), "{$} not at end")
 				}
 				p.segments = append(p.segments, segment{s: "/"})
 				break
 			}
-			var multi bool
+			var multi, optional bool
+			var suffix, def string
 			if strings.HasSuffix(name, "...") {
 				multi = true
 				name = name[:len(name)-3]
 				if len(rest) != 0 {
-					return nil, errors.New("{...} wildcard not at end")
+					var err error
+					if suffix, err = parseSuffix(rest); err != nil {
+						return nil, shiftOffset(err, segOff+len(seg))
+					}
+					rest = ""
+				}
+			} else if j := strings.IndexByte(name, '='); j >= 0 {
+				optional = true
+				def = name[j+1:]
+				name = name[:j]
+				if def == "" {
+					return nil, parseError(ErrBadWildcard, segOff+j+2, "empty default for wildcard %q", name)
+				}
+				if len(rest) != 0 {
+					return nil, parseError(ErrBadWildcard, segOff+len(seg), "wildcard with default not at end")
+				}
+			} else if strings.HasSuffix(name, "?") {
+				optional = true
+				name = name[:len(name)-1]
+				if len(rest) != 0 {
+					return nil, parseError(ErrBadWildcard, segOff+len(seg), "{?} wildcard not at end")
+				}
+			}
+			span := 0
+			if j := strings.LastIndexByte(name, ':'); j >= 0 && !multi && !optional {
+				n, err := strconv.Atoi(name[j+1:])
+				if err != nil || n < 1 {
+					return nil, parseError(ErrBadWildcard, segOff+j+2, "bad wildcard segment count %q", name[j+1:])
+				}
+				if n > MaxSpan {
+					return nil, parseError(ErrBadWildcard, segOff+j+2, "wildcard segment count %d greater than %d", n, MaxSpan)
 				}
+				span = n
+				name = name[:j]
 			}
 			if name == "" {
-				return nil, errors.New("empty wildcard")
+				return nil, parseError(ErrBadWildcard, segOff+1, "empty wildcard")
 			}
 			if !isValidWildcardName(name) {
-				return nil, fmt.Errorf("bad wildcard name %q", name)
+				return nil, parseError(ErrBadWildcard, segOff+1, "bad wildcard name %q", name)
 			}
-			if seenNames[name] {
-				return nil, fmt.Errorf("duplicate wildcard name %q", name)
+			if wildcardValidator != nil {
+				if err := wildcardValidator(name); err != nil {
+					return nil, parseError(ErrBadWildcard, segOff+1, "bad wildcard name %q: %w", name, err)
+				}
+			}
+			if i, ok := seenNames[name]; ok {
+				if !repeats {
+					return nil, parseError(ErrDuplicateWildcard, segOff+1, "duplicate wildcard name %q", name)
+				}
+				if i < 0 || span > 0 || multi || optional {
+					return nil, parseError(ErrDuplicateWildcard, segOff+1, "repeated wildcard name %q must name only single wildcards", name)
+				}
+				p.repeats = append(p.repeats, [2]int{i, nvalues})
+			} else if span > 0 || multi || optional {
+				seenNames[name] = -1
+			} else {
+				seenNames[name] = nvalues
+			}
+			if span > 0 {
+				for k := 0; k < span; k++ {
+					p.segments = append(p.segments, segment{s: name, wild: true, span: span, part: k})
+				}
+				nvalues += span
+				continue
 			}
-			seenNames[name] = true
-			p.segments = append(p.segments, segment{s: name, wild: true, multi: multi})
+			p.segments = append(p.segments, segment{s: name, wild: true, multi: multi, optional: optional, suffix: suffix, def: def})
+			nvalues++
 		}
 	}
 	return p, nil
 }
 
+// parseSuffix parses the rest of a path after a "{name...}" wildcard, which
+// must be literal segments, and returns it with them unescaped. Offsets in
+// errors are in rest.
+func parseSuffix(rest string) (string, error) {
+	var b strings.Builder
+	off := 1
+	segs := strings.Split(rest[1:], "/")
+	for i, seg := range segs {
+		if seg == "" || seg[0] == '{' && !strings.HasPrefix(seg, "{{") {
+			return "", parseError(ErrBadWildcard, off, "{...} wildcard not at end or followed by literals")
+		}
+		if seg == "?" && i == len(segs)-1 {
+			return "", parseError(ErrBadWildcard, off, "optional slash \"/?\" after a {...} wildcard")
+		}
+		lit, err := unescapeBraces(seg)
+		if err != nil {
+			return "", shiftOffset(err, off)
+		}
+		b.WriteByte('/')
+		b.WriteString(lit)
+		off += len(seg) + 1
+	}
+	return b.String(), nil
+}
+
+// ParseLines parses the patterns in r, one per line. Leading and trailing
+// white space is ignored, as are blank lines and lines beginning with '#'.
+// Each pattern's location in errors from registering it is its line number,
+// starting at 1. ParseLines returns the first error from reading r or from
+// parsing a line, which includes the line number.
+func ParseLines(r io.Reader) ([]*Pattern, error) {
+	var pats []*Pattern
+	scan := bufio.NewScanner(r)
+	for n := 1; scan.Scan(); n++ {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p, err := Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d %q: %w", n, line, err)
+		}
+		p.loc = fmt.Sprintf("line %d", n)
+		pats = append(pats, p)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	return pats, nil
+}
+
+// ParseWithDelimiter is like Parse, but for paths whose segments are
+// separated by d instead of '/', like "com.example.{service}" with d == '.'.
+// The string's syntax is
+//
+//	[METHOD ]PATH
+//
+// where PATH does not begin with d, and there is no host. A final d is like
+// a trailing slash. The pattern operates on slashes internally, by
+// exchanging each d in the string with a '/', so a slash is an ordinary
+// character in a segment. Use the pattern with a ServeMux created with
+// [WithSegmentDelimiter].
+func ParseWithDelimiter(s string, d byte) (*Pattern, error) {
+	return parseWithDelimiter(s, d, false)
+}
+
+// parseWithDelimiter implements ParseWithDelimiter, with repeats as for parse.
+func parseWithDelimiter(s string, d byte, repeats bool) (*Pattern, error) {
+	if d == '/' {
+		return parse(s, repeats)
+	}
+	if d <= ' ' || d >= utf8.RuneSelf || strings.IndexByte("{}%,", d) >= 0 {
+		return nil, parseError(ErrBadDelimiter, -1, "bad segment delimiter %q", d)
+	}
+	// As in parse, the methods are separated from the path by the last
+	// space before the end of the first segment, so later segments may
+	// contain spaces.
+	methods, path := "", s
+	end := strings.IndexByte(s, d)
+	if end < 0 {
+		end = len(s)
+	}
+	if i := strings.LastIndexByte(s[:end], ' '); i >= 0 {
+		methods, path = s[:i+1], s[i+1:]
+	}
+	p, err := parse(methods+"/"+swapPatternDelim(path, d, d), repeats)
+	if err != nil {
+		// Account for the added slash.
+		if e, ok := err.(*ParseError); ok && e.Offset > len(methods) {
+			err = shiftOffset(err, -1)
+		}
+		return nil, err
+	}
+	p.str = s
+	p.delim = d
+	return p, nil
+}
+
+// swapDelim returns s with each d replaced by '/' and each '/' by d.
+// It is its own inverse.
+func swapDelim(s string, d byte) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch c {
+		case d:
+			b[i] = '/'
+		case '/':
+			b[i] = d
+		}
+	}
+	return string(b)
+}
+
+// swapPatternDelim is like swapDelim, but leaves the insides of wildcards
+// alone, so "{rest...}" keeps its dots. The segments of s are separated by
+// sep, which is d or '/'.
+func swapPatternDelim(s string, d, sep byte) string {
+	b := []byte(s)
+	segStart := true
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if segStart && c == '{' && !strings.HasPrefix(s[i:], "{{") {
+			j := strings.IndexByte(s[i:], '}')
+			if j < 0 {
+				break
+			}
+			i += j
+			segStart = false
+			continue
+		}
+		segStart = c == sep
+		switch c {
+		case d:
+			b[i] = '/'
+		case '/':
+			b[i] = d
+		}
+	}
+	return string(b)
+}
+
+// ValidateOptions describe the constraints that [Pattern.Validate] checks.
+// The zero value checks nothing.
+type ValidateOptions struct {
+	// MaxWildcards, if positive, is the largest number of named wildcards
+	// a pattern may have, counting a repeated name once.
+	MaxWildcards int
+	// CatchAllMultis requires that a pattern with a "{name...}" wildcard or a
+	// trailing slash have nothing else in its path, like "/{path...}" or "/".
+	CatchAllMultis bool
+	// RequireHost requires a host.
+	RequireHost bool
+	// RequireMethod requires at least one method.
+	RequireMethod bool
+}
+
+// Validate reports whether p meets the constraints of opts, which go beyond
+// the syntax that Parse checks. This lets a project enforce its own
+// conventions, for example in tests over all its patterns.
+// It returns an error describing every constraint that p violates,
+// or nil if there are none.
+func (p *Pattern) Validate(opts ValidateOptions) error {
+	var errs []error
+	if n := p.NumWildcards(); opts.MaxWildcards > 0 && n > opts.MaxWildcards {
+		errs = append(errs, fmt.Errorf("pattern %q: %d wildcards, more than %d", p, n, opts.MaxWildcards))
+	}
+	if opts.CatchAllMultis && p.lastSegment().multi && len(p.segments) > 1 {
+		errs = append(errs, fmt.Errorf("pattern %q: multi wildcard or trailing slash in a pattern that is not a catch-all", p))
+	}
+	if opts.RequireHost && p.host == "" {
+		errs = append(errs, fmt.Errorf("pattern %q: missing host", p))
+	}
+	if opts.RequireMethod && len(p.methods) == 0 {
+		errs = append(errs, fmt.Errorf("pattern %q: missing method", p))
+	}
+	return errors.Join(errs...)
+}
+
+// expand returns the patterns that p stands for. A pattern ending in an
+// optional wildcard stands for two: one that omits the final segment,
+// and one where it is an ordinary wildcard. Likewise, one ending in "/?"
+// stands for one without the slash and one ending in "{$}". Any other
+// pattern stands for itself.
+func (p *Pattern) expand() []*Pattern {
+	last := p.lastSegment()
+	if !last.optional {
+		return []*Pattern{p}
+	}
+	n := len(p.segments) - 1
+	without := *p
+	without.orig = p.source()
+	without.segments = p.segments[:n:n]
+	if !last.wild {
+		with := *p
+		with.orig = p.source()
+		with.segments = append(p.segments[:n:n], segment{s: "/"})
+		return []*Pattern{&without, &with}
+	}
+	if n == 0 {
+		// "/{x?}" without its segment is "/{$}".
+		without.segments = []segment{{s: "/"}}
+	}
+	without.omitted = last.s
+	without.omittedValue = last.def
+	with := *p
+	with.orig = p.source()
+	with.segments = append(p.segments[:n:n], segment{s: last.s, wild: true})
+	return []*Pattern{&without, &with}
+}
+
+// source returns the pattern that p was copied from by expand or by
+// ServeMux.keyed, or p itself. It is the pattern that a ServeMux returns
+// for p's matches.
+func (p *Pattern) source() *Pattern {
+	if p.orig != nil {
+		return p.orig
+	}
+	return p
+}
+
+// unescapeBraces returns the literal segment seg with each "{{" replaced by
+// "{" and each "}}" by "}". Any other '{' is an error.
+func unescapeBraces(seg string) (string, error) {
+	if strings.IndexByte(seg, '{') < 0 && !strings.Contains(seg, "}}") {
+		return seg, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(seg); i++ {
+		c := seg[i]
+		if c == '{' || c == '}' {
+			if i+1 < len(seg) && seg[i+1] == c {
+				i++
+			} else if c == '{' {
+				return "", parseError(ErrBadWildcard, i, "bad wildcard segment (must start with '{')")
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// parseMethods parses a list of methods separated by commas or spaces.
+func parseMethods(s string) ([]string, error) {
+	var methods []string
+	isSep := func(r rune) bool { return r == ',' || r == ' ' }
+	off := 0
+	for {
+		start := strings.IndexFunc(s[off:], func(r rune) bool { return !isSep(r) })
+		if start < 0 {
+			return methods, nil
+		}
+		off += start
+		end := strings.IndexFunc(s[off:], isSep)
+		if end < 0 {
+			end = len(s) - off
+		}
+		m := s[off : off+end]
+		if i := strings.IndexFunc(m, func(r rune) bool { return !isHTTPTokenChar(r) }); i >= 0 {
+			return nil, parseError(ErrBadMethod, off+i, "bad method %q: invalid character %q", m, m[i])
+		}
+		for _, m2 := range methods {
+			if m == m2 {
+				return nil, parseError(ErrBadMethod, off, "duplicate method %q", m)
+			}
+		}
+		methods = append(methods, m)
+		off += end
+	}
+}
+
+// firstDifference returns the index of the first byte at which s1 and s2
+// differ, or the length of the shorter if one is a prefix of the other.
+func firstDifference(s1, s2 string) int {
+	i := 0
+	for i < len(s1) && i < len(s2) && s1[i] == s2[i] {
+		i++
+	}
+	return i
+}
+
+// onlyConnect reports whether p matches only CONNECT requests.
+func (p *Pattern) onlyConnect() bool {
+	if len(p.methods) == 0 {
+		return false
+	}
+	for _, m := range p.methods {
+		if m != "CONNECT" {
+			return false
+		}
+	}
+	return true
+}
+
 var httpTokenRegexp = regexp.MustCompile("^[-0-9A-Za-z!#$%&'*+.^_`|~]+$")
 
 // See https://www.rfc-editor.org/rfc/rfc9110#section-5.6.2.
@@ -192,6 +1360,24 @@ func isValidHTTPToken(s string) bool {
 	return httpTokenRegexp.MatchString(s)
 }
 
+func isHTTPTokenChar(r rune) bool {
+	return r < utf8.RuneSelf && isValidHTTPToken(string(r))
+}
+
+// wildcardValidator, if non-nil, is called by Parse on each wildcard name.
+var wildcardValidator func(name string) error
+
+// SetWildcardValidator arranges for Parse to call f on the name of each
+// wildcard, after checking that it is a valid Go identifier. If f returns an
+// error, Parse fails with an error that wraps it. A nil f removes
+// the validator.
+//
+// SetWildcardValidator is not safe to call concurrently with Parse or with
+// pattern registration; call it during program initialization.
+func SetWildcardValidator(f func(name string) error) {
+	wildcardValidator = f
+}
+
 func isValidWildcardName(s string) bool {
 	if s == "" {
 		return false
@@ -210,44 +1396,330 @@ func isValidWildcardName(s string) bool {
 //
 // Precedence is defined by these rules:
 //
-//  1. Patterns with a host win over patterns without a host.
-//  2. Patterns whose method and path is more specific win. One pattern is more
+//  1. Patterns with a host win over patterns without a host. Of two hosts,
+//     an IP address or a CIDR block wins over a CIDR block containing it,
+//     and a name or wildcard host wins over a wildcard host matching it.
+//  2. Patterns that require https win over patterns that don't.
+//  3. Patterns whose method and path is more specific win. One pattern is more
 //     specific than another if the second matches all the (method, path) pairs
 //     of the first and more.
+//  4. Of otherwise equivalent patterns, one whose header constraints are a
+//     strict superset of the other's wins.
+//  5. Of otherwise equivalent patterns with the same header constraints, one
+//     with a media type wins over one without. Two with different media types
+//     are chosen between by the request's Accept header.
+//
+// If neither pattern has higher precedence, [Pattern.Precedes] breaks the tie.
 func (p1 *Pattern) HigherPrecedence(p2 *Pattern) bool {
-	// 1. Patterns with a host win over patterns without a host.
-	if (p1.host == "") != (p2.host == "") {
-		return p1.host != ""
+	// 1. Patterns with a host win over patterns without a host,
+	// and more specific hosts win over less specific ones.
+	if r := p1.compareHosts(p2); r == moreSpecific || r == moreGeneral {
+		return r == moreSpecific
+	}
+	// 2. Patterns with a scheme win over patterns without one.
+	if p1.scheme != p2.scheme {
+		return p1.scheme != ""
+	}
+	// 3. More specific (method, path)s win.
+	rel := p1.comparePathsAndMethods(p2)
+	if rel == equivalent {
+		// 4. More header constraints win.
+		switch p1.compareHeaders(p2) {
+		case moreSpecific:
+			return true
+		case equivalent:
+			// 5. A media type wins over none.
+			return p1.mediaType != "" && p2.mediaType == ""
+		}
+		return false
+	}
+	return rel == moreSpecific
+}
+
+// Precedes reports whether p1 comes before p2 in a total order on patterns
+// that is consistent with HigherPrecedence: if p1.HigherPrecedence(p2), then
+// p1.Precedes(p2). It breaks the ties that HigherPrecedence leaves, such as
+// between conflicting patterns, so that there is always a winner.
+//
+// Precedes ranks each part of a pattern by how much it matches, and compares
+// the ranks in the order of the precedence rules: the host, then the scheme,
+// then the path segments in order, so that the pattern with the longer literal
+// prefix wins, then the number of segments, then the number of literals after
+// a multi wildcard, then the methods, then the number of header constraints,
+// then the media type. If all of those are equal, the pattern registered first
+// on a ServeMux wins, and then the one with the lesser string.
+func (p1 *Pattern) Precedes(p2 *Pattern) bool {
+	if r1, r2 := p1.hostRank(), p2.hostRank(); r1 != r2 {
+		return r1 < r2
+	}
+	if (p1.scheme == "") != (p2.scheme == "") {
+		return p1.scheme != ""
+	}
+	for i := 0; i < len(p1.segments) && i < len(p2.segments); i++ {
+		if r1, r2 := p1.segments[i].rank(), p2.segments[i].rank(); r1 != r2 {
+			return r1 < r2
+		}
+	}
+	if len(p1.segments) != len(p2.segments) {
+		return len(p1.segments) < len(p2.segments)
+	}
+	if n1, n2 := len(p1.lastSegment().suffixLits()), len(p2.lastSegment().suffixLits()); n1 != n2 {
+		return n1 > n2
+	}
+	if r1, r2 := p1.methodRank(), p2.methodRank(); r1 != r2 {
+		return r1 < r2
+	}
+	if len(p1.headers) != len(p2.headers) {
+		return len(p1.headers) > len(p2.headers)
+	}
+	if (p1.mediaType == "") != (p2.mediaType == "") {
+		return p1.mediaType != ""
+	}
+	if p1.seq != p2.seq {
+		return p1.seq < p2.seq
+	}
+	if p1.str != p2.str {
+		return p1.str < p2.str
+	}
+	return p1.loc < p2.loc
+}
+
+// hostRank is 0 for a pattern with a host that is not a CIDR block or wildcard
+// host, more for a CIDR block, the larger the block, more for a wildcard
+// host, the shorter the suffix, and most for a pattern with no host.
+func (p *Pattern) hostRank() int {
+	switch {
+	case p.host == "":
+		return math.MaxInt
+	case p.prefix.IsValid():
+		return 1 + 128 - p.prefix.Bits()
+	case isWildcardHost(p.host):
+		// Longer suffixes match fewer hosts.
+		return math.MaxInt - len(p.host)
+	default:
+		return 0
 	}
-	// 2. More specific (method, path)s win.
-	return p1.comparePathsAndMethods(p2) == moreSpecific
+}
+
+// rank is 0 for a segment that matches one string, 1 for a single wildcard,
+// 2 for a multi wildcard followed by literals and 3 for any other multi
+// wildcard.
+func (s segment) rank() int {
+	switch {
+	case s.multi && s.suffix != "":
+		return 2
+	case s.multi:
+		return 3
+	case s.wild:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// methodRank is the number of methods p matches, where GET counts as two
+// because it also matches HEAD.
+func (p *Pattern) methodRank() int {
+	if len(p.methods) == 0 {
+		return math.MaxInt
+	}
+	get, head := false, false
+	for _, m := range p.methods {
+		get = get || m == "GET"
+		head = head || m == "HEAD"
+	}
+	if get && !head {
+		return len(p.methods) + 1
+	}
+	return len(p.methods)
+}
+
+// shadows reports whether p1 takes precedence over p2 on every request
+// they both match, though p1's methods and path are more general than p2's.
+// That can happen only because of p1's host or scheme. Requests that p1
+// matches can then never reach p2, which is usually a mistake.
+func (p1 *Pattern) shadows(p2 *Pattern) bool {
+	return p1.compareHosts(p2) != disjoint &&
+		p1.comparePathsAndMethods(p2) == moreGeneral &&
+		p1.HigherPrecedence(p2)
 }
 
 // ConflictsWith reports whether p1 conflicts with p2, that is, whether
 // there is a request that both match but where neither is higher precedence
 // than the other.
+//
+// Patterns with several methods conflict if they conflict on any method
+// they share. Likewise, a pattern ending in "{name?}" conflicts with p2 if
+// either form of it does. Equivalent patterns with different media types
+// don't conflict, nor do those with contradictory header constraints, or
+// where one's header constraints are a strict superset of the other's.
 func (p1 *Pattern) ConflictsWith(p2 *Pattern) bool {
+	if p1.lastSegment().optional || p2.lastSegment().optional {
+		for _, q1 := range p1.expand() {
+			for _, q2 := range p2.expand() {
+				if q1.ConflictsWith(q2) {
+					return true
+				}
+			}
+		}
+		return false
+	}
 	if p1.host != p2.host {
-		// Either one host is empty and the other isn't, in which case the
-		// one with the host wins by rule 1, or neither host is empty
-		// and they differ, so they won't match the same paths.
+		// Either one host is more specific than the other, in which case it
+		// wins by rule 1, or the hosts are disjoint, so they won't match
+		// the same requests.
 		return false
 	}
-	rel := p1.comparePathsAndMethods(p2)
-	return rel == equivalent || rel == overlaps
+	if p1.scheme != p2.scheme {
+		// The one with the scheme wins by rule 2.
+		return false
+	}
+	var pathRel relationship
+	conflict := false
+	forEachMethodPair(p1, p2, func(m1, m2 string) {
+		mr := compareMethod(m1, m2)
+		if conflict || mr == disjoint {
+			return
+		}
+		if pathRel == "" {
+			pathRel = p1.comparePaths(p2)
+		}
+		rel := combineRelationships(mr, pathRel)
+		if rel == equivalent {
+			switch p1.compareHeaders(p2) {
+			case disjoint, moreSpecific, moreGeneral:
+				return
+			}
+			conflict = p1.mediaType == p2.mediaType
+			return
+		}
+		conflict = rel == overlaps
+	})
+	return conflict
 }
 
-// relationship is a relationship between two patterns.
-type relationship string
+// IsSubsetOf reports whether every request that p matches is also matched
+// by q, ignoring precedence.
+//
+// A pattern with no method matches every method, and one with no host
+// matches every host. So p can be a subset of q only if q has no method or
+// has every method of p (where GET covers HEAD), and only if q has no host or
+// a host containing p's. Likewise, q must not require https unless p does.
+func (p *Pattern) IsSubsetOf(q *Pattern) bool {
+	if r := p.compareHosts(q); r != equivalent && r != moreSpecific {
+		return false
+	}
+	if q.scheme != "" && q.scheme != p.scheme {
+		return false
+	}
+	ms1 := p.methods
+	if len(ms1) == 0 {
+		ms1 = []string{""}
+	}
+	for _, m1 := range ms1 {
+		found := false
+		forEachMethodPair(p.withMethod(m1), q, func(_, m2 string) {
+			if r := compareMethod(m1, m2); r == equivalent || r == moreSpecific {
+				found = true
+			}
+		})
+		if !found {
+			return false
+		}
+	}
+	r := p.comparePaths(q)
+	return r == equivalent || r == moreSpecific
+}
+
+// A Relationship describes how the sets of requests matched by two patterns
+// are related.
+type Relationship string
 
 const (
-	moreSpecific relationship = "moreSpecific"
-	moreGeneral  relationship = "moreGeneral"
-	overlaps     relationship = "overlaps"
-	equivalent   relationship = "equivalent"
-	disjoint     relationship = "disjoint"
+	// Equivalent patterns match the same requests.
+	Equivalent Relationship = "equivalent"
+	// A pattern is MoreSpecific than another if the other matches all of
+	// its requests and more.
+	MoreSpecific Relationship = "moreSpecific"
+	// A pattern is MoreGeneral than another if it matches all of the other's
+	// requests and more.
+	MoreGeneral Relationship = "moreGeneral"
+	// Overlapping patterns both match some request, but each matches a
+	// request that the other doesn't.
+	Overlaps Relationship = "overlaps"
+	// Disjoint patterns match no requests in common.
+	Disjoint Relationship = "disjoint"
 )
 
+// relationship and its constants are the internal names for
+// Relationship and its constants.
+type relationship = Relationship
+
+const (
+	moreSpecific = MoreSpecific
+	moreGeneral  = MoreGeneral
+	overlaps     = Overlaps
+	equivalent   = Equivalent
+	disjoint     = Disjoint
+)
+
+// Relationship returns the relationship between the requests matched by p1
+// and those matched by p2, without regard to precedence.
+// Hosts are compared like methods: a pattern without a host is more general
+// than one with a host. So are schemes.
+// Patterns with several methods are compared one method at a time, as with
+// ConflictsWith.
+func (p1 *Pattern) Relationship(p2 *Pattern) Relationship {
+	hostRel := p1.compareHosts(p2)
+	if hostRel == disjoint {
+		return disjoint
+	}
+	var schemeRel relationship
+	switch {
+	case p1.scheme == p2.scheme:
+		schemeRel = equivalent
+	case p1.scheme == "":
+		schemeRel = moreGeneral
+	default:
+		schemeRel = moreSpecific
+	}
+	return combineRelationships(combineRelationships(hostRel, schemeRel), p1.comparePathsAndMethods(p2))
+}
+
+// compareHosts returns the relationship between the hosts that p1 and p2
+// match. No host is more general than any host, a CIDR block is more
+// general than the addresses and smaller blocks within it, and a wildcard
+// host is more general than the names and wildcard hosts it matches.
+func (p1 *Pattern) compareHosts(p2 *Pattern) relationship {
+	switch {
+	case p1.host == p2.host:
+		return equivalent
+	case p1.host == "":
+		return moreGeneral
+	case p2.host == "":
+		return moreSpecific
+	case (p1.prefix.IsValid() || isWildcardHost(p1.host)) && p1.containsHost(p2):
+		return moreGeneral
+	case (p2.prefix.IsValid() || isWildcardHost(p2.host)) && p2.containsHost(p1):
+		return moreSpecific
+	default:
+		return disjoint
+	}
+}
+
+// containsHost reports whether the CIDR block or wildcard host of p contains
+// all the hosts matched by the host of q, which is different from p's.
+func (p *Pattern) containsHost(q *Pattern) bool {
+	if isWildcardHost(p.host) {
+		return strings.HasSuffix(q.host, p.host[1:])
+	}
+	if q.prefix.IsValid() {
+		return q.prefix.Bits() > p.prefix.Bits() && p.prefix.Contains(q.prefix.Addr())
+	}
+	a, err := netip.ParseAddr(strings.Trim(q.host, "[]"))
+	return err == nil && p.prefix.Contains(a)
+}
+
 func (p1 *Pattern) comparePathsAndMethods(p2 *Pattern) relationship {
 	mr := p1.compareMethods(p2)
 	// Optimization: avoid a call to comparePaths.
@@ -255,7 +1727,52 @@ func (p1 *Pattern) comparePathsAndMethods(p2 *Pattern) relationship {
 		return disjoint
 	}
 	pr := p1.comparePaths(p2)
-	return combineRelationships(mr, pr)
+	if len(p1.methods) <= 1 && len(p2.methods) <= 1 {
+		return combineRelationships(mr, pr)
+	}
+	rel := disjoint
+	forEachMethodPair(p1, p2, func(m1, m2 string) {
+		rel = mergeRelationships(rel, combineRelationships(compareMethod(m1, m2), pr))
+	})
+	return rel
+}
+
+// mergeRelationships combines the relationships of two parts of a pattern
+// with several methods, each part holding one method.
+// Equivalence on one method is enough for two patterns to collide, so it
+// dominates everything but overlaps.
+func mergeRelationships(r1, r2 relationship) relationship {
+	switch {
+	case r1 == r2 || r2 == disjoint:
+		return r1
+	case r1 == disjoint:
+		return r2
+	case r1 == overlaps || r2 == overlaps:
+		return overlaps
+	case r1 == equivalent || r2 == equivalent:
+		return equivalent
+	default:
+		// One is moreSpecific and the other moreGeneral.
+		return overlaps
+	}
+}
+
+// forEachMethodPair calls f with each method of p1 paired with each method
+// of p2. A pattern with no methods contributes the single method "".
+func forEachMethodPair(p1, p2 *Pattern, f func(m1, m2 string)) {
+	ms1 := p1.methods
+	if len(ms1) == 0 {
+		ms1 = []string{""}
+	}
+	ms2 := p2.methods
+	if len(ms2) == 0 {
+		ms2 = []string{""}
+	}
+	for _, m1 := range ms1 {
+		for _, m2 := range ms2 {
+			f(m1, m2)
+		}
+	}
 }
 
 func combineRelationships(methodRel, pathRel relationship) relationship {
@@ -287,22 +1804,35 @@ func combineRelationships(methodRel, pathRel relationship) relationship {
 	}
 }
 
+// compareMethods determines the relationship between the methods of two
+// patterns. Each method of a pattern with several methods is compared
+// separately, and the results merged.
 func (p1 *Pattern) compareMethods(p2 *Pattern) relationship {
-	if p1.method == p2.method {
+	rel := disjoint
+	forEachMethodPair(p1, p2, func(m1, m2 string) {
+		rel = mergeRelationships(rel, compareMethod(m1, m2))
+	})
+	return rel
+}
+
+// compareMethod determines the relationship between two single methods,
+// where the empty string means any method.
+func compareMethod(m1, m2 string) relationship {
+	if m1 == m2 {
 		return equivalent
 	}
-	if p1.method == "" {
-		// p1 matches any method, but p2 does not.
+	if m1 == "" {
+		// m1 matches any method, but m2 does not.
 		return moreGeneral
 	}
-	if p2.method == "" {
+	if m2 == "" {
 		return moreSpecific
 	}
-	if p1.method == "GET" && p2.method == "HEAD" {
-		// p1 matches GET and HEAD; p2 matches only HEAD.
+	if m1 == "GET" && m2 == "HEAD" {
+		// m1 matches GET and HEAD; m2 matches only HEAD.
 		return moreGeneral
 	}
-	if p2.method == "GET" && p1.method == "HEAD" {
+	if m2 == "GET" && m1 == "HEAD" {
 		return moreSpecific
 	}
 	return disjoint
@@ -317,6 +1847,9 @@ func (p1 *Pattern) compareMethods(p2 *Pattern) relationship {
 //	overlaps: there is a path that both match, but neither is more specific
 //	disjoint: there is no path that both match
 func (p1 *Pattern) comparePaths(p2 *Pattern) relationship {
+	if p1.hasSuffix() || p2.hasSuffix() {
+		return compareTokens(p1.tokens(), p2.tokens())
+	}
 	if len(p1.segments) != len(p2.segments) && !p1.lastSegment().multi && !p2.lastSegment().multi {
 		return disjoint
 	}
@@ -398,35 +1931,103 @@ func (p1 *Pattern) comparePaths(p2 *Pattern) relationship {
 }
 
 // DescribeRelationship returns a string that describes how pat1 and pat2
-// are related.
+// are related. It panics if either fails to parse.
 func DescribeRelationship(pat1, pat2 string) string {
-	p1, err := Parse(pat1)
+	s, err := DescribeRelationshipErr(pat1, pat2)
 	if err != nil {
 		panic(err)
 	}
+	return s
+}
+
+// DescribeRelationshipErr is like DescribeRelationship, but returns an
+// error instead of panicking if either pattern fails to parse, so it is
+// safe to call with untrusted input.
+func DescribeRelationshipErr(pat1, pat2 string) (string, error) {
+	p1, err := Parse(pat1)
+	if err != nil {
+		return "", err
+	}
 	p2, err := Parse(pat2)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return describeRel(p1, p2)
+	return describeRel(p1, p2), nil
+}
+
+// Conflict reports whether the patterns pat1 and pat2 conflict, so that
+// they could not both be registered on a ServeMux, along with a description
+// of how they are related. For conflicting patterns, the description is the
+// one in the error from registering them, including any suggested fix. Conflict
+// returns an error if either pattern fails to parse.
+func Conflict(pat1, pat2 string) (bool, string, error) {
+	p1, err := Parse(pat1)
+	if err != nil {
+		return false, "", err
+	}
+	p2, err := Parse(pat2)
+	if err != nil {
+		return false, "", err
+	}
+	for _, q1 := range p1.expand() {
+		for _, q2 := range p2.expand() {
+			if q1.ConflictsWith(q2) {
+				d := describeRel(q1, q2)
+				if s := suggestFix(q1, q2); s != "" {
+					d += "\n" + s
+				}
+				return true, d, nil
+			}
+		}
+	}
+	return false, describeRel(p1, p2), nil
 }
 
 func describeRel(p1, p2 *Pattern) string {
 	if p1.host != p2.host {
+		hostRel := p1.compareHosts(p2)
 		switch {
+		case hostRel == disjoint:
+			return fmt.Sprintf("%s and %s have different hosts, so they have no requests in common", p1, p2)
+		case p1.comparePathsAndMethods(p2) == disjoint:
+			// Precedence doesn't arise. Say why, below.
 		case p1.host == "":
 			return fmt.Sprintf("%s does not have a host, while %s does, so %[2]s takes precedence", p1, p2)
 		case p2.host == "":
 			return fmt.Sprintf("%s does not have a host, while %s does, so %[2]s takes precedence", p2, p1)
+		case hostRel == moreSpecific:
+			return fmt.Sprintf("%s has a more specific host than %s, so %[1]s takes precedence", p1, p2)
 		default:
-			return fmt.Sprintf("%s and %s have different hosts, so they have no requests in common", p1, p2)
+			return fmt.Sprintf("%s has a more specific host than %s, so %[1]s takes precedence", p2, p1)
+		}
+	}
+	if p1.scheme != p2.scheme && p1.comparePathsAndMethods(p2) != disjoint {
+		if p1.scheme == "" {
+			return fmt.Sprintf("%s does not require https, while %s does, so %[2]s takes precedence for secure requests", p1, p2)
 		}
+		return fmt.Sprintf("%s does not require https, while %s does, so %[2]s takes precedence for secure requests", p2, p1)
+	}
+	if len(p1.methods) > 1 || len(p2.methods) > 1 {
+		// Describe the pair of single methods that determines how the
+		// patterns are related.
+		rel := p1.comparePathsAndMethods(p2)
+		pathRel := p1.comparePaths(p2)
+		var v1, v2 *Pattern
+		forEachMethodPair(p1, p2, func(m1, m2 string) {
+			if v1 == nil && combineRelationships(compareMethod(m1, m2), pathRel) == rel {
+				v1, v2 = p1.withMethod(m1), p2.withMethod(m2)
+			}
+		})
+		return describeRel(v1, v2)
 	}
 	methodRel := p1.compareMethods(p2)
 	pathRel := p1.comparePaths(p2)
 	rel := combineRelationships(methodRel, pathRel)
 	switch rel {
 	case disjoint:
+		if methodRel == disjoint {
+			return fmt.Sprintf("%s and %s match different methods, so they have no requests in common.", p1, p2)
+		}
 		return fmt.Sprintf("%s has no requests in common with %s.", p1, p2)
 	case equivalent:
 		return fmt.Sprintf("%s matches the same requests as %s.", p1, p2)
@@ -448,6 +2049,17 @@ But neither is more specific than the other.
 	}
 }
 
+// withMethod returns a copy of p that matches only method m, or any method if
+// m is empty. The copy keeps p's string.
+func (p *Pattern) withMethod(m string) *Pattern {
+	p2 := *p
+	p2.methods = nil
+	if m != "" {
+		p2.methods = []string{m}
+	}
+	return &p2
+}
+
 func moreSpecificMessage(spec, gen *Pattern, methodRel relationship) string {
 	// Either the method or path is more specific, or both.
 	over := matchingPath(spec)
@@ -457,8 +2069,8 @@ func moreSpecificMessage(spec, gen *Pattern, methodRel relationship) string {
 Both match "%s %s".
 Only %[2]s matches "%[5]s %s".`,
 			spec, gen,
-			spec.method, over,
-			otherMethod(spec.method, gen.method), over)
+			spec.Method(), over,
+			otherMethod(spec.Method(), gen.Method()), over)
 	}
 	diff := differencePath(gen, spec)
 	return fmt.Sprintf(`%s is more specific than %s.
@@ -467,6 +2079,26 @@ Only %[2]s matches path %[4]q.`,
 		spec, gen, over, diff)
 }
 
+// ExamplePath returns a path that p matches.
+func (p *Pattern) ExamplePath() string {
+	return matchingPath(p)
+}
+
+// DifferencePath returns a path that p1 matches but p2 doesn't.
+// The second result is false if there is no such path, because every path
+// that p1 matches is also matched by p2.
+// Only paths are considered, not methods or hosts.
+func DifferencePath(p1, p2 *Pattern) (string, bool) {
+	switch p1.comparePaths(p2) {
+	case disjoint:
+		return matchingPath(p1), true
+	case overlaps, moreGeneral:
+		return differencePath(p1, p2), true
+	default: // equivalent or moreSpecific
+		return "", false
+	}
+}
+
 func matchingPath(p *Pattern) string {
 	var b strings.Builder
 	writeMatchingPath(&b, p.segments)
@@ -482,6 +2114,12 @@ func writeMatchingPath(b *strings.Builder, segs []segment) {
 
 func writeSegment(b *strings.Builder, s segment) {
 	b.WriteByte('/')
+	if s.suffix != "" {
+		// The multi wildcard must match at least one segment.
+		b.WriteString(tokenValue(s.s))
+		writeSuffix(b, s.suffixLits())
+		return
+	}
 	if !s.multi && s.s != "/" {
 		b.WriteString(s.s)
 	}
@@ -490,6 +2128,10 @@ func writeSegment(b *strings.Builder, s segment) {
 // commonPath returns a path that both p1 and p2 match.
 // It assumes there is such a path.
 func commonPath(p1, p2 *Pattern) string {
+	if p1.hasSuffix() || p2.hasSuffix() {
+		w, _ := intersectTokens(p1.tokens(), p2.tokens())
+		return tokensPath(w)
+	}
 	var b strings.Builder
 	var segs1, segs2 []segment
 	for segs1, segs2 = p1.segments, p2.segments; len(segs1) > 0 && len(segs2) > 0; segs1, segs2 = segs1[1:], segs2[1:] {
@@ -507,6 +2149,76 @@ func commonPath(p1, p2 *Pattern) string {
 	return b.String()
 }
 
+// suggestFix returns a suggestion for changing p1, which conflicts with p2,
+// so that it doesn't. It returns the empty string if it has none.
+func suggestFix(p1, p2 *Pattern) string {
+	if p1.comparePaths(p2) == equivalent {
+		switch {
+		case len(p1.methods) == 0:
+			return fmt.Sprintf("Suggestion: add a method to %s, like %q, to make it more specific.", p1, "GET "+p1.str)
+		case p1.NumWildcards() > 0:
+			q := *p1
+			q.segments = nil
+			for _, s := range p1.segments {
+				if s.wild && s.s != "" {
+					q.segments = append(q.segments, segment{s: s.s})
+					for _, lit := range s.suffixLits() {
+						q.segments = append(q.segments, segment{s: lit})
+					}
+					continue
+				}
+				q.segments = append(q.segments, s)
+			}
+			return fmt.Sprintf("Suggestion: replace a wildcard in %s with a literal, like %q, to make it more specific.", p1, q.debugString())
+		default:
+			return "Suggestion: remove one of the patterns, or give them different methods."
+		}
+	}
+	if p1.hasSuffix() || p2.hasSuffix() {
+		// The intersection may need two multi wildcards.
+		return ""
+	}
+	// Suggest the pattern that matches what both do.
+	q := &Pattern{methods: p1.methods, scheme: p1.scheme, host: p1.host, segments: intersectSegments(p1.segments, p2.segments)}
+	if len(q.methods) == 0 {
+		q.methods = p2.methods
+	}
+	q.str = q.debugString()
+	if _, err := Parse(q.str); err != nil || q.comparePathsAndMethods(p2) != moreSpecific {
+		return ""
+	}
+	s := fmt.Sprintf("Suggestion: replace %s with a pattern that is more specific than %s, like %q.", p1, p2, q)
+	if d, ok := DifferencePath(p1, p2); ok && p1.comparePaths(p2) == overlaps {
+		s += fmt.Sprintf(" Unlike %s, it does not match %q.", p1, d)
+	}
+	return s
+}
+
+// intersectSegments returns segments that match the paths matched by
+// both segs1 and segs2, which must overlap.
+func intersectSegments(segs1, segs2 []segment) []segment {
+	var segs []segment
+	for ; len(segs1) > 0 && len(segs2) > 0; segs1, segs2 = segs1[1:], segs2[1:] {
+		s1, s2 := segs1[0], segs2[0]
+		switch {
+		case s1.multi && len(segs2) > 1:
+			// s1 matches the rest of segs2.
+			return append(segs, segs2...)
+		case s2.multi && len(segs1) > 1:
+			return append(segs, segs1...)
+		case !s1.wild:
+			segs = append(segs, s1)
+		case !s2.wild:
+			segs = append(segs, s2)
+		case s1.multi:
+			segs = append(segs, s2)
+		default:
+			segs = append(segs, s1)
+		}
+	}
+	return segs
+}
+
 func otherMethod(specMethod, genMethod string) string {
 	if specMethod == "HEAD" && genMethod == "GET" {
 		return "GET"
@@ -521,6 +2233,9 @@ func otherMethod(specMethod, genMethod string) string {
 // differencePath returns a path that p1 matches and p2 doesn't.
 // It assumes there is such a path.
 func differencePath(p1, p2 *Pattern) string {
+	if p1.hasSuffix() || p2.hasSuffix() {
+		return differenceTokens(p1.tokens(), p2.tokens())
+	}
 	b := new(strings.Builder)
 
 	var segs1, segs2 []segment
@@ -5,12 +5,14 @@
 package muxpatterns
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
 	"testing"
 
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
@@ -60,12 +62,12 @@ func TestParse(t *testing.T) {
 		},
 		{
 			"GET /",
-			Pattern{method: "GET", segments: []segment{multi("")}},
+			Pattern{methods: []string{"GET"}, segments: []segment{multi("")}},
 		},
 		{
 			"POST example.com/foo/{w}",
 			Pattern{
-				method:   "POST",
+				methods:  []string{"POST"},
 				host:     "example.com",
 				segments: []segment{lit("foo"), wild("w")},
 			},
@@ -76,7 +78,7 @@ func TestParse(t *testing.T) {
 		},
 		{
 			"DELETE example.com/a/{foo12}/{$}",
-			Pattern{method: "DELETE", host: "example.com", segments: []segment{lit("a"), wild("foo12"), lit("/")}},
+			Pattern{methods: []string{"DELETE"}, host: "example.com", segments: []segment{lit("a"), wild("foo12"), lit("/")}},
 		},
 		{
 			"/foo/{$}",
@@ -98,6 +100,84 @@ func TestParse(t *testing.T) {
 			"a.com/foo//",
 			Pattern{host: "a.com", segments: []segment{lit("foo"), lit(""), multi("")}},
 		},
+		{
+			"CONNECT proxy.example.com/",
+			Pattern{methods: []string{"CONNECT"}, host: "proxy.example.com", segments: []segment{multi("")}},
+		},
+		{
+			"CONNECT //a",
+			Pattern{methods: []string{"CONNECT"}, segments: []segment{lit(""), lit("a")}},
+		},
+		{
+			"GET,POST /items",
+			Pattern{methods: []string{"GET", "POST"}, segments: []segment{lit("items")}},
+		},
+		{
+			"GET POST a.com/items",
+			Pattern{methods: []string{"GET", "POST"}, host: "a.com", segments: []segment{lit("items")}},
+		},
+		{
+			"GET  /items",
+			Pattern{methods: []string{"GET"}, segments: []segment{lit("items")}},
+		},
+		{
+			"/files/{{name}}/a{{b}}c}",
+			Pattern{segments: []segment{lit("files"), lit("{name}"), lit("a{b}c}")}},
+		},
+		{
+			"/items/{id?}",
+			Pattern{segments: []segment{lit("items"), {s: "id", wild: true, optional: true}}},
+		},
+		{
+			"/list/{page=1}",
+			Pattern{segments: []segment{lit("list"), {s: "page", wild: true, optional: true, def: "1"}}},
+		},
+		{
+			"/items/?",
+			Pattern{segments: []segment{lit("items"), {s: "/", optional: true}}},
+		},
+		{
+			"/a/?/b",
+			Pattern{segments: []segment{lit("a"), lit("?"), lit("b")}},
+		},
+		{
+			"GET [10.1.2.3/8]/a",
+			Pattern{methods: []string{"GET"}, host: "[10.0.0.0/8]", segments: []segment{lit("a")}},
+		},
+		{
+			"https:///login",
+			Pattern{scheme: "https", segments: []segment{lit("login")}},
+		},
+		{
+			"POST https://a.com/login",
+			Pattern{methods: []string{"POST"}, scheme: "https", host: "a.com", segments: []segment{lit("login")}},
+		},
+		{
+			"maintenance.example.com",
+			Pattern{host: "maintenance.example.com", segments: []segment{multi("")}},
+		},
+		{
+			"GET https://a.com",
+			Pattern{methods: []string{"GET"}, scheme: "https", host: "a.com", segments: []segment{multi("")}},
+		},
+		{
+			"[10.1.2.3/8]",
+			Pattern{host: "[10.0.0.0/8]", segments: []segment{multi("")}},
+		},
+		{
+			"/files/{path...}/a/{{b}}",
+			Pattern{segments: []segment{lit("files"), {s: "path", wild: true, multi: true, suffix: "/a/{b}"}}},
+		},
+		{
+			"/archive/{date:3}/article",
+			Pattern{segments: []segment{
+				lit("archive"),
+				{s: "date", wild: true, span: 3},
+				{s: "date", wild: true, span: 3, part: 1},
+				{s: "date", wild: true, span: 3, part: 2},
+				lit("article"),
+			}},
+		},
 	} {
 		got := mustParse(t, test.in)
 		if !got.equal(&test.want) {
@@ -112,22 +192,57 @@ func TestParseError(t *testing.T) {
 		contains string
 	}{
 		{"", "empty pattern"},
-		{"A=B /", "bad method"},
+		{"A=B /", `bad method "A=B": invalid character '='`},
 		{" ", "missing /"},
 		{"/{w}x", "bad wildcard segment"},
 		{"/x{w}", "bad wildcard segment"},
 		{"/{wx", "bad wildcard segment"},
 		{"/{a$}", "bad wildcard name"},
 		{"/{}", "empty wildcard"},
+		{"a.*.com/", "bad wildcard host"},
+		{"*.*.com/", "bad wildcard host"},
+		{"*example.com/", "bad wildcard host"},
+		{"*./", "bad wildcard host"},
 		{"/{...}", "empty wildcard"},
 		{"/{$...}", "bad wildcard"},
 		{"/{$}/", "{$} not at end"},
 		{"/{$}/x", "{$} not at end"},
 		{"/{a...}/", "not at end"},
-		{"/{a...}/x", "not at end"},
+		{"/{a...}/x/", "not at end"},
+		{"/{a...}/{x}", "not at end"},
+		{"/{a...}/x/{$}", "not at end"},
+		{"/{a...}/x//y", "not at end"},
 		{"{a}/b", "missing initial '/'"},
 		{"/a/{x}/b/{x...}", "duplicate wildcard name"},
 		{"GET //", "unclean path"},
+		{"GET,CONNECT //", "unclean path"},
+		{"GET,P)ST /", "bad method"},
+		{"GET,GET /", "duplicate method"},
+		{"/a{{b{c", "bad wildcard segment"},
+		{"[10.0.0.0/33]/a", "bad CIDR host"},
+		{"[10.0.0.0/8]x/a", "missing ']'"},
+		{"/{x?}/a", "not at end"},
+		{"/{x?}/", "not at end"},
+		{"/{?}", "empty wildcard"},
+		{"/{x=1}/a", "not at end"},
+		{"/{x=}", "empty default"},
+		{"/{=1}", "empty wildcard"},
+		{"/?", "must follow a segment"},
+		{"a.com/?", "must follow a segment"},
+		{"/a/{x...}/?", "after a {...} wildcard"},
+		{"/a/{p...}/b/?", "after a {...} wildcard"},
+		{"/{x...?}", "bad wildcard name"},
+		{"GET", "missing /"},
+		{"localhost", "missing /"},
+		{"a.com{x}", "missing /"},
+		{"/{x:0}", "bad wildcard segment count"},
+		{"/{x:a}", "bad wildcard segment count"},
+		{"/{x:}", "bad wildcard segment count"},
+		{"/{x:65}", "wildcard segment count 65 greater than 64"},
+		{"/{x:5000000}", "greater than 64"},
+		{"/{:2}", "empty wildcard"},
+		{"/{x:2...}", "bad wildcard name"},
+		{"/{x:2}/{x}", "duplicate wildcard name"},
 	} {
 		_, err := Parse(test.in)
 		if err == nil || !strings.Contains(err.Error(), test.contains) {
@@ -136,8 +251,111 @@ func TestParseError(t *testing.T) {
 	}
 }
 
+func TestParseErrorKind(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want error
+	}{
+		{"", ErrEmptyPattern},
+		{"A=B /", ErrBadMethod},
+		{"GET,GET /", ErrBadMethod},
+		{"GET", ErrMissingSlash},
+		{"a{b}/", ErrBadHost},
+		{"*example.com/", ErrBadHost},
+		{"[10.0.0.0/99]/", ErrBadHost},
+		{"GET /a/../b", ErrUncleanPath},
+		{"/{x", ErrBadWildcard},
+		{"/x{y}", ErrBadWildcard},
+		{"/{}", ErrBadWildcard},
+		{"/{$}/x", ErrBadWildcard},
+		{"/{x...}/{y}", ErrBadWildcard},
+		{"/{x}/{x}", ErrDuplicateWildcard},
+	} {
+		_, err := Parse(test.in)
+		if !errors.Is(err, test.want) {
+			t.Errorf("%q: got %v, want error wrapping %v", test.in, err, test.want)
+		}
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Kind != test.want {
+			t.Errorf("%q: got %#v, want a *ParseError of kind %v", test.in, err, test.want)
+		}
+	}
+	if _, err := ParseWithDelimiter("a", '%'); !errors.Is(err, ErrBadDelimiter) {
+		t.Errorf("got %v, want error wrapping %v", err, ErrBadDelimiter)
+	}
+}
+
+func TestParseErrorOffset(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"GET A=B /", 5},
+		{"GET, POST,GET /", 10},
+		{"GET", 3},
+		{"a{b}/", 1},
+		{"https://a*.com/", 9},
+		{"GET /a//b", 7},
+		{"GET a.com/a/../b", 10},
+		{"/a/{x", 3},
+		{"/a/x{y}", 4},
+		{"/a/{}", 4},
+		{"/a/{x:b}", 6},
+		{"/{$}/x", 4},
+		{"/{x?}/y", 5},
+		{"/{x...}/a/{y}", 10},
+		{"/{x...}/a/b{c}", 11},
+		{"/{x}/{x}", 6},
+		{"GET [10.0.0.0/99]/x", 4},
+	} {
+		_, err := Parse(test.in)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%q: got %v, want a *ParseError", test.in, err)
+			continue
+		}
+		if perr.Offset != test.want {
+			t.Errorf("%q: got offset %d, want %d (%v)", test.in, perr.Offset, test.want, err)
+		}
+	}
+	for _, test := range []struct {
+		in   string
+		want int
+	}{
+		{"GET a.{b", 6},
+		{"a.{$}.b", 5},
+	} {
+		_, err := ParseWithDelimiter(test.in, '.')
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Offset != test.want {
+			t.Errorf("ParseWithDelimiter(%q): got %v, want offset %d", test.in, err, test.want)
+		}
+	}
+}
+
+func TestSetWildcardValidator(t *testing.T) {
+	errReserved := errors.New("reserved")
+	SetWildcardValidator(func(name string) error {
+		if name == "http" {
+			return errReserved
+		}
+		return nil
+	})
+	defer SetWildcardValidator(nil)
+
+	if _, err := Parse("/a/{http}"); !errors.Is(err, errReserved) {
+		t.Errorf("got %v, want error wrapping %v", err, errReserved)
+	} else if want := `bad wildcard name "http"`; !strings.Contains(err.Error(), want) {
+		t.Errorf("got %q, want it to contain %q", err, want)
+	}
+	if _, err := Parse("/a/{https...}"); err != nil {
+		t.Error(err)
+	}
+}
+
 func (p1 *Pattern) equal(p2 *Pattern) bool {
-	return p1.method == p2.method && p1.host == p2.host && slices.Equal(p1.segments, p2.segments)
+	return slices.Equal(p1.methods, p2.methods) && p1.scheme == p2.scheme && p1.host == p2.host && slices.Equal(p1.segments, p2.segments)
 }
 
 func TestIsValidHTTPToken(t *testing.T) {
@@ -323,6 +541,15 @@ func TestComparePaths(t *testing.T) {
 		{"/{z}/{$}", "/a/{x...}", overlaps},
 		{"/{z}/{$}", "/{z}/{x...}", moreSpecific},
 		{"/a/{z}/{$}", "/{z}/a/", overlaps},
+
+		// A "{name:N}" wildcard is like N single wildcards.
+		{"/{d:3}", "/{x}/{y}/{z}", equivalent},
+		{"/{d:3}", "/{x}/{y}", disjoint},
+		{"/{d:3}", "/{x}/{y}/{z}/{w}", disjoint},
+		{"/{d:3}", "/{x...}", moreSpecific},
+		{"/{d:3}", "/a/{x...}", overlaps},
+		{"/{d:3}", "/a/b/c", moreGeneral},
+		{"/{d:2}/{$}", "/{x}/{y}/", moreSpecific},
 	} {
 		pat1 := mustParse(t, test.p1)
 		pat2 := mustParse(t, test.p2)
@@ -427,6 +654,39 @@ func TestDifferencePath(t *testing.T) {
 	}
 }
 
+func TestExampleAndDifferencePaths(t *testing.T) {
+	matches := func(p *Pattern, path string) bool {
+		n, _ := buildTree(p.String()).match("GET", "", path)
+		return n != nil
+	}
+	pats := []string{
+		"/", "/a", "/a/", "/a/b", "/a/{x}", "/{x}/b", "/a/{$}", "/{$}",
+		"/a/{x}/{y...}", "/{x}/a/", "/a/{x}/b/{$}", "/b/{z}",
+		"/a/{p...}/b", "/{p...}/b", "/{x}/{p...}/a/b",
+	}
+	for _, s1 := range pats {
+		p1 := mustParse(t, s1)
+		if ex := p1.ExamplePath(); !matches(p1, ex) {
+			t.Errorf("%s does not match its example path %q", s1, ex)
+		}
+		for _, s2 := range pats {
+			p2 := mustParse(t, s2)
+			path, ok := DifferencePath(p1, p2)
+			rel := p1.comparePaths(p2)
+			if wantOK := rel != equivalent && rel != moreSpecific; ok != wantOK {
+				t.Errorf("%s, %s (%s): got ok=%t, want %t", s1, s2, rel, ok, wantOK)
+			}
+			if !ok {
+				continue
+			}
+			if !matches(p1, path) || matches(p2, path) {
+				t.Errorf("%s, %s: difference path %q matched by %s=%t, %s=%t",
+					s1, s2, path, s1, matches(p1, path), s2, matches(p2, path))
+			}
+		}
+	}
+}
+
 func TestHigherPrecedence(t *testing.T) {
 	for _, test := range []struct {
 		p1, p2 string
@@ -437,7 +697,22 @@ func TestHigherPrecedence(t *testing.T) {
 		{"/", "h/", false},
 		{"h/", "h/", false},
 
-		// 2. method
+		{"10.1.2.3/", "[10.0.0.0/8]/a", true},
+		{"[10.1.0.0/16]/", "[10.0.0.0/8]/a", true},
+		{"[10.0.0.0/8]/a", "[10.1.0.0/16]/", false},
+		{"[10.0.0.0/8]/", "/a", true},
+		{"a.example.com/", "*.example.com/a", true},
+		{"*.a.example.com/", "*.example.com/a", true},
+		{"*.example.com/", "/a", true},
+		{"*.example.com/a", "a.example.com/", false},
+		{"*.example.com/", "example.com/a", false},
+
+		// 2. scheme
+		{"https:///", "/a", true},
+		{"/a", "https:///", false},
+		{"https://a.com/", "https:///a", true},
+
+		// 3. method
 		{"GET /", "/", true},
 		{"/", "GET /", false},
 		{"GET /", "POST /", false},
@@ -445,7 +720,7 @@ func TestHigherPrecedence(t *testing.T) {
 		{"/foo", "GET /", false},
 		{"HEAD /", "GET /", true},
 
-		// 3. more specific path
+		// 4. more specific path
 		{"/", "/", false},
 		{"/a", "/", true},
 		{"/", "/a", false},
@@ -460,7 +735,7 @@ func TestHigherPrecedence(t *testing.T) {
 		{"/a/bc", "/a/b", false},
 		{"/a/b", "/a/bc", false},
 
-		// 4. {$}
+		// 5. {$}
 		{"/{$}", "/", true},
 		{"/", "/{$}", false},
 		{"/a/{x}/{$}", "/a/{x}/", true},
@@ -482,6 +757,116 @@ func TestHigherPrecedence(t *testing.T) {
 	}
 }
 
+func TestPrecedes(t *testing.T) {
+	for _, test := range []struct {
+		p1, p2 string
+		seq1   int
+		seq2   int
+		want   bool
+	}{
+		{"/a/b", "/a/{x}", 0, 0, true},   // higher precedence
+		{"/c/{z}", "/{y}/d", 2, 1, true}, // conflict: longer literal prefix
+		{"/{y}/d", "/c/{z}", 1, 2, false},
+		{"/a/{x}", "/a/{y}", 1, 2, true}, // tie: registered first
+		{"/a/{x}", "/a/{y}", 2, 1, false},
+		{"/a/{x}", "/a/{y}", 0, 0, true}, // tie: lesser string
+		{"/a/{x}", "/a/{x}", 0, 0, false},
+		{"/a/{p...}/b", "/a/{p...}", 2, 1, true}, // literals after a multi
+		{"/a/{p...}/b/c", "/a/{p...}/c", 2, 1, true},
+		{"/a/{x}/b", "/a/{p...}/b", 2, 1, true},
+	} {
+		pat1 := mustParse(t, test.p1)
+		pat2 := mustParse(t, test.p2)
+		pat1.seq, pat2.seq = test.seq1, test.seq2
+		if got := pat1.Precedes(pat2); got != test.want {
+			t.Errorf("%q (seq %d).Precedes(%q (seq %d)) = %t, want %t",
+				test.p1, test.seq1, test.p2, test.seq2, got, test.want)
+		}
+	}
+
+	// Precedes is consistent with HigherPrecedence.
+	var pats []*Pattern
+	for _, s := range []string{"/", "/a", "/a/", "/a/{x}", "/{x}/b", "GET /a", "HEAD /a",
+		"h/a", "https:///a", "/a/{$}", "/a/{x...}", "[10.0.0.0/8]/a", "10.1.2.3/"} {
+		pats = append(pats, mustParse(t, s))
+	}
+	for _, p1 := range pats {
+		for _, p2 := range pats {
+			if p1.HigherPrecedence(p2) && !p1.Precedes(p2) {
+				t.Errorf("%q has higher precedence than %q but does not precede it", p1, p2)
+			}
+		}
+	}
+}
+
+func TestMediaTypePrecedence(t *testing.T) {
+	withMedia := func(s, mt string) *Pattern {
+		p := mustParse(t, s)
+		p.mediaType = mt
+		return p
+	}
+	for _, test := range []struct {
+		p1, m1, p2, m2 string
+		wantHigher     bool
+		wantConflict   bool
+	}{
+		{"/a", "application/json", "/a", "", true, false},
+		{"/a", "", "/a", "application/json", false, false},
+		{"/a", "application/json", "/a", "text/html", false, false},
+		{"/a", "application/json", "/a", "application/json", false, true},
+		{"/a/{x}", "application/json", "/a/b", "", false, false},
+		{"/{x}/b", "application/json", "/a/{y}", "", false, true},
+	} {
+		pat1 := withMedia(test.p1, test.m1)
+		pat2 := withMedia(test.p2, test.m2)
+		if got := pat1.HigherPrecedence(pat2); got != test.wantHigher {
+			t.Errorf("%q (%s).HigherPrecedence(%q (%s)) = %t, want %t",
+				test.p1, test.m1, test.p2, test.m2, got, test.wantHigher)
+		}
+		if got := pat1.ConflictsWith(pat2); got != test.wantConflict {
+			t.Errorf("%q (%s).ConflictsWith(%q (%s)) = %t, want %t",
+				test.p1, test.m1, test.p2, test.m2, got, test.wantConflict)
+		}
+	}
+}
+
+func TestHeaderPrecedence(t *testing.T) {
+	withHeaders := func(s, hs string) *Pattern {
+		p := mustParse(t, s)
+		for _, h := range strings.Fields(hs) {
+			k, v, _ := strings.Cut(h, "=")
+			p.headers = append(p.headers, headerMatch{k, v})
+		}
+		return p
+	}
+	for _, test := range []struct {
+		p1, h1, p2, h2 string
+		wantHigher     bool
+		wantConflict   bool
+	}{
+		{"/a", "X-A=1", "/a", "", true, false},
+		{"/a", "", "/a", "X-A=1", false, false},
+		{"/a", "X-A=1 X-B=", "/a", "X-A=1", true, false},
+		{"/a", "X-A=1", "/a", "X-A=", true, false},
+		{"/a", "X-A=1", "/a", "X-A=2", false, false},
+		{"/a", "X-A=1", "/a", "X-B=1", false, true},
+		{"/a", "X-A=1", "/a", "X-A=1", false, true},
+		{"/a/{x}", "X-A=1", "/a/b", "", false, false},
+		{"/{x}/b", "X-A=1", "/a/{y}", "X-A=2", false, true},
+	} {
+		pat1 := withHeaders(test.p1, test.h1)
+		pat2 := withHeaders(test.p2, test.h2)
+		if got := pat1.HigherPrecedence(pat2); got != test.wantHigher {
+			t.Errorf("%q (%s).HigherPrecedence(%q (%s)) = %t, want %t",
+				test.p1, test.h1, test.p2, test.h2, got, test.wantHigher)
+		}
+		if got := pat1.ConflictsWith(pat2); got != test.wantConflict {
+			t.Errorf("%q (%s).ConflictsWith(%q (%s)) = %t, want %t",
+				test.p1, test.h1, test.p2, test.h2, got, test.wantConflict)
+		}
+	}
+}
+
 func TestConflictsWith(t *testing.T) {
 	for _, test := range []struct {
 		p1, p2 string
@@ -507,7 +892,48 @@ func TestConflictsWith(t *testing.T) {
 		{"/", "GET /foo", false},
 		{"GET /", "GET /foo", false},
 		{"GET /", "/foo", true},
+		{"https:///a", "/a", false},
+		{"/items/{id?}", "/items", true},
+		{"/items/{id?}", "/items/{x}", true},
+		{"/items/{id?}", "/items/new", false},
+		{"/items/{id?}", "/items/", false},
+		{"/{x?}", "/{$}", true},
+		{"/{x?}", "/a/{y?}", false},
+		{"/a/{x?}", "/{y}/b", true},
+		{"/a/{x?}", "/{y}/{z?}", false},
+		{"/foo/?", "/foo", true},
+		{"/foo/?", "/foo/{$}", true},
+		{"/foo/?", "/foo/{x}", false}, // a wildcard doesn't match an empty segment
+		{"/foo/?", "/foo/", false},    // more specific
+		{"/foo/?", "/{x}/?", false},
+		{"/foo/?", "/{x}", false},
+		{"/{x}/?", "/foo/", true},
+		{"https:///a", "https:///a", true},
+		{"https:///a/{x}", "https:///{y}/b", true},
 		{"GET /foo", "HEAD /", true},
+		{"GET,POST /x", "GET /x", true},
+		{"GET,POST /x", "POST,PUT /x", true},
+		{"GET,HEAD /x", "GET /x", true},
+		{"GET,POST /x", "PUT,DELETE /x", false},
+		{"GET,POST /x", "/x", false},
+		{"HEAD,POST /x", "GET /x", false},
+		{"GET,POST /a/b", "GET /a/{x}", false},
+		// A pattern without a method matches every method, so it can conflict
+		// with one that has a method when their paths overlap.
+		{"/x", "GET /x", false}, // GET /x is more specific
+		{"/x", "GET /y", false},
+		{"/{x}", "GET /a", false},
+		{"GET /{x}", "/a", true},
+		{"/a/{x}", "GET /{y}/b", true},
+		{"/a/{x}", "HEAD /{y}/b", true},
+		{"/a/{x...}", "POST /a/{y}", false},
+		{"/a/{d:2}", "/a/{x}/{y}", true},
+		{"/a/{d:2}", "/a/b/{y}", false},
+		{"/a/{d:2}", "/{x}/b/{y}", true},
+		{"/a/{d:2}", "/a/{x...}", false},
+		{"/archive/{date:3}/article", "/archive/{slug}", false},
+		{"/files/{p...}/download", "/files/{x}/{y...}", false}, // more specific
+		{"/files/{p...}/download", "/files/a/{y...}", true},
 	} {
 		pat1 := mustParse(t, test.p1)
 		pat2 := mustParse(t, test.p2)
@@ -525,20 +951,84 @@ func TestConflictsWith(t *testing.T) {
 	}
 }
 
+func TestIsSubsetOf(t *testing.T) {
+	for _, test := range []struct {
+		p1, p2 string
+		want   bool
+	}{
+		{"/a/b", "/a/{x}", true},
+		{"/a/{x}", "/a/b", false},
+		{"/a/{x}", "/a/{y}", true},
+		{"/a/{x}", "/{y}/b", false}, // overlaps
+		{"/a/b", "/c", false},
+		{"/a/b/c", "/a/", true},
+		{"GET /a", "/a", true},
+		{"/a", "GET /a", false},
+		{"HEAD /a", "GET /a", true},
+		{"GET /a", "HEAD /a", false},
+		{"GET,POST /a", "GET,POST,PUT /a", true},
+		{"GET,POST /a", "GET /a", false},
+		{"h.com/a", "/a", true},
+		{"/a", "h.com/a", false},
+		{"h.com/a", "i.com/a", false},
+	} {
+		pat1 := mustParse(t, test.p1)
+		pat2 := mustParse(t, test.p2)
+		if got := pat1.IsSubsetOf(pat2); got != test.want {
+			t.Errorf("%q.IsSubsetOf(%q) = %t, want %t", test.p1, test.p2, got, test.want)
+		}
+	}
+}
+
+func TestRelationship(t *testing.T) {
+	for _, test := range []struct {
+		p1, p2 string
+		want   Relationship
+	}{
+		{"/a/{x}", "/a/{y}", Equivalent},
+		{"GET /a", "GET /a", Equivalent},
+		{"/a/b", "/a/{x}", MoreSpecific},
+		{"GET /a", "/a", MoreSpecific},
+		{"h.com/a", "/a", MoreSpecific},
+		{"h.com/a", "/{x}", MoreSpecific},
+		{"/", "/a", MoreGeneral},
+		{"/a", "HEAD /a", MoreGeneral},
+		{"/a/{x}", "/{y}/b", Overlaps},
+		{"h.com/{x}", "/a", Overlaps},
+		{"GET /", "/a", Overlaps},
+		{"/a", "/b", Disjoint},
+		{"GET /a", "POST /a", Disjoint},
+		{"h.com/a", "i.com/a", Disjoint},
+		{"h.com/a", "/b", Disjoint},
+		{"https:///a", "/a", MoreSpecific},
+		{"[10.0.0.0/8]/a", "10.1.2.3/a", MoreGeneral},
+		{"[10.0.0.0/8]/a", "[10.1.0.0/16]/{x}", Overlaps},
+		{"[10.0.0.0/8]/a", "[192.168.0.0/16]/a", Disjoint},
+		{"[10.0.0.0/8]/a", "192.168.0.1/a", Disjoint},
+		{"/a", "https:///{x}", Overlaps},
+		{"https://h.com/a", "https:///a", MoreSpecific},
+	} {
+		pat1 := mustParse(t, test.p1)
+		pat2 := mustParse(t, test.p2)
+		if got := pat1.Relationship(pat2); got != test.want {
+			t.Errorf("%q.Relationship(%q) = %s, want %s", test.p1, test.p2, got, test.want)
+		}
+		if got, want := pat2.Relationship(pat1), inverseRelationship(test.want); got != want {
+			t.Errorf("%q.Relationship(%q) = %s, want %s", test.p2, test.p1, got, want)
+		}
+	}
+}
+
 func TestRegisterConflict(t *testing.T) {
 	mux := NewServeMux()
 	pat1 := "/a/{x}/"
-	if err := mux.register(pat1, http.NotFoundHandler()); err != nil {
-		t.Fatal(err)
-	}
+	mux.Handle(pat1, http.NotFoundHandler())
 	pat2 := "/a/{y}/{z...}"
-	err := mux.register(pat2, http.NotFoundHandler())
 	var got string
-	if err == nil {
-		got = "<nil>"
-	} else {
-		got = err.Error()
-	}
+	func() {
+		defer func() { got = fmt.Sprint(recover()) }()
+		mux.Handle(pat2, http.NotFoundHandler())
+	}()
 	q1 := regexp.QuoteMeta(pat1)
 	q2 := regexp.QuoteMeta(pat2)
 	wantre := `pattern "` + q2 +
@@ -555,6 +1045,39 @@ func TestRegisterConflict(t *testing.T) {
 	}
 }
 
+func TestSuggestFix(t *testing.T) {
+	for _, test := range []struct {
+		p1, p2 string
+		want   string
+	}{
+		{"/a", "/a", `add a method to /a, like "GET /a"`},
+		{"a.com/a", "a.com/a", `like "GET a.com/a"`},
+		{"GET /a/{x}", "GET /a/{y}", `replace a wildcard in GET /a/{x} with a literal, like "GET /a/x"`},
+		{"GET /a/{x}/", "GET /a/{y}/", `like "GET /a/x/"`},
+		{"GET /a", "GET,POST /a", "remove one of the patterns"},
+		{"/a/{x}", "/{y}/b", `replace /a/{x} with a pattern that is more specific than /{y}/b, like "/a/b". Unlike /a/{x}, it does not match "/a/x".`},
+		{"/a/{x...}", "/{y}/b/{z}", `like "/a/b/{z}"`},
+		{"/a/b", "GET /a/{x}", `like "GET /a/b"`},
+	} {
+		p1 := mustParse(t, test.p1)
+		p2 := mustParse(t, test.p2)
+		if !p1.ConflictsWith(p2) {
+			t.Fatalf("%s does not conflict with %s", p1, p2)
+		}
+		got := suggestFix(p1, p2)
+		if !strings.Contains(got, test.want) {
+			t.Errorf("%s vs. %s:\ngot  %s\nwant it to contain %s", test.p1, test.p2, got, test.want)
+		}
+	}
+
+	mux := NewServeMux()
+	mux.Handle("/a/{x}", http.NotFoundHandler())
+	err := mux.CanRegister(mustParse(t, "/{y}/b"))
+	if want := `Suggestion: replace /{y}/b with a pattern that is more specific than /a/{x}, like "/a/b".`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want it to contain %q", err, want)
+	}
+}
+
 func TestDescribeRelationship(t *testing.T) {
 	for _, test := range []struct {
 		p1, p2 string
@@ -571,6 +1094,19 @@ func TestDescribeRelationship(t *testing.T) {
 		{"/", "/foo", "is more specific than"},
 		{"a.com/b", "/b", "does not have a host"},
 		{"a.com/b", "b.com/b", "different hosts"},
+		{"GET /x", "POST /x", "different methods"},
+		{"GET /x", "POST /y", "different methods"},
+		{"GET /x", "/x", `Only /x matches "POST /x"`},
+		{"a.com/x", "/x", "/x does not have a host, while a.com/x does"},
+		{"/x", "a.com/x", "/x does not have a host, while a.com/x does"},
+		{"a.com/x", "/y", "has no requests in common"},
+		{"GET a.com/x", "POST /x", "different methods"},
+		{"GET,POST /x", "GET /x", "matches the same"},
+		{"GET,POST /x", "/x", "is more specific than"},
+		{"https:///x", "/x", "/x does not require https, while https:///x does"},
+		{"[10.0.0.0/8]/x", "10.1.2.3/x", "10.1.2.3/x has a more specific host than [10.0.0.0/8]/x"},
+		{"[10.0.0.0/8]/x", "[11.0.0.0/8]/x", "different hosts"},
+		{"https:///x", "/y", "has no requests in common"},
 	} {
 		got := DescribeRelationship(test.p1, test.p2)
 		fmt.Println(got)
@@ -581,6 +1117,560 @@ func TestDescribeRelationship(t *testing.T) {
 	}
 }
 
+func TestDescribeRelationshipErr(t *testing.T) {
+	got, err := DescribeRelationshipErr("/a", "/{x}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := DescribeRelationship("/a", "/{x}"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, test := range [][2]string{
+		{"/{x", "/a"},
+		{"/a", "GET"},
+		{"", ""},
+	} {
+		got, err := DescribeRelationshipErr(test[0], test[1])
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%q, %q: got (%q, %v), want a *ParseError", test[0], test[1], got, err)
+		}
+	}
+}
+
+func TestConflict(t *testing.T) {
+	for _, test := range []struct {
+		p1, p2   string
+		want     bool
+		wantDesc string
+	}{
+		{"/a", "/b", false, "no requests in common"},
+		{"GET /a", "POST /a", false, "different methods"},
+		{"/a/{x}", "/{y}/b", true, "neither is more specific"},
+		{"/{x}", "/{y}", true, "matches the same requests"},
+		{"/items/{id?}", "/items/{x}", true, "matches the same requests"},
+		{"/a/{x}", "/a/b", false, "is more specific than"},
+		{"GET /a", "/a", false, "is more specific than"},
+	} {
+		got, desc, err := Conflict(test.p1, test.p2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want || !strings.Contains(desc, test.wantDesc) {
+			t.Errorf("%s vs. %s: got (%t, %q), want (%t, description containing %q)",
+				test.p1, test.p2, got, desc, test.want, test.wantDesc)
+		}
+	}
+	if _, _, err := Conflict("/a", "/{b"); err == nil {
+		t.Error("bad pattern: got nil error")
+	}
+}
+
+func TestMethod(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"/", ""},
+		{"GET /", "GET"},
+		{"GET,POST /", "GET,POST"},
+		{"GET POST /", "GET,POST"},
+	} {
+		p := mustParse(t, test.in)
+		if got := p.Method(); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+		if got := p.String(); got != test.in {
+			t.Errorf("%q: String() = %q", test.in, got)
+		}
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	for _, test := range []struct {
+		in     string
+		want   []string
+		multi  bool
+		static bool
+	}{
+		{"/", nil, false, false},
+		{"/a/b", nil, false, true},
+		{"GET example.com/a/b", nil, false, true},
+		{"/a/b/{$}", nil, false, true},
+		{"/{$}", nil, false, true},
+		{"/{x}/", []string{"x"}, false, false},
+		{"/a/{x}", []string{"x"}, false, false},
+		{"/{x...}", []string{"x"}, true, false},
+		{"/{x}/b/{y}/{z...}", []string{"x", "y", "z"}, true, false},
+		{"/{x:2}/b/{y:3}", []string{"x", "y"}, false, false},
+		{"/a/{x?}", []string{"x"}, false, false},
+	} {
+		p := mustParse(t, test.in)
+		got := p.Wildcards()
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.in, got, test.want)
+		}
+		if g, w := p.NumWildcards(), len(test.want); g != w {
+			t.Errorf("%q: NumWildcards() = %d, want %d", test.in, g, w)
+		}
+		if g, w := p.HasMultiWildcard(), test.multi; g != w {
+			t.Errorf("%q: HasMultiWildcard() = %t, want %t", test.in, g, w)
+		}
+		if g, w := p.IsStatic(), test.static; g != w {
+			t.Errorf("%q: IsStatic() = %t, want %t", test.in, g, w)
+		}
+	}
+}
+
+func TestWithRenamedWildcards(t *testing.T) {
+	for _, test := range []struct {
+		in     string
+		rename map[string]string
+		want   string // or error substring, if it begins with "error: "
+	}{
+		{"GET /users/{id}", map[string]string{"id": "userID"}, "GET /users/{userID}"},
+		{"/users/{id}/posts/{post}", map[string]string{"id": "post", "post": "id"}, "/users/{post}/posts/{id}"},
+		{"https://a.com/{d:2}/{rest...}", map[string]string{"d": "date", "x": "y"}, "https://a.com/{date:2}/{rest...}"},
+		{"/items/{id?}", map[string]string{"id": "n"}, "/items/{n?}"},
+		{"/list/{page=1}", map[string]string{"page": "p"}, "/list/{p=1}"},
+		{"/a/{x}/{$}", map[string]string{"x": "y"}, "/a/{y}/{$}"},
+		{"/a/{x}/{y}", map[string]string{"x": "y"}, `error: duplicate wildcard names`},
+		{"/a/{x}/{y}", map[string]string{"x": "z", "y": "z"}, `error: duplicate wildcard names`},
+		{"/a/{x}", map[string]string{"x": "a-b"}, `error: bad wildcard name "a-b"`},
+	} {
+		p := mustParse(t, test.in)
+		got, err := p.WithRenamedWildcards(test.rename)
+		if want, ok := strings.CutPrefix(test.want, "error: "); ok {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("%q: got error %v, want one containing %q", test.in, err, want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if got.String() != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+		if !slices.Equal(got.Wildcards(), mustParse(t, test.want).Wildcards()) {
+			t.Errorf("%q: got wildcards %q, want those of %q", test.in, got.Wildcards(), test.want)
+		}
+		if got.comparePaths(p) != equivalent {
+			t.Errorf("%q: renamed pattern %q matches different paths", test.in, got)
+		}
+	}
+
+	p, err := ParseWithDelimiter("GET a.{x}.{rest...}", '.')
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.WithRenamedWildcards(map[string]string{"x": "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "GET a.{y}.{rest...}"; got.String() != want {
+		t.Errorf("with delimiter: got %q, want %q", got, want)
+	}
+}
+
+func TestOpenAPIPath(t *testing.T) {
+	for _, test := range []struct {
+		pattern    string
+		path       string
+		parameters []string
+	}{
+		{"/", "/", nil},
+		{"GET example.com/a/b", "/a/b", nil},
+		{"/a/b/", "/a/b/", nil},
+		{"/a/{$}", "/a/", nil},
+		{"GET /users/{id}", "/users/{id}", []string{"id"}},
+		{"/users/{u}/posts/{p}", "/users/{u}/posts/{p}", []string{"u", "p"}},
+		{"GET,HEAD /files/{path...}", "/files/{path}", []string{"path"}},
+		{"/files/{path...}/download", "/files/{path}/download", []string{"path"}},
+		{"/archive/{date:3}/article", "/archive/{date}/article", []string{"date"}},
+	} {
+		p, err := Parse(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.OpenAPIPath(); got != test.path {
+			t.Errorf("%q.OpenAPIPath() = %q, want %q", test.pattern, got, test.path)
+		}
+		if got := p.OpenAPIParameters(); !slices.Equal(got, test.parameters) {
+			t.Errorf("%q.OpenAPIParameters() = %q, want %q", test.pattern, got, test.parameters)
+		}
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	in := `# Routes.
+GET /users/{id}
+
+  POST /users   
+# /commented/out
+/files/{path...}
+`
+	pats, err := ParseLines(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range pats {
+		got = append(got, p.String()+" at "+p.location())
+	}
+	want := []string{"GET /users/{id} at line 2", "POST /users at line 4", "/files/{path...} at line 6"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = ParseLines(strings.NewReader("/a\n# ok\n/b/{x\n/c\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), `line 3 "/b/{x":`) {
+		t.Errorf("got %v, want an error for line 3", err)
+	}
+
+	// Errors from RegisterAll use the line numbers.
+	pats, err = ParseLines(strings.NewReader("/a/{x}\n\n/a/{y}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes []Route
+	for _, p := range pats {
+		routes = append(routes, Route{p, http.NotFoundHandler()})
+	}
+	err = NewServeMux().RegisterAll(routes)
+	if err == nil || !strings.Contains(err.Error(), "line 1") || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("got %v, want an error mentioning lines 1 and 3", err)
+	}
+}
+
+func TestParseWithDelimiter(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want []segment
+	}{
+		{"com.example.{service}", []segment{{s: "com"}, {s: "example"}, {s: "service", wild: true}}},
+		{"com.example.", []segment{{s: "com"}, {s: "example"}, {wild: true, multi: true}}},
+		{"com.{rest...}", []segment{{s: "com"}, {s: "rest", wild: true, multi: true}}},
+		{"a/b.c", []segment{{s: "a.b"}, {s: "c"}}},
+		{"a.{d:2}.{{x.y}}", []segment{{s: "a"}, {s: "d", wild: true, span: 2}, {s: "d", wild: true, span: 2, part: 1}, {s: "{x"}, {s: "y}"}}},
+	} {
+		p, err := ParseWithDelimiter(test.in, '.')
+		if err != nil {
+			t.Fatalf("%q: %v", test.in, err)
+		}
+		if !slices.Equal(p.segments, test.want) {
+			t.Errorf("%q: got %#v, want %#v", test.in, p.segments, test.want)
+		}
+		if p.String() != test.in {
+			t.Errorf("%q: String() = %q", test.in, p.String())
+		}
+	}
+	// As with Parse, the methods end at the last space before the path's
+	// first segment ends.
+	for _, test := range []struct {
+		in      string
+		d       byte
+		methods []string
+		want    []segment
+	}{
+		{"GET,POST a:{b}", ':', []string{"GET", "POST"}, []segment{{s: "a"}, {s: "b", wild: true}}},
+		{"GET POST com.a", '.', []string{"GET", "POST"}, []segment{{s: "com"}, {s: "a"}}},
+		{"com.a b", '.', nil, []segment{{s: "com"}, {s: "a b"}}},
+		{"GET com.a b.c", '.', []string{"GET"}, []segment{{s: "com"}, {s: "a b"}, {s: "c"}}},
+	} {
+		p, err := ParseWithDelimiter(test.in, test.d)
+		if err != nil {
+			t.Fatalf("%q: %v", test.in, err)
+		}
+		if !slices.Equal(p.methods, test.methods) || !slices.Equal(p.segments, test.want) {
+			t.Errorf("%q: got methods %v, segments %#v; want %v, %#v", test.in, p.methods, p.segments, test.methods, test.want)
+		}
+	}
+	for _, d := range []byte{' ', '{', '%', 0} {
+		if _, err := ParseWithDelimiter("a", d); err == nil {
+			t.Errorf("%q: got nil, want error", d)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	strict := ValidateOptions{MaxWildcards: 2, CatchAllMultis: true, RequireHost: true, RequireMethod: true}
+	for _, test := range []struct {
+		pattern string
+		opts    ValidateOptions
+		want    []string // error substrings; nil for valid
+	}{
+		{"/a/{x}/{y}/{z}", ValidateOptions{}, nil},
+		{"GET a.com/{x}/{y}", strict, nil},
+		{"GET a.com/{path...}", strict, nil},
+		{"GET a.com/", strict, nil},
+		{"GET a.com/{x}/{y}/{z}", strict, []string{"3 wildcards, more than 2"}},
+		{"GET a.com/{d:3}", strict, nil},
+		{"GET a.com/static/", strict, []string{"not a catch-all"}},
+		{"GET a.com/files/{path...}", strict, []string{"not a catch-all"}},
+		{"/a", strict, []string{"missing host", "missing method"}},
+		{"/a/{x}/{y}/{z}/", ValidateOptions{MaxWildcards: 1, RequireMethod: true}, []string{"more than 1", "missing method"}},
+	} {
+		err := mustParse(t, test.pattern).Validate(test.opts)
+		if test.want == nil {
+			if err != nil {
+				t.Errorf("%q: %v", test.pattern, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%q: got nil, want error", test.pattern)
+			continue
+		}
+		for _, w := range test.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("%q: got %q, want it to contain %q", test.pattern, err, w)
+			}
+		}
+	}
+}
+
+// FuzzParse checks that Parse does not panic, and that the strings of the
+// patterns it accepts parse again to the same patterns.
+func FuzzParse(f *testing.F) {
+	for _, s := range []string{"/", "/a/b", "GET /{x}/", "a.com/{$}", "/{x...}", "/a/{x?}", "/a/{x=d}", "/a/?",
+		"https://h/{{a}}", "[10.0.0.0/8]/x", "POST,PUT /{d:2}/c", "//a", "/a/",
+		"h.com", "/%7B/{x}"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		p, err := Parse(s)
+		if err != nil {
+			return
+		}
+		// String is the input, so check the form built from p's parts.
+		d := p.debugString()
+		p2, err := Parse(d)
+		if err != nil {
+			t.Fatalf("%q: parsing debugString %q: %v", s, d, err)
+		}
+		if !p.equal(p2) {
+			t.Fatalf("%q: debugString %q reparsed to %s", s, d, p2.debugString())
+		}
+		c := p.Canonical()
+		pc, err := Parse(c)
+		if err != nil {
+			t.Fatalf("%q: parsing Canonical %q: %v", s, c, err)
+		}
+		if got := pc.Canonical(); got != c {
+			t.Fatalf("%q: Canonical %q reparsed to %q", s, c, got)
+		}
+	})
+}
+
+func TestCanonical(t *testing.T) {
+	for _, test := range []struct {
+		in   []string // all with the same canonical form
+		want string
+	}{
+		{[]string{"/"}, "/"},
+		{[]string{"/a/{x}", "/a/{y}"}, "/a/{w1}"},
+		{[]string{"/a/", "/a/{rest...}"}, "/a/"},
+		{[]string{"/a/{$}"}, "/a/{$}"},
+		{[]string{"GET /a", "GET,HEAD /a", "HEAD GET /a"}, "GET /a"},
+		{[]string{"POST,GET,PUT /a", "PUT POST GET /a"}, "GET,POST,PUT /a"},
+		{[]string{"HEAD /a"}, "HEAD /a"},
+		{[]string{"https://example.com/{x}/b/{y...}", "https://example.com/{a}/b/"}, "https://example.com/{w1}/b/"},
+		{[]string{"/{d:3}/x", "/{a}/{b}/{c}/x"}, "/{w1}/{w2}/{w3}/x"},
+		{[]string{"/{x}/{p...}/a/{{b}}", "/{y}/{q...}/a/{{b}}"}, "/{w1}/{w2...}/a/{{b}}"},
+		{[]string{"/items/{id?}", "/items/{x?}"}, "/items/{w1?}"},
+		{[]string{"/items/{id}/?", "/items/{x}/?"}, "/items/{w1}/?"},
+		{[]string{"/files/{{name}}"}, "/files/{{name}}"},
+		{[]string{"[10.1.2.3/8]/a", "[10.0.0.0/8]/a"}, "[10.0.0.0/8]/a"},
+		{[]string{"/A"}, "/A"},
+	} {
+		for _, in := range test.in {
+			p := mustParse(t, in)
+			got := p.Canonical()
+			if got != test.want {
+				t.Errorf("%q: got %q, want %q", in, got, test.want)
+				continue
+			}
+			// The canonical form is a pattern equivalent to the original.
+			q := mustParse(t, got)
+			if r := p.Relationship(q); r != Equivalent {
+				t.Errorf("%q vs. its canonical form %q: %s", in, got, r)
+			}
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	for _, test := range []struct {
+		pattern            string
+		method, host, path string
+		want               map[string]string // nil for no bindings
+		ok                 bool
+	}{
+		{"/a/b", "GET", "", "/a/b", nil, true},
+		{"/a/b", "GET", "", "/a/c", nil, false},
+		{"GET /a", "HEAD", "", "/a", nil, true},
+		{"GET /a", "POST", "", "/a", nil, false},
+		{"a.com/a", "GET", "a.com", "/a", nil, true},
+		{"a.com/a", "GET", "b.com", "/a", nil, false},
+		{"*.a.com/a", "GET", "x.a.com", "/a", nil, true},
+		{"https:///a", "GET", "", "/a", nil, true},
+		{"/users/{id}", "GET", "", "/users/a%20b", map[string]string{"id": "a b"}, true},
+		{"/users/{id}", "GET", "", "/users/", nil, false},
+		{"/users/{id}", "GET", "", "/users/1/2", nil, false},
+		{"/users/{id}/{$}", "GET", "", "/users/1/", map[string]string{"id": "1"}, true},
+		{"/users/{id}/{$}", "GET", "", "/users/1/x", nil, false},
+		{"/files/", "GET", "", "/files/a/b", nil, true},
+		{"/files/", "GET", "", "/files", nil, false},
+		{"/files/{p...}", "GET", "", "/files/a/b", map[string]string{"p": "a/b"}, true},
+		{"/files/{p...}", "GET", "", "/files/", map[string]string{"p": ""}, true},
+		{"/files/{p...}/raw", "GET", "", "/files/a/b/raw", map[string]string{"p": "a/b"}, true},
+		{"/files/{p...}/raw", "GET", "", "/files/raw", nil, false},
+		{"/items/{id?}", "GET", "", "/items", map[string]string{"id": ""}, true},
+		{"/items/{id?}", "GET", "", "/items/4", map[string]string{"id": "4"}, true},
+		{"/list/{page=1}", "GET", "", "/list", map[string]string{"page": "1"}, true},
+		{"/list/{page=1}", "GET", "", "/list/3", map[string]string{"page": "3"}, true},
+	} {
+		p, err := Parse(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := p.MatchPath(test.method, test.host, test.path)
+		if ok != test.ok || !maps.Equal(got, test.want) {
+			t.Errorf("%q.MatchPath(%q, %q, %q) = %v, %t, want %v, %t",
+				test.pattern, test.method, test.host, test.path, got, ok, test.want, test.ok)
+		}
+	}
+
+	p, err := ParseWithDelimiter("a.{b}", '.')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := p.MatchPath("", "", "a.x/y"); !ok || got["b"] != "x/y" {
+		t.Errorf("%q: got %v, %t, want b bound to \"x/y\"", p, got, ok)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		values  map[string]string
+		want    string // or error substring, if it begins with "error: "
+	}{
+		{"/", nil, "/"},
+		{"GET example.com/a/b", nil, "/a/b"},
+		{"/a/{$}", nil, "/a/"},
+		{"/users/{id}/", map[string]string{"id": "17"}, "/users/17/"},
+		{"/users/{id}", map[string]string{"id": "a/b c"}, "/users/a%2Fb%20c"},
+		{"/files/{path...}", map[string]string{"path": "a/b c/d"}, "/files/a/b%20c/d"},
+		{"/files/{path...}", map[string]string{"path": ""}, "/files/"},
+		{"/files/{path...}/raw", map[string]string{"path": "a/b c"}, "/files/a/b%20c/raw"},
+		{"/files/{path...}/raw", map[string]string{"path": ""}, `error: empty value for wildcard "path"`},
+		{"/items/{id?}", map[string]string{"id": "4"}, "/items/4"},
+		{"/items/{id?}", nil, "/items"},
+		{"/list/{page=1}", map[string]string{"page": "1"}, "/list"},
+		{"/list/{page=1}", map[string]string{"page": "2"}, "/list/2"},
+		{"/items/?", nil, "/items"},
+		{"/{x?}", nil, "/"},
+		{"/{{lit}}/{x}", map[string]string{"x": "1", "y": "2"}, "/%7Blit%7D/1"},
+		{"/archive/{date:3}/article", map[string]string{"date": "2024/01/15"}, "/archive/2024/01/15/article"},
+		{"/archive/{date:3}", map[string]string{"date": "2024/01"}, "error: is not 3 non-empty segments"},
+		{"/archive/{date:3}", map[string]string{"date": "2024//15"}, "error: is not 3 non-empty segments"},
+		{"/users/{id}", nil, `error: missing value for wildcard "id"`},
+		{"/users/{id}", map[string]string{"id": ""}, `error: empty value for wildcard "id"`},
+	} {
+		p := mustParse(t, test.pattern)
+		got, err := p.Build(test.values)
+		if want, ok := strings.CutPrefix(test.want, "error: "); ok {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("%q: got (%q, %v), want error containing %q", test.pattern, got, err, want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.pattern, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.pattern, got, test.want)
+		}
+	}
+}
+
+// TestComparePathsSuffix compares the relationships that comparePaths
+// reports for patterns with literals after a multi wildcard to those found
+// by matching all short paths.
+func TestComparePathsSuffix(t *testing.T) {
+	// paths holds the paths of up to 5 segments drawn from "a", "b" and "x",
+	// with and without a trailing slash.
+	var paths []string
+	var gen func(prefix string, n int)
+	gen = func(prefix string, n int) {
+		paths = append(paths, prefix+"/")
+		if prefix != "" {
+			paths = append(paths, prefix)
+		}
+		if n == 0 {
+			return
+		}
+		for _, s := range []string{"a", "b", "x"} {
+			gen(prefix+"/"+s, n-1)
+		}
+	}
+	gen("", 5)
+	pats := []string{
+		"/", "/a", "/a/", "/a/b", "/a/{x}", "/{x}/b", "/a/{$}", "/{$}",
+		"/a/{x}/{y...}", "/{x}/a/", "/a/{x}/b/{$}", "/b/{z}",
+		"/a/{p...}/b", "/{p...}/b", "/a/{p...}/a/b", "/{p...}/a/b", "/{x}/{p...}/b", "/{p...}/x",
+		"/a/b/{p...}/b", "/{x}/{y}/b", "/a/{x}/b", "/{x}/{y}",
+	}
+	for _, s1 := range pats {
+		p1 := mustParse(t, s1)
+		for _, s2 := range pats {
+			p2 := mustParse(t, s2)
+			m1 := buildTree(s1)
+			m2 := buildTree(s2)
+			only1, only2, both := false, false, false
+			for _, path := range paths {
+				n1, _ := m1.match("GET", "", path)
+				n2, _ := m2.match("GET", "", path)
+				switch {
+				case n1 != nil && n2 != nil:
+					both = true
+				case n1 != nil:
+					only1 = true
+				case n2 != nil:
+					only2 = true
+				}
+			}
+			var want relationship
+			switch {
+			case !both:
+				want = disjoint
+			case !only1 && !only2:
+				want = equivalent
+			case !only1:
+				want = moreSpecific
+			case !only2:
+				want = moreGeneral
+			default:
+				want = overlaps
+			}
+			if got := p1.comparePaths(p2); got != want {
+				t.Errorf("%s vs %s: got %s, want %s", s1, s2, got, want)
+			}
+			if both && (p1.hasSuffix() || p2.hasSuffix()) {
+				path := commonPath(p1, p2)
+				n1, _ := m1.match("GET", "", path)
+				n2, _ := m2.match("GET", "", path)
+				if n1 == nil || n2 == nil {
+					t.Errorf("%s vs %s: common path %q does not match both", s1, s2, path)
+				}
+			}
+		}
+	}
+}
+
 func mustParse(t *testing.T, s string) *Pattern {
 	t.Helper()
 	p, err := Parse(s)
@@ -589,3 +1679,20 @@ func mustParse(t *testing.T, s string) *Pattern {
 	}
 	return p
 }
+
+// bodyHandler returns a handler that writes s as the response body.
+func bodyHandler(s string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, s)
+	})
+}
+
+// mustRoutes returns a Route with a NotFoundHandler for each of pats.
+func mustRoutes(t *testing.T, pats ...string) []Route {
+	t.Helper()
+	var rs []Route
+	for _, p := range pats {
+		rs = append(rs, Route{mustParse(t, p), http.NotFoundHandler()})
+	}
+	return rs
+}
@@ -17,6 +17,7 @@ import (
 	"path"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -27,123 +28,1609 @@ import (
 // ServeMux is an HTTP request multiplexer.
 // It behaves like [net/http.ServeMux], but using the enhanced patterns
 // of this package.
+//
+// ServeMux has the same Handle, HandleFunc, Handler and ServeHTTP methods as
+// net/http.ServeMux, so code can usually switch by replacing the call to
+// http.NewServeMux with NewServeMux. The differences are:
+//   - A pattern may begin with a method and contain wildcards, like
+//     "GET /items/{id}". A path segment that looks like a wildcard is never a
+//     literal.
+//   - When several patterns match a request, the most specific one wins,
+//     rather than the longest. Patterns that match some of the same requests
+//     with neither more specific than the other conflict.
+//   - A pattern with a host takes precedence over one without, but only on
+//     the requests it matches. A request for "a.com/y" goes to "/y" if no
+//     pattern for a.com matches it, even if there is one for "a.com/x".
+//   - Handle and HandleFunc panic on any conflict, not only on duplicate
+//     patterns. The panic describes both patterns and where they were
+//     registered.
 type ServeMux struct {
-	mu            sync.RWMutex
-	tree          *node
+	// NotFound handles requests that match no pattern, unless there is a
+	// handler for the request's host set with HandleNotFound.
+	// If nil, http.NotFoundHandler is used.
+	NotFound http.Handler
+
+	// MethodNotAllowed handles requests whose path matches a pattern, but
+	// not with the request's method. The Allow header is set to the methods
+	// that would match before it is called.
+	// If nil, a handler that replies with a 405 error is used.
+	MethodNotAllowed http.Handler
+
+	// RawBindings makes Match and PathValue return wildcard values exactly
+	// as they appear in the request path, without percent-decoding.
+	// ServeHTTP matches against the escaped form of the path,
+	// r.URL.EscapedPath, which is r.URL.RawPath if that is a valid encoding of
+	// r.URL.Path, and otherwise r.URL.Path re-encoded. So raw values keep
+	// escapes like "%2F", but may not be byte-for-byte what the client sent.
+	RawBindings bool
+
+	// MaxSegments, if positive, is the largest number of segments a path can
+	// have and still be matched. Longer paths match no pattern, and ServeHTTP
+	// replies to them with a 414 (URI Too Long) error.
+	MaxSegments int
+
+	// StrictShadowing makes registration fail if the new pattern shadows
+	// a registered one, or is shadowed by one. A pattern shadows another if,
+	// though its method and path are more general, its host or scheme gives it
+	// precedence on every request they both match. For example,
+	// "example.com/{path...}" shadows "/a/{x}" for requests to example.com.
+	StrictShadowing bool
+
+	// NormalizeMethod makes ServeHTTP, Handler and Match and its variants
+	// convert the request method to upper case before matching, so that a
+	// request with the method "get" matches "GET /". RFC 9110 says that
+	// methods are case-sensitive, and the standard ones are upper case, but
+	// some clients send them in lower case. Patterns must still use upper
+	// case for the standard methods.
+	NormalizeMethod bool
+
+	// MergeTrailingSlash makes ServeHTTP, Handler, Match and its variants
+	// treat a path with a trailing slash and the same path without one alike:
+	// if the request's path matches no pattern, or matches one of lower
+	// precedence than the other form of the path does, the other form is used
+	// instead, without a redirect. So "/items/{id}" matches "/items/3/",
+	// while "/items/3/" still goes to "/{path...}" if there is also such a
+	// pattern but no "/items/{id}/". Wildcards are bound as for the matching
+	// form.
+	MergeTrailingSlash bool
+
+	// StrictHost makes requests for a host that no pattern names match no
+	// pattern at all. Ordinarily, a request whose host matches no pattern
+	// with a host is matched against the patterns without one; with
+	// StrictHost, that happens only if some pattern's host, exact, wildcard
+	// or CIDR, contains the request's host, or if the request has no host.
+	// So a mux with StrictHost and no patterns with hosts serves only
+	// requests without a host, and a request for an unregistered host gets
+	// the NotFound handler, never a 405. Set it before serving; it is not
+	// safe to change while requests are being matched.
+	StrictHost bool
+
+	// OptionsStar handles "OPTIONS *" requests, which ask about the server
+	// as a whole rather than about a resource. Their request target is the
+	// asterisk-form of RFC 7230, section 5.3.4, so their path is "*", which
+	// no pattern matches. If OptionsStar is nil, ServeHTTP replies with an
+	// Allow header listing every method named by a registered pattern, along
+	// with OPTIONS. Note that an http.Server answers these requests itself,
+	// without calling its handler, unless its DisableGeneralOptionsHandler
+	// field is set.
+	OptionsStar http.Handler
+
+	// MaxPatterns, if positive, is the largest number of patterns that can
+	// be registered. Registering more fails with an error that wraps
+	// ErrTooManyPatterns, or panics for methods like Handle that don't return
+	// errors. It guards against route lists from untrusted configuration.
+	// Reset frees the patterns for registering again.
+	MaxPatterns int
+
+	mu            sync.RWMutex         // guards registration; matching uses tree
+	tree          atomic.Pointer[node] // immutable; replaced on each registration
 	conflictCalls atomic.Int32
 	index         *index
+	middleware    []Middleware
+	named         map[string]*Pattern // from HandleNamed; nil while registering
+	treeOpts      treeOptions
+	capacityHint  int
+	nregistered   int         // number of calls to registerPattern, for Pattern.seq
+	npatterns     int         // number of patterns registered since the last Reset
+	delim         byte        // segment delimiter, or 0 for '/'; see WithSegmentDelimiter
+	counting      atomic.Bool // see EnableCounters
+	repeats       bool        // see WithRepeatedWildcards
+}
+
+// An Option configures a ServeMux.
+type Option func(*ServeMux)
+
+// WithMaxSlice sets the number of children above which a node of the mux's
+// routing tree switches from a slice, which is faster to search when small,
+// to a map. A value of zero means nodes always use maps.
+// The default is 8.
+func WithMaxSlice(n int) Option {
+	return func(mux *ServeMux) { mux.treeOpts.maxSlice = n }
 }
 
-func NewServeMux() *ServeMux {
-	return &ServeMux{
-		tree:  &node{},
-		index: newIndex(),
+// A ChildLookup is a way for a node of a mux's routing tree to find the
+// child for a path segment, host or method among its children.
+type ChildLookup int
+
+const (
+	// HybridLookup searches a slice of up to the number of children set by
+	// WithMaxSlice, and uses a map for more. It is the default.
+	HybridLookup ChildLookup = iota
+	// LinearLookup always searches a slice, in the order the children were
+	// added.
+	LinearLookup
+	// MapLookup always uses a map.
+	MapLookup
+	// SortedLookup always uses a slice sorted by key, and searches it by
+	// binary search. It may suit routing tables that are read far more
+	// often than they grow.
+	SortedLookup
+)
+
+// WithChildLookup sets how the nodes of the mux's routing tree find their
+// children. It affects only performance; see BenchmarkChildLookup.
+func WithChildLookup(l ChildLookup) Option {
+	return func(mux *ServeMux) { mux.treeOpts.lookup = l }
+}
+
+// WithCapacityHint sizes the index that the mux uses to find conflicting
+// patterns for about n patterns, so that registering that many doesn't
+// repeatedly grow it. The routing tree is not sized in advance, because its
+// shape depends on the patterns. It affects only performance.
+func WithCapacityHint(n int) Option {
+	return func(mux *ServeMux) { mux.capacityHint = n }
+}
+
+// WithSegmentDelimiter makes the mux split paths into segments at d instead
+// of '/', for matching identifiers like "com.example.api". Patterns passed to
+// the mux's methods are parsed with [ParseWithDelimiter], and the paths passed
+// to Match and its variants must not begin with d. Values and offsets are in
+// terms of the original path.
+// ServeHTTP is unaffected: it matches request paths, which always use '/',
+// as if each '/' were d, so "com.example.{service}" matches "/com/example/api".
+func WithSegmentDelimiter(d byte) Option {
+	return func(mux *ServeMux) {
+		if d != '/' {
+			mux.delim = d
+		}
 	}
 }
 
+// WithFirstMatchWins makes the mux route each request to the first
+// registered pattern that matches it, ignoring the precedence rules, as
+// routers that match in order of declaration do. Since the order then
+// decides, patterns are not checked for conflicts, and a general pattern
+// registered early can hide a more specific one registered later.
+// Patterns that match exactly the same requests still cannot both be
+// registered. Matching examines every matching pattern, so it is slower.
+func WithFirstMatchWins() Option {
+	return func(mux *ServeMux) { mux.treeOpts.firstMatchWins = true }
+}
+
+// WithRepeatedWildcards lets a single wildcard in the mux's patterns have
+// the same name as an earlier single wildcard, so that the pattern matches a
+// path only if the segments at both places are the same. For example,
+// "/{org}/repos/{org}/settings" matches "/go/repos/go/settings" but not
+// "/go/repos/tools/settings". The name is bound once.
+// For precedence and conflicts, a repeated wildcard is like any other, so
+// "/{org}/repos/{org}/settings" conflicts with "/{a}/repos/{b}/settings".
+func WithRepeatedWildcards() Option {
+	return func(mux *ServeMux) { mux.repeats = true }
+}
+
+// WithCaseInsensitivePath makes the mux match the literal segments of
+// patterns without regard to case, so that "/api/users" matches the path
+// "/API/Users". It affects only literal segments: wildcard values keep the
+// case of the request path, and hosts and methods are matched as usual.
+// Patterns whose literals differ only in case conflict.
+func WithCaseInsensitivePath() Option {
+	return func(mux *ServeMux) { mux.treeOpts.caseInsensitive = true }
+}
+
+// WithUnicodeNormalization makes the mux compare the literal segments of
+// patterns and paths in Unicode normalization form NFC, so that a literal
+// with a composed character, like "é" (U+00E9), matches a path with the
+// decomposed form, "e" followed by U+0301, and vice versa. Wildcard values
+// keep the form of the request path. Patterns whose literals differ only in
+// normalization conflict.
+//
+// Each path segment compared with a literal is normalized, which has a cost
+// even for ASCII segments, and allocates for those not already in NFC.
+func WithUnicodeNormalization() Option {
+	return func(mux *ServeMux) { mux.treeOpts.normalizeUnicode = true }
+}
+
+// A Middleware wraps an http.Handler, typically to do work before or after
+// calling it.
+type Middleware func(http.Handler) http.Handler
+
+// NewServeMux returns a new ServeMux configured with the given options.
+func NewServeMux(opts ...Option) *ServeMux {
+	mux := &ServeMux{treeOpts: treeOptions{maxSlice: maxSlice}}
+	for _, o := range opts {
+		o(mux)
+	}
+	mux.index = newIndexSize(mux.capacityHint)
+	mux.tree.Store(&node{opts: &mux.treeOpts})
+	return mux
+}
+
 func (mux *ServeMux) Handle(pattern string, handler http.Handler) {
-	if err := mux.register(pattern, handler); err != nil {
+	if _, err := mux.register(pattern, handler, nil); err != nil {
 		panic(err)
 	}
 }
 
 func (mux *ServeMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
 	// Does not call Handle so that  ServeMux.register retrieves the right source location.
-	if err := mux.register(pattern, http.HandlerFunc(handler)); err != nil {
+	if _, err := mux.register(pattern, http.HandlerFunc(handler), nil); err != nil {
+		panic(err)
+	}
+}
+
+// HandlePattern is like Handle, but returns the parsed pattern, so that
+// callers can use it later, for example with [Pattern.Build]. Instead of
+// panicking, it returns any error from parsing or registering the pattern.
+func (mux *ServeMux) HandlePattern(pattern string, handler http.Handler) (*Pattern, error) {
+	return mux.register(pattern, handler, nil)
+}
+
+// HandleMediaType is like Handle, but handler serves only requests whose
+// Accept header allows mediaType, such as "application/json". Several
+// handlers may be registered for the same pattern with different media
+// types; a request goes to the one its Accept header prefers, or, if it
+// accepts none of them, to the handler registered for the pattern with
+// Handle, if any. Otherwise the request goes to the next pattern in
+// precedence order that matches it and whose media type and headers it
+// allows, and if there is none, the mux replies with 406 Not Acceptable.
+// A request without an Accept header accepts any media type.
+// Matches and similar methods that don't see the request's headers report
+// the pattern registered with Handle, or else the first with a media type
+// or headers.
+func (mux *ServeMux) HandleMediaType(pattern, mediaType string, handler http.Handler) {
+	typ, sub, ok := strings.Cut(mediaType, "/")
+	if !ok || typ == "" || sub == "" || strings.ContainsAny(mediaType, "*;, ") {
+		panic(fmt.Sprintf("HandleMediaType: bad media type %q", mediaType))
+	}
+	mediaType = strings.ToLower(mediaType)
+	if _, err := mux.register(pattern, handler, func(p *Pattern) { p.mediaType = mediaType }); err != nil {
+		panic(err)
+	}
+}
+
+// HandleHeaders is like Handle, but handler serves only requests that have
+// each header in headers, such as "X-Internal". If the header's value in
+// headers is not empty, one of the request's values for it must equal it.
+// Several handlers may be registered for the same pattern with different
+// headers; a request goes to the one with the most headers that it meets,
+// or else to the handler registered for the pattern with Handle, if any.
+// If it meets none, the request goes to the next pattern in precedence order
+// that matches it and whose headers it meets, as though the pattern were not
+// registered, so "GET /admin/" with a header falls through to "/{path...}"
+// for requests without it. Headers may be combined with
+// [ServeMux.HandleMediaType]: of the patterns with a request's headers, its
+// Accept header chooses.
+// Matches and similar methods that don't see the request's headers report
+// the pattern registered with Handle, or else the first with headers.
+func (mux *ServeMux) HandleHeaders(pattern string, headers map[string]string, handler http.Handler) {
+	if len(headers) == 0 {
+		panic("HandleHeaders: no headers")
+	}
+	var hms []headerMatch
+	for k, v := range headers {
+		if k == "" {
+			panic("HandleHeaders: empty header key")
+		}
+		hms = append(hms, headerMatch{http.CanonicalHeaderKey(k), v})
+	}
+	sort.Slice(hms, func(i, j int) bool { return hms[i].key < hms[j].key })
+	for i := 1; i < len(hms); i++ {
+		if hms[i].key == hms[i-1].key {
+			panic(fmt.Sprintf("HandleHeaders: duplicate header %q", hms[i].key))
+		}
+	}
+	if _, err := mux.register(pattern, handler, func(p *Pattern) { p.headers = hms }); err != nil {
 		panic(err)
 	}
 }
 
-func (mux *ServeMux) register(pattern string, handler http.Handler) error {
+// HandleExact is like Handle, but pins pattern to the path it names, so that
+// it wins over every other pattern that matches a request it matches. The
+// pattern's path must be literal, without wildcards or a trailing slash other
+// than "{$}", and its host, if it has one, must be a plain host name. It may
+// not require https.
+//
+// Ordinarily a literal path already takes precedence over wildcards, so
+// "/static/index.html" wins over "/static/{path...}". But a pattern with a
+// host or scheme takes precedence over one without, whatever their paths, so
+// "example.com/{path...}" would win on requests to example.com. Registered
+// with HandleExact, "/static/index.html" serves that path on every host.
+// Among pinned patterns, the usual precedence applies, and a pinned pattern
+// conflicts with the same patterns as it would if registered with Handle.
+func (mux *ServeMux) HandleExact(pattern string, handler http.Handler) {
+	if _, err := mux.register(pattern, handler, func(p *Pattern) { p.pinned = true }); err != nil {
+		panic(err)
+	}
+}
+
+// HandleNamed is like Handle, but also gives the registration a name,
+// so that [ServeMux.URL] can later build paths for it.
+// It panics if name is already in use.
+func (mux *ServeMux) HandleNamed(name, pattern string, handler http.Handler) {
+	mux.mu.Lock()
+	if _, ok := mux.named[name]; ok {
+		mux.mu.Unlock()
+		panic(fmt.Sprintf("HandleNamed: duplicate name %q", name))
+	}
+	if mux.named == nil {
+		mux.named = map[string]*Pattern{}
+	}
+	// Reserve the name, so a concurrent call can't also use it.
+	mux.named[name] = nil
+	mux.mu.Unlock()
+
+	pat, err := mux.register(pattern, handler, nil)
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if err != nil {
+		delete(mux.named, name)
+		panic(err)
+	}
+	mux.named[name] = pat
+}
+
+// URL returns the path for the pattern registered with HandleNamed under
+// name, with its wildcards replaced by values, as by [Pattern.Build].
+// It returns an error if there is no such pattern.
+func (mux *ServeMux) URL(name string, values map[string]string) (string, error) {
+	mux.mu.RLock()
+	pat := mux.named[name]
+	mux.mu.RUnlock()
+	if pat == nil {
+		return "", fmt.Errorf("no pattern named %q", name)
+	}
+	return pat.Build(values)
+}
+
+// HandleAll is like Handle, but pattern must not have a method, so that
+// handler receives requests with any method that no more specific pattern
+// matches. It panics if pattern has a method.
+func (mux *ServeMux) HandleAll(pattern string, handler http.Handler) {
+	if p, err := mux.parse(pattern); err == nil && len(p.methods) > 0 {
+		panic(fmt.Sprintf("HandleAll: pattern %q has a method", pattern))
+	}
+	if _, err := mux.register(pattern, handler, nil); err != nil {
+		panic(err)
+	}
+}
+
+// HandleWith is like Handle, but wraps handler in the given middleware.
+// The first middleware is the outermost. The chain is built once, when the
+// pattern is registered, and runs inside any middleware added with Use.
+// ReHandle keeps the middleware, wrapping the new handler in it.
+func (mux *ServeMux) HandleWith(pattern string, handler http.Handler, mws ...Middleware) {
+	configure := func(p *Pattern) { p.middleware = mws }
+	if _, err := mux.register(pattern, chain(handler, mws), configure); err != nil {
+		panic(err)
+	}
+}
+
+// A Group registers patterns on a ServeMux under a common prefix.
+// Create one with [ServeMux.Group].
+type Group struct {
+	mux    *ServeMux
+	method string // from the prefix; used by patterns without a method
+	prefix string // host and path, without a final slash or delimiter
+}
+
+// Group returns a Group for registering patterns that begin with prefix,
+// which has the form
+//
+//	[METHOD ][HOST]/[PATH]
+//
+// The patterns given to the group's methods are "[METHOD ]/PATH". Each is
+// registered with the path of prefix, less any final slash, before its own
+// path, and with the method of prefix if it has none of its own. So patterns
+// registered with Group("api.example.com/v1") begin with "api.example.com/v1",
+// and "/users" is registered as "api.example.com/v1/users".
+//
+// If mux has a segment delimiter d, prefix and the group's patterns have
+// the syntax of [ParseWithDelimiter], "[METHOD ]PATH", and each pattern's
+// path is joined to that of prefix with d. So with d == '.', the pattern
+// "users" of Group("com.example") is registered as "com.example.users".
+//
+// Group panics if prefix is not a valid pattern.
+func (mux *ServeMux) Group(prefix string) *Group {
+	if _, err := mux.parse(prefix); err != nil {
+		panic(fmt.Sprintf("Group: bad prefix %q: %v", prefix, err))
+	}
+	return newGroup(mux, prefix)
+}
+
+// newGroup returns a Group of mux for prefix, which is a valid pattern.
+func newGroup(mux *ServeMux, prefix string) *Group {
+	sep := "/"
+	if mux.delim != 0 {
+		sep = string(mux.delim)
+	}
+	method, rest := splitMethod(prefix, mux.delim)
+	return &Group{mux: mux, method: method, prefix: strings.TrimSuffix(rest, sep)}
+}
+
+// Group returns a Group whose prefix is that of g followed by prefix,
+// which has the form of the group's patterns. The method of prefix, if any,
+// replaces that of g.
+func (g *Group) Group(prefix string) *Group {
+	pattern := g.pattern(prefix)
+	if _, err := g.mux.parse(pattern); err != nil {
+		panic(fmt.Sprintf("Group: bad prefix %q: %v", prefix, err))
+	}
+	return newGroup(g.mux, pattern)
+}
+
+// Handle registers handler for pattern with g's prefix, as with
+// [ServeMux.Handle].
+func (g *Group) Handle(pattern string, handler http.Handler) {
+	if _, err := g.mux.register(g.pattern(pattern), handler, nil); err != nil {
+		panic(err)
+	}
+}
+
+// HandleFunc registers handler for pattern with g's prefix, as with
+// [ServeMux.HandleFunc].
+func (g *Group) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	if _, err := g.mux.register(g.pattern(pattern), http.HandlerFunc(handler), nil); err != nil {
+		panic(err)
+	}
+}
+
+// pattern returns the pattern for s with g's prefix.
+// It panics if the path of s doesn't begin with a slash, or, if the mux has
+// a segment delimiter, if it does begin with the delimiter.
+func (g *Group) pattern(s string) string {
+	d := g.mux.delim
+	method, path := splitMethod(s, d)
+	switch {
+	case d == 0 && !strings.HasPrefix(path, "/"):
+		panic(fmt.Sprintf("Group: pattern %q: path must begin with '/'", s))
+	case d != 0 && strings.IndexByte(path, d) == 0:
+		panic(fmt.Sprintf("Group: pattern %q: path must not begin with %q", s, d))
+	case d != 0:
+		path = string(d) + path
+	}
+	if method == "" {
+		method = g.method
+	}
+	if method == "" {
+		return g.prefix + path
+	}
+	return method + " " + g.prefix + path
+}
+
+// splitMethod splits a pattern into its methods and the rest, as Parse does,
+// or as ParseWithDelimiter does if d is not 0.
+// The methods are empty if there are none.
+func splitMethod(s string, d byte) (method, rest string) {
+	if d == 0 {
+		d = '/'
+	}
+	end := strings.IndexByte(s, d)
+	if end < 0 {
+		end = len(s)
+	}
+	if i := strings.LastIndexByte(s[:end], ' '); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return "", s
+}
+
+// ReHandle replaces the handler of the registered pattern that matches
+// exactly the same requests as pattern, such as pattern itself, with handler.
+// The registered pattern is kept, so its wildcard names still apply, and
+// so is any middleware it was registered with by HandleWith, which wraps
+// handler. If pattern is only one form of a registered pattern that ends
+// in an optional wildcard or "/?", like "/items" for "/items/{id?}", only
+// the handler for that form is replaced.
+// Since the patterns don't change, there is no check for conflicts.
+// Requests being served when ReHandle is called may use either handler.
+// ReHandle panics if there is no such pattern.
+func (mux *ServeMux) ReHandle(pattern string, handler http.Handler) {
+	if handler == nil {
+		panic("http: nil handler")
+	}
+	pat, err := mux.parse(pattern)
+	if err != nil {
+		panic(err)
+	}
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	tree := mux.tree.Load()
+	for _, p := range mux.keyed(pat).expand() {
+		tree, err = tree.replaceHandler(p, handler)
+		if err != nil {
+			panic(err)
+		}
+	}
+	mux.tree.Store(tree)
+}
+
+// Use adds mw to the middleware that wraps every handler the mux dispatches
+// to, including the handlers for redirects and for requests that match no
+// pattern. Middleware runs in the order it was added.
+// Use calls the middleware functions to build the chain once, rather than
+// for each request, so the handlers they return must be safe for concurrent
+// use.
+func (mux *ServeMux) Use(mw Middleware) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.middleware = append(mux.middleware, mw)
+	root := *mux.tree.Load()
+	root.chain = chain(http.HandlerFunc(serveChosen), mux.middleware)
+	mux.tree.Store(&root)
+}
+
+// serveChosen calls the handler that ServeHTTP chose for r, which it stores
+// in r's context. It is the innermost handler of the middleware from Use.
+func serveChosen(w http.ResponseWriter, r *http.Request) {
+	r.Context().Value(matchKey{}).(*match).handler.ServeHTTP(w, r)
+}
+
+// HandleNotFound sets the handler for requests to host that match no pattern.
+// Requests to other hosts use mux.NotFound. The host is compared with the
+// request's host after any port is removed, as in patterns.
+// A nil handler removes the one for host.
+func (mux *ServeMux) HandleNotFound(host string, h http.Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	root := *mux.tree.Load()
+	root.notFound = maps.Clone(root.notFound)
+	if h == nil {
+		delete(root.notFound, host)
+	} else {
+		if root.notFound == nil {
+			root.notFound = map[string]http.Handler{}
+		}
+		root.notFound[host] = h
+	}
+	mux.tree.Store(&root)
+}
+
+// chain returns h wrapped in mws, with mws[0] outermost.
+// A nil h stays nil, so register can report it.
+func chain(h http.Handler, mws []Middleware) http.Handler {
+	if h == nil {
+		return nil
+	}
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// register parses pattern and registers it with handler. If configure is not
+// nil, it is called on the parsed pattern first.
+func (mux *ServeMux) register(pattern string, handler http.Handler, configure func(*Pattern)) (*Pattern, error) {
 	if pattern == "" {
-		return errors.New("http: invalid pattern")
+		return nil, errors.New("http: invalid pattern")
 	}
 	if handler == nil {
-		return errors.New("http: nil handler")
+		return nil, errors.New("http: nil handler")
 	}
 
-	pat, err := Parse(pattern)
+	pat, err := mux.parse(pattern)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	pat.loc = callerLocation()
+	if configure != nil {
+		configure(pat)
+	}
+	if err := mux.registerPattern(pat, handler); err != nil {
+		return nil, err
+	}
+	return pat, nil
+}
+
+// registerPattern adds a parsed pattern and its handler to mux.
+func (mux *ServeMux) registerPattern(pat *Pattern, handler http.Handler) error {
+	return mux.registerRoutes([]Route{{pat, handler}})
+}
+
+// ErrTooManyPatterns is wrapped by the error from registering a pattern on
+// a ServeMux that already has MaxPatterns of them.
+var ErrTooManyPatterns = errors.New("too many patterns")
+
+// A Route is a pattern and its handler, for [ServeMux.RegisterAll].
+type Route struct {
+	Pattern *Pattern
+	Handler http.Handler
+}
+
+// RegisterAll registers the patterns and handlers of routes all at once.
+// If any pattern conflicts with one already registered or with another in
+// routes, or any handler is nil, RegisterAll returns an error describing the
+// first such problem and registers none of routes. A pattern's location in
+// errors is its index in routes, unless it has one already, like the patterns
+// from [ParseLines]. The patterns themselves are not modified.
+func (mux *ServeMux) RegisterAll(routes []Route) error {
+	rs := make([]Route, len(routes))
+	for i, r := range routes {
+		if r.Pattern == nil {
+			return fmt.Errorf("routes[%d]: nil pattern", i)
+		}
+		if r.Handler == nil {
+			return fmt.Errorf("routes[%d] %q: nil handler", i, r.Pattern)
+		}
+		p := *r.Pattern
+		if p.loc == "" {
+			p.loc = fmt.Sprintf("routes[%d]", i)
+		}
+		rs[i] = Route{&p, r.Handler}
+	}
+	return mux.registerRoutes(rs)
+}
+
+// registerRoutes adds routes, whose patterns are parsed and owned by mux.
+// It builds a new tree with all of them before storing it, so if a route
+// can't be added, mux is unchanged.
+func (mux *ServeMux) registerRoutes(routes []Route) error {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if mux.MaxPatterns > 0 && mux.npatterns+len(routes) > mux.MaxPatterns {
+		// Report the first route that doesn't fit. None does if MaxPatterns
+		// was lowered below the number already registered.
+		i := mux.MaxPatterns - mux.npatterns
+		if i < 0 {
+			i = 0
+		}
+		r := routes[i]
+		return fmt.Errorf("pattern %q: %w (MaxPatterns is %d)", r.Pattern, ErrTooManyPatterns, mux.MaxPatterns)
+	}
+	tree := mux.tree.Load()
+	// The nodes of the new tree are changed in place as the routes are added
+	// to it, so that each is copied only once. The batch number is unique,
+	// because nregistered only grows.
+	batch := mux.nregistered + 1
+	// mux.index doesn't yet have the earlier routes, so index them apart.
+	var batchIndex *index
+	if len(routes) > 1 {
+		batchIndex = newIndexSize(len(routes))
+	}
+	keyed := make([]*Pattern, len(routes))
+	for i, r := range routes {
+		r.Pattern.seq = mux.nregistered + i + 1
+		r.Pattern.hits = new(atomic.Uint64)
+		pat := mux.keyed(r.Pattern)
+		keyed[i] = pat
+		if !mux.treeOpts.firstMatchWins {
+			if err := mux.checkConflicts(mux.index, pat); err != nil {
+				return err
+			}
+			if batchIndex != nil {
+				if err := mux.checkConflicts(batchIndex, pat); err != nil {
+					return err
+				}
+				for _, p := range pat.expand() {
+					batchIndex.addPattern(p)
+				}
+			}
+		}
+		if mux.StrictShadowing {
+			if err := checkShadowing(tree, pat); err != nil {
+				return err
+			}
+		}
+		if pat.pinned {
+			if err := pat.checkPinnable(); err != nil {
+				return err
+			}
+		}
+		for _, p := range pat.expand() {
+			var err error
+			if p.pinned {
+				tree, err = tree.addPinned(batch, p, r.Handler)
+			} else {
+				tree, err = tree.addPattern(batch, p, r.Handler)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, pat := range keyed {
+		for _, p := range pat.expand() {
+			mux.index.addPattern(p)
+		}
+	}
+	mux.nregistered += len(routes)
+	mux.npatterns += len(routes)
+	mux.tree.Store(tree)
+	return nil
+}
+
+// Reset removes all the patterns registered on mux, including their names
+// from HandleNamed, so that mux matches nothing, as if newly created.
+// The mux's options, middleware, and not-found handlers are kept.
+func (mux *ServeMux) Reset() {
 	mux.mu.Lock()
 	defer mux.mu.Unlock()
-	// Check for conflict.
-	npats := 0
-	if err := mux.index.possiblyConflictingPatterns(pat, func(pat2 *Pattern) error {
-		npats++
-		mux.conflictCalls.Add(1)
-		if pat.ConflictsWith(pat2) {
-			d := describeRel(pat, pat2)
-			return fmt.Errorf("pattern %q (registered at %s) conflicts with pattern %q (registered at %s):\n%s",
-				pat, pat.loc, pat2, pat2.loc, d)
+	mux.index = newIndexSize(mux.capacityHint)
+	mux.named = nil
+	mux.npatterns = 0
+	old := mux.tree.Load()
+	mux.tree.Store(&node{opts: &mux.treeOpts, chain: old.chain, notFound: old.notFound})
+}
+
+// FromServeMux returns a ServeMux with each of patterns registered, so that
+// the patterns of an existing net/http.ServeMux can be checked for conflicts
+// and analyzed. Every pattern is registered with a handler that replies with
+// 404. FromServeMux returns the first error from parsing or registering a
+// pattern. A pattern's location in errors is its index in patterns.
+//
+// The syntax is intended to be the same as net/http's, but FromServeMux will
+// reject or reinterpret some patterns that net/http accepts:
+//   - Only spaces separate a method from the path. "GET\t/a" is a pattern
+//     for the host "GET\t".
+//   - A pattern with a method other than CONNECT must have a clean path.
+//   - "https://" before the host restricts a pattern to secure requests,
+//     rather than being part of the host.
+func FromServeMux(patterns []string) (*ServeMux, error) {
+	mux := NewServeMux(WithCapacityHint(len(patterns)))
+	for i, s := range patterns {
+		pat, err := Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("patterns[%d] %q: %w", i, s, err)
 		}
+		pat.loc = fmt.Sprintf("patterns[%d]", i)
+		if err := mux.registerPattern(pat, http.NotFoundHandler()); err != nil {
+			return nil, err
+		}
+	}
+	return mux, nil
+}
+
+// CanRegister reports whether pat can be registered without conflicting with
+// the patterns already registered on mux. It returns the error that
+// registering pat would, but it does not change mux.
+func (mux *ServeMux) CanRegister(pat *Pattern) error {
+	if mux.treeOpts.firstMatchWins {
 		return nil
-	}); err != nil {
-		return err
 	}
-	mux.tree.addPattern(pat, handler)
-	mux.index.addPattern(pat)
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	return mux.checkConflicts(mux.index, mux.keyed(pat))
+}
+
+// checkShadowing returns an error if pat shadows a pattern in tree or is
+// shadowed by one. Unlike conflicts, shadowing is not limited to patterns
+// whose paths the index would find, so all the patterns are checked.
+func checkShadowing(tree *node, pat *Pattern) error {
+	for _, pat := range pat.expand() {
+		err := tree.walk(0, func(n *node, _ int) error {
+			p1, p2 := pat, n.pattern
+			if !p1.shadows(p2) {
+				p1, p2 = p2, p1
+				if !p1.shadows(p2) {
+					return nil
+				}
+			}
+			return fmt.Errorf("pattern %q (registered at %s) shadows pattern %q (registered at %s):\n%s takes precedence on every request that both match, though its path is more general",
+				p1, p1.location(), p2, p2.location(), p1)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyed returns the pattern to put in mux's tree for pat: a copy whose
+// literal segments are their keys in the tree, lowercased if mux matches
+// paths case-insensitively and in NFC if it normalizes Unicode. Like the
+// patterns from expand, the copy's source is pat, so pat keeps its own
+// segments for String, URL and Build. Without those options, keyed
+// returns pat.
+func (mux *ServeMux) keyed(pat *Pattern) *Pattern {
+	if !mux.treeOpts.caseInsensitive && !mux.treeOpts.normalizeUnicode {
+		return pat
+	}
+	q := *pat
+	q.orig = pat.source()
+	q.segments = make([]segment, len(pat.segments))
+	for i, s := range pat.segments {
+		if !s.wild {
+			s.s = mux.treeOpts.literalKey(s.s)
+		}
+		s.suffix = mux.treeOpts.literalKey(s.suffix)
+		q.segments[i] = s
+	}
+	return &q
+}
+
+// checkConflicts returns an error if pat conflicts with a pattern in idx,
+// such as mux.index, which holds the registered patterns.
+// The caller must hold mux.mu.
+func (mux *ServeMux) checkConflicts(idx *index, pat *Pattern) error {
+	// Indexed patterns are expanded, so only pat needs to be.
+	for _, pat := range pat.expand() {
+		err := idx.possiblyConflictingPatterns(pat, func(pat2 *Pattern) error {
+			mux.conflictCalls.Add(1)
+			return checkConflict(pat, pat2)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkConflict returns an error describing the conflict between pat and
+// pat2, or nil if they don't conflict.
+func checkConflict(pat, pat2 *Pattern) error {
+	for _, p1 := range pat.expand() {
+		for _, p2 := range pat2.expand() {
+			if p1.ConflictsWith(p2) {
+				d := describeRel(p1, p2)
+				if s := suggestFix(p1, p2); s != "" {
+					d += "\n" + s
+				}
+				return fmt.Errorf("pattern %q (registered at %s) conflicts with pattern %q (registered at %s):\n%s",
+					p1, p1.location(), p2, p2.location(), d)
+			}
+		}
+	}
 	return nil
 }
 
 func callerLocation() string {
-	_, file, line, ok := runtime.Caller(2) // caller's caller's caller
+	_, file, line, ok := runtime.Caller(3) // skip callerLocation, register and its exported caller
 	if !ok {
 		return "unknown location"
 	}
 	return fmt.Sprintf("%s:%d", file, line)
 }
 
+// Match returns the pattern that matches the given method, host and path,
+// along with the values of the pattern's wildcards, keyed by name.
+// The values are percent-decoded unless mux.RawBindings is set.
+// It returns nil if no pattern matches.
+// An empty method matches only patterns without a method.
+//
+// Unlike ServeHTTP, Match neither strips a port from host nor cleans path,
+// and it never redirects. The path must not have a query or fragment;
+// use [SplitPath] to remove them from a string like r.URL.RequestURI().
+// Unless mux has a segment delimiter, the path must also begin with a slash.
+// Match does not add one: a relative path like "users/1" matches no pattern,
+// and neither does the "*" of a server-wide OPTIONS request. The same holds
+// for the other Match methods.
+func (mux *ServeMux) Match(method, host, path string) (*Pattern, map[string]string) {
+	m, ok := mux.match(method, host, path, true)
+	if !ok {
+		return nil, nil
+	}
+	return m.Pattern, m.Values
+}
+
+// SplitPath returns the path of rawurl, which is a path optionally followed
+// by a query ("?...") and fragment ("#..."), without them.
+// The path is not otherwise changed.
+func SplitPath(rawurl string) string {
+	if i := strings.IndexAny(rawurl, "?#"); i >= 0 {
+		return rawurl[:i]
+	}
+	return rawurl
+}
+
+// A Span is the part of a path that a wildcard matched.
+// Start and End are byte offsets into the path, so the wildcard's value,
+// before percent-decoding, is path[Start:End].
+type Span struct {
+	Name       string
+	Start, End int
+}
+
+// MatchSpans is like Match, but instead of the values of the pattern's
+// wildcards it returns where they occur in path, in the order the wildcards
+// appear in the pattern. This can be used, for example, to highlight them
+// in a log.
+func (mux *ServeMux) MatchSpans(method, host, path string) (*Pattern, []Span) {
+	method = mux.normalizeMethod(method)
+	path = mux.slashPath(path)
+	if mux.tooManySegments(path) {
+		return nil, nil
+	}
+	bp := getMatches()
+	n, matches, path := mux.matchMerged(nil, mux.matchTree(host), false, method, host, path, *bp)
+	putMatches(bp, matches)
+	if n == nil {
+		return nil, nil
+	}
+	mux.count(n.pattern)
+	spans := n.pattern.spans(path)
+	if mux.delim != 0 {
+		// Account for the slash added by slashPath.
+		for i := range spans {
+			spans[i].Start--
+			spans[i].End--
+		}
+	}
+	return n.pattern.source(), spans
+}
+
+// spans returns the spans of p's wildcards in path, which p matches.
+// Each segment of p matches one segment of path, except for a final multi
+// wildcard, which matches the rest, or the rest before its literals.
+func (p *Pattern) spans(path string) []Span {
+	var spans []Span
+	off := 0 // offset of rest in path
+	rest := path
+	for _, seg := range p.segments {
+		if seg.multi {
+			if seg.s != "" {
+				end := len(path)
+				for range seg.suffixLits() {
+					end = strings.LastIndexByte(path[:end], '/')
+				}
+				// Skip the slash.
+				spans = append(spans, Span{Name: seg.s, Start: off + 1, End: end})
+			}
+			break
+		}
+		_, r := nextSegment(rest)
+		end := len(path) - len(r)
+		switch {
+		case seg.part > 0:
+			// Extend the span of the "{name:N}" wildcard.
+			spans[len(spans)-1].End = end
+		case seg.wild:
+			spans = append(spans, Span{Name: seg.s, Start: off + 1, End: end})
+		}
+		off, rest = end, r
+	}
+	return spans
+}
+
+// MatchContext is like Match, but stops and returns ctx.Err() if ctx is done
+// before matching finishes. Matching a long path against many wildcard
+// patterns can take many steps, and MatchContext bounds the time spent.
+func (mux *ServeMux) MatchContext(ctx context.Context, method, host, path string) (*Pattern, map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	method = mux.normalizeMethod(method)
+	path = mux.slashPath(path)
+	if mux.tooManySegments(path) {
+		return nil, nil, nil
+	}
+	cc := &cancelCheck{ctx: ctx}
+	bp := getMatches()
+	n, matches, _ := mux.matchMerged(cc, mux.matchTree(host), false, method, host, path, *bp)
+	var (
+		p      *Pattern
+		values map[string]string
+	)
+	if n != nil {
+		p = n.pattern.source()
+		values = n.pattern.bind(matches, mux.RawBindings)
+		mux.count(n.pattern)
+	}
+	putMatches(bp, matches)
+	if cc.err != nil {
+		return nil, nil, cc.err
+	}
+	return p, values, nil
+}
+
+// A Match is the result of matching a request against a ServeMux.
+type Match struct {
+	// Pattern is the pattern that matched.
+	Pattern *Pattern
+	// Values holds the values of the pattern's wildcards, keyed by name.
+	Values map[string]string
+	// Tail is the part of the path matched by a final multi wildcard or
+	// trailing slash, without a leading slash. It is empty if the pattern
+	// has neither, as when its multi wildcard is followed by literals.
+	Tail string
+}
+
+// Bindings returns the values of m's wildcards as name/value pairs, in the
+// order the wildcards appear in m.Pattern. Unlike ranging over m.Values,
+// the order is deterministic, so the values can be used as positional
+// arguments.
+func (m *Match) Bindings() []Binding {
+	var bs []Binding
+	for _, name := range m.Pattern.Wildcards() {
+		bs = append(bs, Binding{name, m.Values[name]})
+	}
+	if name := m.Pattern.omitted; name != "" {
+		bs = append(bs, Binding{name, m.Pattern.omittedValue})
+	}
+	return bs
+}
+
+// MatchResult is like Match, but returns the result as a Match.
+// It returns nil if no pattern matches.
+func (mux *ServeMux) MatchResult(method, host, path string) *Match {
+	m, ok := mux.match(method, host, path, true)
+	if !ok {
+		return nil
+	}
+	return &m
+}
+
+// match is the common part of Match and MatchResult. It counts the match
+// for Counts only if count is true.
+func (mux *ServeMux) match(method, host, path string, count bool) (Match, bool) {
+	method = mux.normalizeMethod(method)
+	path = mux.slashPath(path)
+	if mux.tooManySegments(path) {
+		return Match{}, false
+	}
+	bp := getMatches()
+	n, matches, path := mux.matchMerged(nil, mux.matchTree(host), false, method, host, path, *bp)
+	var m Match
+	if n != nil {
+		if count {
+			mux.count(n.pattern)
+		}
+		m = Match{Pattern: n.pattern.source(), Values: n.pattern.bind(matches, mux.RawBindings)}
+		m.Tail = mux.tail(n.pattern, path)
+	}
+	putMatches(bp, matches)
+	return m, n != nil
+}
+
+// tail returns the Tail of a Match of p to path.
+func (mux *ServeMux) tail(p *Pattern, path string) string {
+	segs := p.segments
+	if last := segs[len(segs)-1]; !last.multi || last.suffix != "" {
+		return ""
+	}
+	// Skip the path segments matched by the rest of the pattern.
+	for range segs[:len(segs)-1] {
+		_, path = nextSegment(path)
+	}
+	t := strings.TrimPrefix(path, "/")
+	if !mux.RawBindings {
+		t = matchValue(t)
+	}
+	if mux.delim != 0 {
+		t = swapDelim(t, mux.delim)
+	}
+	return t
+}
+
+// MatchStatic is like Match, but returns only the pattern and the Tail that
+// Match would return, without binding the pattern's wildcards. It is meant
+// for routes like "/static/{path...}" that serve a large tree of files,
+// where building a map for each request to hold one value is wasted work.
+// Unless the tail must be percent-decoded, MatchStatic does not allocate.
+func (mux *ServeMux) MatchStatic(method, host, path string) (*Pattern, string) {
+	method = mux.normalizeMethod(method)
+	path = mux.slashPath(path)
+	if mux.tooManySegments(path) {
+		return nil, ""
+	}
+	bp := getMatches()
+	n, matches, path := mux.matchMerged(nil, mux.matchTree(host), false, method, host, path, *bp)
+	putMatches(bp, matches)
+	if n == nil {
+		return nil, ""
+	}
+	mux.count(n.pattern)
+	return n.pattern.source(), mux.tail(n.pattern, path)
+}
+
+// MatchInto is like Match, but instead of building a map, it appends the
+// wildcard values to buf[:0] and returns the resulting slice. The values are
+// in the order the wildcards appear in the pattern, with one for each part of
+// a "{name:N}" wildcard and for each occurrence of a repeated name; use
+// [Pattern.BindSlice] to pair them with names. Unlike the values returned by
+// Match, they are exactly as they appear in path, without percent-decoding.
+//
+// If buf is large enough, MatchInto does not allocate. The returned slice
+// shares buf's storage when it can, so its values are only valid until buf is
+// next modified or passed to MatchInto.
+func (mux *ServeMux) MatchInto(method, host, path string, buf []string) (*Pattern, []string) {
+	method = mux.normalizeMethod(method)
+	path = mux.slashPath(path)
+	if mux.tooManySegments(path) {
+		return nil, nil
+	}
+	n, matches, _ := mux.matchMerged(nil, mux.matchTree(host), false, method, host, path, buf)
+	if n == nil {
+		return nil, nil
+	}
+	mux.count(n.pattern)
+	if mux.delim != 0 {
+		for i, m := range matches {
+			matches[i] = swapDelim(m, mux.delim)
+		}
+	}
+	return n.pattern.source(), matches
+}
+
+// Matches reports whether any pattern matches the given method, host and
+// path, as Match would. It is cheaper than Match because it does not
+// bind wildcard values.
+func (mux *ServeMux) Matches(method, host, path string) bool {
+	method = mux.normalizeMethod(method)
+	path = mux.slashPath(path)
+	if mux.tooManySegments(path) {
+		return false
+	}
+	bp := getMatches()
+	n, matches, _ := mux.matchMerged(nil, mux.matchTree(host), false, method, host, path, *bp)
+	putMatches(bp, matches)
+	if n == nil {
+		return false
+	}
+	mux.count(n.pattern)
+	return true
+}
+
+// LongestPrefixMatch returns the pattern that matches the longest prefix of
+// path, made of whole segments, with and without a trailing slash, with the
+// given method and host. Unlike Match, it returns a pattern even if none
+// matches all of path: given "/a/b/c", it returns "/a/b/c" if that is
+// registered, and otherwise the pattern that matches "/a/b/", then "/a/b",
+// and so on, like "/a/" or "/a/{x...}". There is no trailing-slash redirect.
+// It returns nil if no pattern matches even "/". The pattern's count for
+// [ServeMux.Counts] is not changed.
+func (mux *ServeMux) LongestPrefixMatch(method, host, path string) *Pattern {
+	method = mux.normalizeMethod(method)
+	path = mux.slashPath(path)
+	if mux.tooManySegments(path) {
+		return nil
+	}
+	tree := mux.matchTree(host)
+	bp := getMatches()
+	buf := *bp
+	defer func() { putMatches(bp, buf) }()
+	for {
+		n, matches, _ := mux.matchMerged(nil, tree, false, method, host, path, buf[:0])
+		if cap(matches) > cap(buf) {
+			buf = matches
+		}
+		if n != nil {
+			return n.pattern.source()
+		}
+		switch {
+		case path == "/" || path == "":
+			return nil
+		case strings.HasSuffix(path, "/"):
+			path = path[:len(path)-1]
+		default:
+			path = path[:strings.LastIndexByte(path, '/')+1]
+		}
+	}
+}
+
+// Walk calls f for each registered pattern, along with the depth of the
+// pattern's node in the mux's routing tree. The first two levels of the tree
+// are the host and method, so the pattern "GET /a" has depth 3. The order of
+// the calls is deterministic. A pattern with several methods is visited once
+// for each method, and one ending in an optional wildcard or "/?" is visited
+// once for each of its two forms, at the depths of their nodes.
+//
+// If f returns an error, Walk stops and returns it.
+// Walk visits the patterns registered when it was called; f may register
+// more, but Walk will not see them.
+func (mux *ServeMux) Walk(f func(pattern *Pattern, depth int) error) error {
+	return mux.tree.Load().walk(0, func(n *node, depth int) error {
+		if err := f(n.pattern.source(), depth); err != nil {
+			return err
+		}
+		// Visit the constrained patterns that aren't n.pattern.
+		for _, v := range n.variants {
+			if v.pattern != n.pattern {
+				if err := f(v.pattern.source(), depth); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// EnableCounters makes mux count how many times each pattern matches,
+// for [ServeMux.Counts]. Every successful match counts, whether by
+// ServeHTTP, Handler, or Match and its variants, except for Explain and
+// LongestPrefixMatch, which only inspect the routes. Counting is off by
+// default, because it adds an atomic increment to each match.
+func (mux *ServeMux) EnableCounters() {
+	mux.counting.Store(true)
+}
+
+// count records a match of p, if counting is enabled.
+func (mux *ServeMux) count(p *Pattern) {
+	if mux.counting.Load() {
+		p.hits.Add(1)
+	}
+}
+
+// Counts returns the number of matches of each registered pattern since
+// EnableCounters was called, keyed by the patterns that Match returns.
+// Counts is nil if counting is not enabled.
+func (mux *ServeMux) Counts() map[*Pattern]uint64 {
+	if !mux.counting.Load() {
+		return nil
+	}
+	counts := map[*Pattern]uint64{}
+	mux.tree.Load().walk(0, func(n *node, _ int) error {
+		counts[n.pattern.source()] = n.pattern.hits.Load()
+		for _, v := range n.variants {
+			counts[v.pattern.source()] = v.pattern.hits.Load()
+		}
+		return nil
+	})
+	return counts
+}
+
+// Compile rebuilds mux's routing tree so that its nodes are stored
+// contiguously, which makes matching faster by improving locality.
+// Matching gives the same results before and after. Patterns can still be
+// registered, but their nodes are allocated separately, so call Compile
+// after registering all the patterns.
+func (mux *ServeMux) Compile() {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.tree.Store(mux.tree.Load().compile())
+}
+
+// TreeStats describes the routing tree of a ServeMux.
+// The first level of the tree below the root is for hosts, the second
+// for methods, and the rest for path segments.
+type TreeStats struct {
+	MaxDepth   int // depth of the deepest node; the root is at depth 0
+	Nodes      int // number of nodes, including the root
+	Leaves     int // number of nodes with no children
+	SliceNodes int // number of nodes whose children are in a slice
+	MapNodes   int // number of nodes whose children are in a map
+}
+
+// Stats returns statistics about mux's routing tree, which may help in
+// choosing a value for [WithMaxSlice]. A node's wildcard child is stored
+// separately, so a node whose only child is a wildcard is counted in
+// neither SliceNodes nor MapNodes.
+func (mux *ServeMux) Stats() TreeStats {
+	var s TreeStats
+	mux.tree.Load().stats(0, &s)
+	return s
+}
+
+// AsHandler returns mux as a plain http.Handler, for code that should
+// dispatch requests but not register patterns.
+func (mux *ServeMux) AsHandler() http.Handler {
+	return http.HandlerFunc(mux.ServeHTTP)
+}
+
+// AllWildcardNames returns the sorted names of the wildcards of all the
+// registered patterns, without duplicates.
+func (mux *ServeMux) AllWildcardNames() []string {
+	set := map[string]bool{}
+	mux.Walk(func(p *Pattern, _ int) error {
+		for _, name := range p.Wildcards() {
+			set[name] = true
+		}
+		return nil
+	})
+	names := maps.Keys(set)
+	sort.Strings(names)
+	return names
+}
+
+// OpenAPIPaths returns the registered patterns grouped by their
+// [Pattern.OpenAPIPath]. Each path maps to the sorted methods of its patterns.
+// A pattern that matches any method contributes "*". Patterns that differ
+// only in host share a path.
+func (mux *ServeMux) OpenAPIPaths() map[string][]string {
+	sets := map[string]map[string]bool{}
+	mux.Walk(func(p *Pattern, _ int) error {
+		for _, q := range p.expand() {
+			path := q.OpenAPIPath()
+			if sets[path] == nil {
+				sets[path] = map[string]bool{}
+			}
+			if len(q.methods) == 0 {
+				sets[path]["*"] = true
+			}
+			for _, m := range q.methods {
+				sets[path][m] = true
+			}
+		}
+		return nil
+	})
+	paths := map[string][]string{}
+	for path, set := range sets {
+		methods := maps.Keys(set)
+		sort.Strings(methods)
+		paths[path] = methods
+	}
+	return paths
+}
+
+// String returns a listing of mux's patterns, one per line, each followed by
+// the location where it was registered. A pattern is listed before the
+// patterns that it takes precedence over; otherwise the order is arbitrary
+// but fixed.
+func (mux *ServeMux) String() string {
+	var pats []*Pattern
+	seen := map[string]bool{}
+	mux.Walk(func(p *Pattern, _ int) error {
+		// A pattern appears more than once in the tree if it has several
+		// methods or ends in an optional wildcard.
+		if k := p.str + "\x00" + p.loc; !seen[k] {
+			seen[k] = true
+			pats = append(pats, p)
+		}
+		return nil
+	})
+	sort.Slice(pats, func(i, j int) bool { return pats[i].Precedes(pats[j]) })
+	var b strings.Builder
+	for _, p := range pats {
+		fmt.Fprintf(&b, "%s  (%s)\n", p, p.location())
+	}
+	return b.String()
+}
+
+// Explain describes how mux routes a request with the given method, host and
+// path, for use in tests and when debugging. If a pattern matches, it gives
+// the pattern, where it was registered, and the values of its wildcards.
+// Otherwise it lists the nearest candidates, in order of precedence, and why
+// each failed: patterns that would match but for the method, host or scheme,
+// and those that match the longest prefix of path. The text is meant for
+// people; its form may change.
+func (mux *ServeMux) Explain(method, host, path string) string {
+	var b strings.Builder
+	req := strings.TrimSpace(method + " " + host + path)
+	if m, ok := mux.match(method, host, path, false); ok {
+		fmt.Fprintf(&b, "%s matches %s (%s)\n", req, m.Pattern, m.Pattern.location())
+		for _, bd := range m.Bindings() {
+			fmt.Fprintf(&b, "\t%s = %q\n", bd.Name, bd.Value)
+		}
+		return b.String()
+	}
+	fmt.Fprintf(&b, "%s matches no pattern\n", req)
+	method = mux.normalizeMethod(method)
+	var pats []*Pattern
+	mux.Walk(func(p *Pattern, _ int) error {
+		pats = append(pats, p)
+		return nil
+	})
+	sort.SliceStable(pats, func(i, j int) bool { return pats[i].Precedes(pats[j]) })
+	sep := byte('/')
+	if mux.delim != 0 {
+		sep = mux.delim
+	}
+	prefixes := pathPrefixes(path, sep)
+	var misses, partial []string
+	best := len(prefixes) // index of the longest prefix that a pattern matches
+	for _, p := range pats {
+		desc := fmt.Sprintf("\t%s (%s): ", p, p.location())
+		if why := p.missReason(method, host, path); why != "" {
+			misses = append(misses, desc+why+"\n")
+			continue
+		}
+		for i := 0; i < len(prefixes) && i <= best; i++ {
+			if _, ok := p.MatchPath(method, host, prefixes[i]); ok {
+				if i < best {
+					best, partial = i, nil
+				}
+				partial = append(partial, fmt.Sprintf("%smatches only the prefix %q\n", desc, prefixes[i]))
+				break
+			}
+		}
+	}
+	// A pattern appears more than once in the tree if it has several
+	// methods or ends in an optional wildcard.
+	seen := map[string]bool{}
+	for _, l := range append(misses, partial...) {
+		if !seen[l] {
+			seen[l] = true
+			b.WriteString(l)
+		}
+	}
+	return b.String()
+}
+
+// missReason returns why p, which doesn't match a request with the given
+// method, host and path, would match it but for its method, host or scheme,
+// or "" if p doesn't match path at all.
+func (p *Pattern) missReason(method, host, path string) string {
+	m := method
+	if _, ok := p.MatchPath(m, host, path); !ok && len(p.methods) > 0 {
+		m = p.methods[0]
+	}
+	h := host
+	if _, ok := p.MatchPath(m, h, path); !ok && p.host != "" {
+		switch {
+		case p.prefix.IsValid():
+			h = p.prefix.Addr().String()
+		case isWildcardHost(p.host):
+			h = "x" + p.host[1:]
+		default:
+			h = p.host
+		}
+	}
+	if _, ok := p.MatchPath(m, h, path); !ok {
+		return ""
+	}
+	var whys []string
+	if m != method {
+		whys = append(whys, fmt.Sprintf("method %s is not %s", displayMethod(method), strings.Join(p.methods, " or ")))
+	}
+	if h != host {
+		whys = append(whys, fmt.Sprintf("host %q is not %s", host, p.host))
+	}
+	if len(whys) == 0 && p.scheme != "" {
+		whys = append(whys, "only secure requests match")
+	}
+	if len(whys) == 0 {
+		return "matches the path, but is not chosen"
+	}
+	return "matches the path, but " + strings.Join(whys, " and ")
+}
+
+// displayMethod returns method, or "(none)" if it is empty.
+func displayMethod(method string) string {
+	if method == "" {
+		return "(none)"
+	}
+	return method
+}
+
+// pathPrefixes returns the proper prefixes of path made of whole segments
+// separated by sep, longest first, with and without a final sep. For '/',
+// the last is "/".
+func pathPrefixes(path string, sep byte) []string {
+	var ps []string
+	for path != "" && path != "/" {
+		if path[len(path)-1] == sep {
+			path = path[:len(path)-1]
+		} else {
+			path = path[:strings.LastIndexByte(path, sep)+1]
+		}
+		if path != "" {
+			ps = append(ps, path)
+		}
+	}
+	return ps
+}
+
+// Diff compares the patterns registered on oldMux and newMux. It returns
+// the patterns of newMux that oldMux lacks, and those of oldMux that newMux
+// lacks, each sorted by canonical form. Patterns are the same if they have
+// the same [Pattern.Canonical] form, media type and headers, so renaming a
+// wildcard is not a change, and neither their handlers nor where they were
+// registered matter.
+func Diff(oldMux, newMux *ServeMux) (added, removed []*Pattern) {
+	oldPats := oldMux.canonicalPatterns()
+	newPats := newMux.canonicalPatterns()
+	for k, p := range newPats {
+		if _, ok := oldPats[k]; !ok {
+			added = append(added, p)
+		}
+	}
+	for k, p := range oldPats {
+		if _, ok := newPats[k]; !ok {
+			removed = append(removed, p)
+		}
+	}
+	byCanonical := func(ps []*Pattern) {
+		sort.Slice(ps, func(i, j int) bool { return diffKey(ps[i]) < diffKey(ps[j]) })
+	}
+	byCanonical(added)
+	byCanonical(removed)
+	return added, removed
+}
+
+// canonicalPatterns returns mux's patterns keyed by diffKey.
+func (mux *ServeMux) canonicalPatterns() map[string]*Pattern {
+	pats := map[string]*Pattern{}
+	mux.Walk(func(p *Pattern, _ int) error {
+		if k := diffKey(p); pats[k] == nil {
+			pats[k] = p
+		}
+		return nil
+	})
+	return pats
+}
+
+// diffKey returns the key that identifies p for Diff.
+func diffKey(p *Pattern) string {
+	var b strings.Builder
+	b.WriteString(p.Canonical())
+	if p.mediaType != "" {
+		b.WriteString(" ;type=")
+		b.WriteString(p.mediaType)
+	}
+	for _, h := range p.headers {
+		fmt.Fprintf(&b, " ;%s=%s", h.key, h.value)
+	}
+	return b.String()
+}
+
 func (mux *ServeMux) Handler(r *http.Request) (h http.Handler, pattern string) {
-	h, _, sp, _ := mux.handler(r)
+	h, _, sp, _ := mux.handler(mux.tree.Load(), r)
 	return h, sp
 }
 
+// matchKey is the context key under which ServeHTTP stores the *match for
+// a request. It is unexported so that only this package can set the value;
+// other code reads it with PathValue or BindingsFromContext.
 type matchKey struct{}
 
+// ServeHTTP dispatches the request to the handler whose pattern most closely
+// matches it.
+//
+// Matching uses r.URL.EscapedPath, not r.URL.Path. Path is already decoded,
+// so in it an encoded slash, "%2F", is indistinguishable from a segment
+// separator. EscapedPath is r.URL.RawPath when that is a valid encoding of
+// Path, so "/a%2Fb/c" has two segments and matches "/{x}/c". Wildcard values
+// are decoded only when they are bound, unless mux.RawBindings is set.
 func (mux *ServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// This if statement copied from net/http/server.go.
-	if r.RequestURI == "*" {
+	// This if statement adapted from net/http/server.go.
+	if r.RequestURI == "*" && mux.normalizeMethod(r.Method) != "OPTIONS" {
 		if r.ProtoAtLeast(1, 1) {
 			w.Header().Set("Connection", "close")
 		}
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	h, pat, _, matches := mux.handler(r)
-	var m match
-	if pat != nil && matches != nil {
-		m = match{pat: pat, values: matches}
+	root := mux.tree.Load()
+	h, pat, _, matches := mux.handler(root, r)
+	m := match{handler: h}
+	if pat != nil {
+		m.pat, m.values = pat, matches
 	}
 	r = r.WithContext(context.WithValue(r.Context(), matchKey{}, &m))
-	h.ServeHTTP(w, r)
+	if root.chain == nil {
+		h.ServeHTTP(w, r)
+		return
+	}
+	root.chain.ServeHTTP(w, r)
 }
 
-func (mux *ServeMux) handler(r *http.Request) (h http.Handler, pattern *Pattern, spat string, matches []string) {
+// handler returns the handler for r in the tree rooted at root, along with
+// the pattern that matched, its string and the wildcard values.
+func (mux *ServeMux) handler(root *node, r *http.Request) (h http.Handler, pattern *Pattern, spat string, matches []string) {
 	var (
 		n        *node
 		u        *url.URL
 		redirect bool
 		host     string
 		path     string
+		tree     *node // the tree for host, for both the match and any Allow header
 	)
+	method := mux.normalizeMethod(r.Method)
+	if r.RequestURI == "*" && method == "OPTIONS" {
+		if mux.OptionsStar != nil {
+			return mux.OptionsStar, nil, "*", nil
+		}
+		return http.HandlerFunc(mux.serveOptionsStar), nil, "*", nil
+	}
 	host = r.URL.Host
+	secure := r.TLS != nil || r.URL.Scheme == "https"
 	escapedPath := r.URL.EscapedPath()
 	path = escapedPath
+	if mux.tooManySegments(path) {
+		return http.HandlerFunc(uriTooLong), nil, "", nil
+	}
 	// CONNECT requests are not canonicalized.
-	if r.Method == "CONNECT" {
+	if method == "CONNECT" {
 		// If r.URL.Path is /tree and its handler is not registered,
 		// the /tree -> /tree/ redirect applies to CONNECT requests
 		// but the path canonicalization does not.
-		_, _, u, redirect = mux.matchOrRedirect(r.Method, host, path, r.URL)
+		_, _, u, redirect = mux.matchOrRedirect(mux.restrictTree(root, host), secure, method, host, path, r.URL)
 		if redirect {
 			return http.RedirectHandler(u.String(), http.StatusMovedPermanently), nil, u.Path, nil
 		}
-		// Redo the match, this time with r.Host instead of r.URL.Host.
-		// Pass a nil URL to skip the trailing-slash redirect logic.
-		n, matches, _, _ = mux.matchOrRedirect(r.Method, r.Host, path, nil)
+		// Redo the match in the same tree, this time with r.Host instead of
+		// r.URL.Host. Pass a nil URL to skip the trailing-slash redirect logic.
+		host = r.Host
+		tree = mux.restrictTree(root, host)
+		n, matches, _, _ = mux.matchOrRedirect(tree, secure, method, host, path, nil)
 	} else {
 		// All other requests have any port stripped and path cleaned
 		// before passing to mux.handler.
@@ -152,7 +1639,8 @@ func (mux *ServeMux) handler(r *http.Request) (h http.Handler, pattern *Pattern,
 
 		// If the given path is /tree and its handler is not registered,
 		// redirect for /tree/.
-		n, matches, u, redirect = mux.matchOrRedirect(r.Method, host, path, r.URL)
+		tree = mux.restrictTree(root, host)
+		n, matches, u, redirect = mux.matchOrRedirect(tree, secure, method, host, path, r.URL)
 		if redirect {
 			return http.RedirectHandler(u.String(), http.StatusMovedPermanently), nil, u.Path, nil
 		}
@@ -166,20 +1654,151 @@ func (mux *ServeMux) handler(r *http.Request) (h http.Handler, pattern *Pattern,
 			return http.RedirectHandler(u.String(), http.StatusMovedPermanently), nil, pattern, nil
 		}
 	}
-	if n == nil {
+	var unacceptable, headersUnmet bool
+	if n != nil {
+		pattern, h, unacceptable = n.choose(r.Header)
+		if pattern == nil {
+			// Fall back to the patterns of lower precedence that match.
+			if p, fh, m := mux.chooseFallback(tree, n, secure, method, host, path, r.Header); p != nil {
+				pattern, h, matches = p, fh, m
+			}
+		}
+		headersUnmet = pattern == nil && !unacceptable
+	}
+	if n == nil || headersUnmet {
 		// We didn't find a match with the request method. To distinguish between
 		// Not Found and Method Not Allowed, see if there is another pattern that
-		// matches except for the method.
-		allowedMethods := mux.matchingMethods(host, path)
-		if len(allowedMethods) > 0 {
+		// matches except for the method. If the request matched but for its
+		// headers, the method is not to blame. The host and path are those
+		// just matched, as AllowedMethods would compute them.
+		var allow string
+		if !headersUnmet {
+			allow = strings.Join(mux.matchingMethods(tree, secure, host, path), ", ")
+		}
+		if allow != "" {
+			mna := mux.MethodNotAllowed
+			if mna == nil {
+				mna = http.HandlerFunc(methodNotAllowed)
+			}
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
-				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				w.Header().Set("Allow", allow)
+				mna.ServeHTTP(w, r)
 			}), nil, "", nil
 		}
+		if nf := root.notFound[host]; nf != nil {
+			return nf, nil, "", nil
+		}
+		if mux.NotFound != nil {
+			return mux.NotFound, nil, "", nil
+		}
 		return http.NotFoundHandler(), nil, "", nil
 	}
-	return n.handler, n.pattern, n.pattern.String(), matches
+	if pattern == nil {
+		return http.HandlerFunc(notAcceptable), nil, "", nil
+	}
+	mux.count(pattern)
+	return h, pattern, pattern.String(), matches
+}
+
+// slashPath returns path in the form the routing tree uses: if mux has a
+// segment delimiter, path has it exchanged with '/' and a '/' prepended.
+func (mux *ServeMux) slashPath(path string) string {
+	if mux.delim == 0 {
+		return path
+	}
+	return "/" + swapDelim(path, mux.delim)
+}
+
+// parse parses a pattern, using mux's segment delimiter if it has one.
+func (mux *ServeMux) parse(s string) (*Pattern, error) {
+	if mux.delim == 0 {
+		return parse(s, mux.repeats)
+	}
+	return parseWithDelimiter(s, mux.delim, mux.repeats)
+}
+
+// normalizeMethod returns method in upper case if mux.NormalizeMethod is set,
+// and otherwise unchanged.
+func (mux *ServeMux) normalizeMethod(method string) string {
+	if mux.NormalizeMethod {
+		return strings.ToUpper(method)
+	}
+	return method
+}
+
+// tooManySegments reports whether path has more than mux.MaxSegments segments.
+func (mux *ServeMux) tooManySegments(path string) bool {
+	return mux.MaxSegments > 0 && strings.Count(path, "/") > mux.MaxSegments
+}
+
+func uriTooLong(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+func notAcceptable(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+}
+
+// An acceptRange is one media range of an Accept header, like "text/*;q=0.5".
+type acceptRange struct {
+	typ, subtype string // lower case; either may be "*"
+	q            float64
+}
+
+// parseAccept parses an Accept header. Malformed ranges are ignored.
+// An empty header accepts anything.
+func parseAccept(s string) []acceptRange {
+	if strings.TrimSpace(s) == "" {
+		return []acceptRange{{"*", "*", 1}}
+	}
+	var rs []acceptRange
+	for _, part := range strings.Split(s, ",") {
+		mr, params, _ := strings.Cut(part, ";")
+		typ, sub, ok := strings.Cut(strings.ToLower(strings.TrimSpace(mr)), "/")
+		if !ok || typ == "" || sub == "" || (typ == "*" && sub != "*") {
+			continue
+		}
+		r := acceptRange{typ, sub, 1}
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				q, err := strconv.ParseFloat(v, 64)
+				if err != nil || q < 0 || q > 1 {
+					q = 1
+				}
+				r.q = q
+			}
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// acceptQuality returns the quality that ranges give mediaType: that of the
+// most specific range that matches it, or 0 if none does.
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+	typ, sub, _ := strings.Cut(mediaType, "/")
+	q, spec := 0.0, -1
+	for _, r := range ranges {
+		s := 0
+		switch {
+		case r.typ == typ && r.subtype == sub:
+			s = 2
+		case r.typ == typ && r.subtype == "*":
+			s = 1
+		case r.typ == "*":
+		default:
+			continue
+		}
+		if s > spec {
+			q, spec = r.q, s
+		}
+	}
+	return q
 }
 
 func mightNeedCleaning(p string) bool {
@@ -234,22 +1853,135 @@ func stripHostPort(h string) string {
 	return host
 }
 
-func (mux *ServeMux) matchOrRedirect(method, host, path string, u *url.URL) (*node, []string, *url.URL, bool) {
-	// Hold the read lock for the entire method so that the two matches are done
-	// on the same set of registered patterns.
-	mux.mu.RLock()
-	defer mux.mu.RUnlock()
-	n, matches := mux.tree.match(method, host, path)
+func (mux *ServeMux) matchOrRedirect(tree *node, secure bool, method, host, path string, u *url.URL) (*node, []string, *url.URL, bool) {
+	bp := getMatches()
+	n, matches, _ := mux.matchMerged(nil, tree, secure, method, host, path, *bp)
+	// Copy the values out of the pooled slice, which is reused below.
+	vals := mux.bindValues(matches)
 	// If we have an exact match, then don't redirect.
-	if !exactMatch(n, path) && u != nil {
+	if !exactMatch(n, path) && u != nil && !mux.MergeTrailingSlash {
 		// If there is an exact match with a trailing slash, then redirect.
 		path += "/"
-		n2, _ := mux.tree.match(method, host, path)
+		n2, m2 := tree.matchSchemeInto(nil, secure, method, host, path, matches[:0])
+		if cap(m2) > cap(matches) {
+			matches = m2
+		}
 		if exactMatch(n2, path) {
+			putMatches(bp, matches)
 			return nil, nil, &url.URL{Path: path, RawQuery: u.RawQuery}, true
 		}
 	}
-	return n, matches, nil, false
+	putMatches(bp, matches)
+	return n, vals, nil, false
+}
+
+// bindValues returns a copy of the wildcard values in matches, decoded
+// unless mux.RawBindings is set, or nil if there are none.
+func (mux *ServeMux) bindValues(matches []string) []string {
+	if len(matches) == 0 {
+		return nil
+	}
+	vals := make([]string, len(matches))
+	for i, m := range matches {
+		if mux.RawBindings {
+			vals[i] = m
+		} else {
+			vals[i] = matchValue(m)
+		}
+	}
+	return vals
+}
+
+// chooseFallback is called when header rules out every pattern at n, the
+// leaf of tree that best matches the other arguments. It tries the other
+// leaves that match, from the highest precedence down, and returns the
+// pattern chosen at the first one where one is, along with its handler and
+// wildcard values. It returns a nil pattern if there is none.
+func (mux *ServeMux) chooseFallback(tree, n *node, secure bool, method, host, path string, header http.Header) (*Pattern, http.Handler, []string) {
+	type leaf struct {
+		n       *node
+		matches []string
+	}
+	var leaves []leaf
+	add := func(l *node, matches []string) {
+		if l != n {
+			leaves = append(leaves, leaf{l, append([]string(nil), matches...)})
+		}
+	}
+	paths := []string{path}
+	if mux.MergeTrailingSlash && path != "" && path != "/" {
+		paths = append(paths, toggleTrailingSlash(path))
+	}
+	for _, p := range paths {
+		if tree.pinned != nil {
+			tree.pinned.matchAll(nil, secure, method, host, p, add)
+		}
+		tree.matchAll(nil, secure, method, host, p, add)
+	}
+	firstMatchWins := tree.opts != nil && tree.opts.firstMatchWins
+	sort.Slice(leaves, func(i, j int) bool {
+		p1, p2 := leaves[i].n.pattern, leaves[j].n.pattern
+		if p1.pinned != p2.pinned {
+			return p1.pinned
+		}
+		if firstMatchWins {
+			return p1.seq < p2.seq
+		}
+		return p1.Precedes(p2)
+	})
+	for _, l := range leaves {
+		if p, h, _ := l.n.choose(header); p != nil {
+			return p, h, mux.bindValues(l.matches)
+		}
+	}
+	return nil, nil, nil
+}
+
+// matchTree returns the tree to match a request for host against: mux's
+// tree, or an empty one if mux.StrictHost is set and no pattern's host
+// contains host.
+func (mux *ServeMux) matchTree(host string) *node {
+	return mux.restrictTree(mux.tree.Load(), host)
+}
+
+// restrictTree returns tree, or an empty one if mux.StrictHost is set and no
+// pattern's host in tree contains host.
+func (mux *ServeMux) restrictTree(tree *node, host string) *node {
+	if mux.StrictHost && host != "" && !tree.hasHost(host) {
+		return emptyTree
+	}
+	return tree
+}
+
+// emptyTree is a tree with no patterns.
+var emptyTree = &node{}
+
+// matchMerged matches path in tree, as tree.matchSchemeInto does. If
+// mux.MergeTrailingSlash is set, it also matches path with its trailing slash
+// removed or added, and returns that match if it has higher precedence.
+// A pattern registered with HandleExact wins over any other.
+// It also returns the form of path that matched.
+func (mux *ServeMux) matchMerged(cc *cancelCheck, tree *node, secure bool, method, host, path string, buf []string) (*node, []string, string) {
+	n, matches := tree.matchSchemeInto(cc, secure, method, host, path, buf)
+	if !mux.MergeTrailingSlash || path == "" || path == "/" {
+		return n, matches, path
+	}
+	other := toggleTrailingSlash(path)
+	n2, matches2 := tree.matchSchemeInto(cc, secure, method, host, other, nil)
+	if n2 != nil && (n == nil || n2.pattern.pinned && !n.pattern.pinned ||
+		n2.pattern.pinned == n.pattern.pinned && n2.pattern.HigherPrecedence(n.pattern)) {
+		return n2, matches2, other
+	}
+	return n, matches, path
+}
+
+// toggleTrailingSlash returns path with its trailing slash removed, or with
+// one added if it has none.
+func toggleTrailingSlash(path string) string {
+	if strings.HasSuffix(path, "/") {
+		return path[:len(path)-1]
+	}
+	return path + "/"
 }
 
 // exactMatch reports whether the node's pattern exactly matches the path.
@@ -260,7 +1992,8 @@ func exactMatch(n *node, path string) bool {
 	if len(path) > 0 && path[len(path)-1] != '/' {
 		// If the path doesn't end in a trailing slash, then
 		// an exact match is one that doesn't end in a multi.
-		return !n.pattern.lastSegment().multi
+		last := n.pattern.lastSegment()
+		return !last.multi || last.suffix != ""
 	}
 	// Only patterns ending in {$} or a multi wildcard can
 	// match a path with a trailing slash.
@@ -270,16 +2003,39 @@ func exactMatch(n *node, path string) bool {
 	return len(n.pattern.segments) == strings.Count(path, "/")
 }
 
-// Return a sorted list of all methods that would match with the given host and path.
-func (mux *ServeMux) matchingMethods(host, path string) []string {
-	// Hold the read lock for the entire method so that the two matches are done
-	// on the same set of registered patterns.
-	mux.mu.RLock()
-	defer mux.mu.RUnlock()
+// AllowedMethods returns the sorted methods of the patterns that match r's
+// host and path, regardless of its method. It sees the host and path as
+// ServeHTTP does: unless r is a CONNECT request, the port is stripped from
+// r.Host and the path is cleaned. Patterns without a method match any
+// method, so they don't contribute to the result.
+func (mux *ServeMux) AllowedMethods(r *http.Request) []string {
+	secure := r.TLS != nil || r.URL.Scheme == "https"
+	host, path := r.Host, r.URL.EscapedPath()
+	if mux.normalizeMethod(r.Method) != "CONNECT" {
+		host = stripHostPort(host)
+		path = cleanPath(path)
+	}
+	return mux.matchingMethods(mux.matchTree(host), secure, host, path)
+}
+
+// serveOptionsStar replies to an "OPTIONS *" request with the methods of all
+// registered patterns.
+func (mux *ServeMux) serveOptionsStar(w http.ResponseWriter, r *http.Request) {
+	ms := map[string]bool{"OPTIONS": true}
+	mux.tree.Load().methods(ms)
+	methods := maps.Keys(ms)
+	sort.Strings(methods)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.Header().Set("Content-Length", "0")
+}
+
+// Return a sorted list of all methods that would match with the given host and path
+// in tree, which is mux.matchTree(host) or a snapshot of it.
+func (mux *ServeMux) matchingMethods(tree *node, secure bool, host, path string) []string {
 	ms := map[string]bool{}
-	mux.tree.matchingMethods(host, path, ms)
+	tree.matchingMethods(secure, host, path, ms)
 	// matchOrRedirect will try appending a trailing slash if there is no match.
-	mux.tree.matchingMethods(host, path+"/", ms)
+	tree.matchingMethods(secure, host, path+"/", ms)
 	methods := maps.Keys(ms)
 	sort.Strings(methods)
 	return methods
@@ -302,6 +2058,31 @@ func PathValue(r *http.Request, name string) string {
 	return m.get(name)
 }
 
+// BindingsFromContext returns the wildcard values of the pattern that
+// matched the request whose context is ctx, along with any values set by
+// SetPathValue. ctx must be the context of a request passed to a handler by
+// [ServeMux.ServeHTTP], or derived from it. The second result is false if
+// ctx has no values from a ServeMux, or if no pattern matched.
+//
+// The map is a copy; changing it does not affect PathValue.
+func BindingsFromContext(ctx context.Context) (map[string]string, bool) {
+	m, _ := ctx.Value(matchKey{}).(*match)
+	if m == nil || m.pat == nil {
+		return nil, false
+	}
+	b := map[string]string{}
+	for _, name := range m.pat.Wildcards() {
+		b[name] = m.get(name)
+	}
+	if m.pat.omitted != "" {
+		b[m.pat.omitted] = m.pat.omittedValue
+	}
+	for k, v := range m.other {
+		b[k] = v
+	}
+	return b, true
+}
+
 // SetPathValue calls the top-level SetPathValue function.
 // deprecated: use SetPathValue.
 func (mux *ServeMux) SetPathValue(r *http.Request, name, value string) {
@@ -317,23 +2098,32 @@ func SetPathValue(r *http.Request, name, value string) {
 }
 
 type match struct {
-	pat    *Pattern
-	values []string
-	other  map[string]string // for calls to SetPathValue that don't match a wildcard
+	pat     *Pattern
+	values  []string
+	handler http.Handler      // the handler ServeHTTP chose, for serveChosen
+	other   map[string]string // for calls to SetPathValue that don't match a wildcard
 }
 
 func (m *match) get(name string) string {
 	if m == nil {
 		return ""
 	}
-	if i := m.index(name); i >= 0 {
-		return m.values[i]
+	if v, ok := m.other[name]; ok {
+		return v
+	}
+	if i, n := m.index(name); i >= 0 {
+		return strings.Join(m.values[i:i+n], "/")
+	}
+	if m.pat != nil && name == m.pat.omitted {
+		return m.pat.omittedValue
 	}
-	return m.other[name]
+	return ""
 }
 
 func (m *match) set(name, value string) {
-	if i := m.index(name); i >= 0 {
+	// The value of a "{name:N}" wildcard is several values, so it goes in
+	// m.other instead.
+	if i, n := m.index(name); i >= 0 && n == 1 {
 		m.values[i] = value
 		return
 	}
@@ -343,18 +2133,23 @@ func (m *match) set(name, value string) {
 	m.other[name] = value
 }
 
-func (m *match) index(name string) int {
+// index returns the index in m.values of the first value for the wildcard
+// name, and the number of values it has.
+func (m *match) index(name string) (int, int) {
 	if m.pat == nil {
-		return -1
+		return -1, 0
 	}
 	i := 0
 	for _, seg := range m.pat.segments {
 		if seg.wild && seg.s != "" {
 			if name == seg.s {
-				return i
+				if seg.span > 0 {
+					return i, seg.span
+				}
+				return i, 1
 			}
 			i++
 		}
 	}
-	return -1
+	return -1, 0
 }
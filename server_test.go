@@ -6,14 +6,22 @@ package muxpatterns
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 type handler struct{ i int }
@@ -62,7 +70,7 @@ func TestServeMuxHandler(t *testing.T) {
 		r.Method = test.method
 		r.Host = "example.com"
 		r.URL = &url.URL{Path: test.path}
-		gotH, _, _, _ := mux.handler(&r)
+		gotH, _, _, _ := mux.handler(mux.tree.Load(), &r)
 		got := fmt.Sprintf("%#v", gotH)
 		if got != test.wantHandler {
 			t.Errorf("%s %q: got %q, want %q", test.method, test.path, got, test.wantHandler)
@@ -77,6 +85,539 @@ func TestServeMuxHandler(t *testing.T) {
 	}
 }
 
+// stdMux is the registration and dispatch API of net/http.ServeMux.
+type stdMux interface {
+	Handle(string, http.Handler)
+	HandleFunc(string, func(http.ResponseWriter, *http.Request))
+	Handler(*http.Request) (http.Handler, string)
+	ServeHTTP(http.ResponseWriter, *http.Request)
+}
+
+var (
+	_ stdMux = (*http.ServeMux)(nil)
+	_ stdMux = (*ServeMux)(nil)
+)
+
+func TestAsHandler(t *testing.T) {
+	var m stdMux = NewServeMux()
+	for _, p := range []string{"/", "/static/", "/api/users", "example.com/"} {
+		p := p
+		m.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, p)
+		})
+	}
+	h := m.(*ServeMux).AsHandler()
+	if _, ok := h.(*ServeMux); ok {
+		t.Error("AsHandler returned the mux itself")
+	}
+	for _, test := range []struct {
+		url  string
+		want string
+	}{
+		{"http://host/", "/"},
+		{"http://host/other", "/"},
+		{"http://host/static/css/main.css", "/static/"},
+		{"http://host/api/users", "/api/users"},
+		{"http://host/api/users/1", "/"},
+		{"http://example.com/api/users", "example.com/"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", test.url, nil))
+		if got := rec.Body.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.url, got, test.want)
+		}
+	}
+
+	// Like net/http.ServeMux, registering a conflicting pattern panics.
+	defer func() {
+		if recover() == nil {
+			t.Error("got no panic registering a duplicate pattern")
+		}
+	}()
+	m.Handle("/static/", http.NotFoundHandler())
+}
+
+func TestFromServeMux(t *testing.T) {
+	patterns := []string{
+		"/",
+		"/static/",
+		"GET /healthz",
+		"GET /api/v1/users",
+		"POST /api/v1/users",
+		"GET /api/v1/users/{id}",
+		"PUT /api/v1/users/{id}",
+		"DELETE /api/v1/users/{id}",
+		"GET /api/v1/users/{id}/posts/{post}",
+		"GET /api/v1/users/me",
+		"GET /files/{path...}",
+		"GET /blog/{$}",
+		"admin.example.com/",
+	}
+	mux, err := FromServeMux(patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := mux.Match("GET", "", "/api/v1/users/me"); p == nil || p.String() != "GET /api/v1/users/me" {
+		t.Errorf("got %v, want GET /api/v1/users/me", p)
+	}
+
+	for _, test := range []struct {
+		patterns []string
+		want     string // substring of error
+	}{
+		{
+			[]string{"/a", "GET /b/{x}", "GET /{y}/c"},
+			`pattern "GET /{y}/c" (registered at patterns[2]) conflicts with pattern "GET /b/{x}" (registered at patterns[1])`,
+		},
+		{
+			[]string{"/a", "GET /a/../b"},
+			`patterns[1] "GET /a/../b": at offset 5: non-CONNECT pattern with unclean path`,
+		},
+	} {
+		_, err := FromServeMux(test.patterns)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got error %v, want it to contain %q", test.patterns, err, test.want)
+		}
+	}
+}
+
+func TestOpenAPIPaths(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{
+		"GET /users",
+		"POST /users",
+		"GET,PUT /users/{id}",
+		"DELETE /users/{id}",
+		"/files/{path...}",
+		"example.com/files/{name...}",
+	} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	got := mux.OpenAPIPaths()
+	want := map[string][]string{
+		"/users":        {"GET", "POST"},
+		"/users/{id}":   {"DELETE", "GET", "PUT"},
+		"/files/{path}": {"*"},
+		"/files/{name}": {"*"},
+	}
+	if !maps.EqualFunc(got, want, slices.Equal[string]) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAllWildcardNames(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{
+		"GET /users/{id}",
+		"DELETE /users/{id}",
+		"/users/{id}/posts/{post}",
+		"/files/{path...}",
+		"/archive/{date:3}",
+		"/static/",
+		"/items/{id?}",
+	} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	mux.HandleMediaType("/docs/{page}", "application/json", http.NotFoundHandler())
+	mux.HandleMediaType("/docs/{name}", "text/html", http.NotFoundHandler())
+	got := mux.AllWildcardNames()
+	want := []string{"date", "id", "name", "page", "path", "post"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	makeMux := func(pats ...string) *ServeMux {
+		mux := NewServeMux()
+		for _, p := range pats {
+			mux.Handle(p, http.NotFoundHandler())
+		}
+		return mux
+	}
+	oldMux := makeMux("GET /users/{id}", "/static/", "POST /users", "/a/{x}/b")
+	newMux := makeMux("GET /users/{uid}", "/static/{rest...}", "PUT /users", "/a/{x}/c", "GET,POST /items")
+	newMux.HandleMediaType("/a/{x}/b", "application/json", http.NotFoundHandler())
+	strs := func(ps []*Pattern) []string {
+		var ss []string
+		for _, p := range ps {
+			ss = append(ss, p.String())
+		}
+		return ss
+	}
+	added, removed := Diff(oldMux, newMux)
+	wantAdded := []string{"/a/{x}/b", "/a/{x}/c", "GET,POST /items", "PUT /users"}
+	wantRemoved := []string{"/a/{x}/b", "POST /users"}
+	if got := strs(added); !slices.Equal(got, wantAdded) {
+		t.Errorf("added: got %q, want %q", got, wantAdded)
+	}
+	if got := strs(removed); !slices.Equal(got, wantRemoved) {
+		t.Errorf("removed: got %q, want %q", got, wantRemoved)
+	}
+	if added[0].MediaType() != "application/json" {
+		t.Errorf("added %q has media type %q, want application/json", added[0], added[0].MediaType())
+	}
+
+	added, removed = Diff(oldMux, oldMux)
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("Diff(oldMux, oldMux) = %v, %v, want nothing", added, removed)
+	}
+}
+
+func TestSecurePatterns(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"/login", "https:///login", "https:///account", "GET https://a.com/login"} {
+		p := p
+		mux.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, p)
+		})
+	}
+	for _, test := range []struct {
+		url  string
+		tls  bool
+		want string // pattern, or status code
+	}{
+		{"http://b.com/login", false, "/login"},
+		{"http://b.com/login", true, "https:///login"},
+		{"https://b.com/login", false, "https:///login"},
+		{"http://b.com/account", true, "https:///account"},
+		{"http://b.com/account", false, "404"},
+		{"http://a.com/login", true, "GET https://a.com/login"},
+		{"http://a.com/login", false, "/login"},
+	} {
+		req := httptest.NewRequest("GET", test.url, nil)
+		if !test.tls {
+			req.TLS = nil
+		} else if req.TLS == nil {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		got := rec.Body.String()
+		if rec.Code != 200 {
+			got = strconv.Itoa(rec.Code)
+		}
+		if got != test.want {
+			t.Errorf("%s, tls=%t: got %q, want %q", test.url, test.tls, got, test.want)
+		}
+	}
+}
+
+func TestOptionalWildcard(t *testing.T) {
+	mux := NewServeMux()
+	mux.EnableCounters()
+	pat, err := mux.HandlePattern("GET /items/{id?}", http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle("GET /items/new", http.NotFoundHandler())
+	for _, test := range []struct {
+		path string
+		want map[string]string
+	}{
+		{"/items", map[string]string{"id": ""}},
+		{"/items/42", map[string]string{"id": "42"}},
+		{"/items/new", nil},
+	} {
+		p, got := mux.Match("GET", "", test.path)
+		if p == nil {
+			t.Errorf("%s: no match", test.path)
+			continue
+		}
+		if !maps.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.path, got, test.want)
+		}
+	}
+	if p, _ := mux.Match("GET", "", "/items/42/x"); p != nil {
+		t.Errorf("/items/42/x: got match %s", p)
+	}
+	// Both forms of the pattern are reported as the registered pattern.
+	for _, path := range []string{"/items", "/items/42"} {
+		p, vals := mux.MatchInto("GET", "", path, nil)
+		if p != pat {
+			t.Errorf("%s: MatchInto returned a different pattern", path)
+		} else if bs := p.BindSlice(vals); len(bs) != 1 || bs[0].Name != "id" {
+			t.Errorf("%s: BindSlice: got %v", path, bs)
+		}
+		if m := mux.MatchResult("GET", "", path); m.Pattern != pat {
+			t.Errorf("%s: MatchResult returned a different pattern", path)
+		}
+	}
+	mux.Walk(func(p *Pattern, _ int) error {
+		if p.String() == pat.String() && p != pat {
+			t.Error("Walk visited a different pattern")
+		}
+		return nil
+	})
+	if got, want := mux.Counts()[pat], uint64(6); got != want {
+		t.Errorf("Counts: got %d, want %d", got, want)
+	}
+	// Each form of the pattern conflicts with patterns that the other
+	// doesn't.
+	for _, pat := range []string{"GET /items", "GET /items/{x}"} {
+		if err := mux.CanRegister(mustParse(t, pat)); err == nil {
+			t.Errorf("%s: got no conflict", pat)
+		}
+	}
+}
+
+func TestWildcardDefault(t *testing.T) {
+	mux := NewServeMux()
+	var got string
+	mux.HandleFunc("GET /list/{page=1}", func(w http.ResponseWriter, r *http.Request) {
+		got = PathValue(r, "page")
+	})
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		{"/list", "1"},
+		{"/list/3", "3"},
+	} {
+		p, m := mux.Match("GET", "", test.path)
+		if p == nil {
+			t.Errorf("%s: no match", test.path)
+			continue
+		}
+		if m["page"] != test.want {
+			t.Errorf("%s: Match: got %q, want %q", test.path, m["page"], test.want)
+		}
+		got = ""
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+		if got != test.want {
+			t.Errorf("%s: PathValue: got %q, want %q", test.path, got, test.want)
+		}
+	}
+	if m := mux.MatchResult("GET", "", "/list"); !slices.Equal(m.Bindings(), []Binding{{"page", "1"}}) {
+		t.Errorf("Bindings: got %v", m.Bindings())
+	}
+	// A default doesn't change which requests match, so the pattern
+	// conflicts with the same ones as "/list/{page?}".
+	if err := mux.CanRegister(mustParse(t, "GET /list/{n?}")); err == nil {
+		t.Error("GET /list/{n?}: got no conflict")
+	}
+}
+
+func TestOptionalSlash(t *testing.T) {
+	mux := NewServeMux()
+	// "/items/{x}" doesn't conflict with "/items/?", because a wildcard
+	// doesn't match the empty segment after "/items/".
+	for _, p := range []string{"GET /items/?", "/items/{x}", "/dir/"} {
+		p := p
+		mux.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, p)
+		})
+	}
+	for _, test := range []struct {
+		path string
+		want string // body, or Location header for a redirect
+	}{
+		{"/items", "GET /items/?"},
+		{"/items/", "GET /items/?"},
+		{"/items/4", "/items/{x}"},
+		{"/items/4/", "404 page not found\n"},
+		// "/dir/?" would not redirect "/dir", and "/dir/" does.
+		{"/dir", "redirect /dir/"},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		got := w.Body.String()
+		if w.Code == http.StatusMovedPermanently {
+			got = "redirect " + w.Header().Get("Location")
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.path, got, test.want)
+		}
+	}
+	// Each form of the pattern conflicts with patterns that the other
+	// doesn't.
+	for _, pat := range []string{"GET /items", "GET /items/{$}"} {
+		if err := mux.CanRegister(mustParse(t, pat)); err == nil {
+			t.Errorf("%s: got no conflict", pat)
+		}
+	}
+}
+
+func TestEscapedBraces(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"/files/{{name}}", "/files/{name}", "/a/{$}"} {
+		p := p
+		mux.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, p)
+		})
+	}
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		{"/files/{name}", "/files/{{name}}"},
+		{"/files/%7Bname%7D", "/files/{{name}}"},
+		{"/files/name", "/files/{name}"},
+		{"/files/{other}", "/files/{name}"},
+		{"/a/", "/a/{$}"},
+		{"/a/%2F", "404 page not found\n"},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if got := rec.Body.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.path, got, test.want)
+		}
+	}
+	if got, want := mustParse(t, "/files/{{name}}").debugString(), "/files/{{name}}"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHandleNotFound(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("a.com/x", http.NotFoundHandler())
+	mux.Handle("b.com/x", http.NotFoundHandler())
+	notFound := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, body)
+		})
+	}
+	mux.HandleNotFound("a.com", notFound("no such page on a"))
+	mux.HandleNotFound("b.com", notFound("no such page on b"))
+	mux.NotFound = notFound("default")
+	for _, test := range []struct {
+		url  string
+		want string
+	}{
+		{"http://a.com/y", "no such page on a"},
+		{"http://a.com:8080/y", "no such page on a"},
+		{"http://b.com/y", "no such page on b"},
+		{"http://c.com/y", "default"},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", test.url, nil))
+		if got := rec.Body.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.url, got, test.want)
+		}
+	}
+
+	// The handlers survive Reset, and a nil handler removes one.
+	mux.Reset()
+	mux.HandleNotFound("b.com", nil)
+	for _, test := range []struct {
+		url  string
+		want string
+	}{
+		{"http://a.com/x", "no such page on a"},
+		{"http://b.com/x", "default"},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", test.url, nil))
+		if got := rec.Body.String(); got != test.want {
+			t.Errorf("after Reset, %s: got %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestHandleAll(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleAll("/api/{path...}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "all")
+	}))
+	mux.HandleFunc("GET /api/users", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "users")
+	})
+	for _, test := range []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/api/x", "all"},
+		{"POST", "/api/x", "all"},
+		{"DELETE", "/api/x/y", "all"},
+		{"PATCH", "/api/users", "all"},
+		{"GET", "/api/users", "users"},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(test.method, test.path, nil))
+		if got := rec.Body.String(); got != test.want {
+			t.Errorf("%s %s: got %q, want %q", test.method, test.path, got, test.want)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("got no panic for a pattern with a method")
+		}
+	}()
+	mux.HandleAll("GET /other", http.NotFoundHandler())
+}
+
+func TestServeMuxString(t *testing.T) {
+	patterns := []string{
+		"/",
+		"/a/{x}",
+		"GET /a/{x}",
+		"HEAD /a/b",
+		"GET /a/b",
+		"/a/b/",
+		"example.com/a/{x}",
+		"GET,POST /c",
+		"https:///a/{x}",
+	}
+	want := []string{
+		"example.com/a/{x}",
+		"https:///a/{x}",
+		"GET,POST /c",
+		"HEAD /a/b",
+		"GET /a/b",
+		"/a/b/",
+		"GET /a/{x}",
+		"/a/{x}",
+		"/",
+	}
+	for i := 0; i < 3; i++ {
+		mux := NewServeMux()
+		for _, p := range patterns {
+			mux.Handle(p, http.NotFoundHandler())
+		}
+		lines := strings.Split(strings.TrimSuffix(mux.String(), "\n"), "\n")
+		var got []string
+		for _, line := range lines {
+			pat, loc, ok := strings.Cut(line, "  (")
+			if !ok || !strings.Contains(loc, "server_test.go:") {
+				t.Fatalf("bad line %q", line)
+			}
+			got = append(got, pat)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+		// Registering in a different order gives the same listing.
+		patterns[0], patterns[len(patterns)-1-i] = patterns[len(patterns)-1-i], patterns[0]
+	}
+}
+
+func TestCIDRHosts(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"/a", "[10.0.0.0/8]/a", "[10.1.0.0/16]/a", "10.1.2.3/a", "[192.168.0.0/16]/a", "[fd00::/8]/a"} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		host string
+		want string
+	}{
+		{"10.9.9.9", "[10.0.0.0/8]/a"},
+		{"10.1.9.9", "[10.1.0.0/16]/a"},
+		{"10.1.2.3", "10.1.2.3/a"},
+		{"192.168.1.1", "[192.168.0.0/16]/a"},
+		{"172.16.0.1", "/a"},
+		{"[fd00::1]", "[fd00::/8]/a"},
+		{"example.com", "/a"},
+	} {
+		req := httptest.NewRequest("GET", "http://"+test.host+"/a", nil)
+		_, got := mux.Handler(req)
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
 func TestExactMatch(t *testing.T) {
 	for _, test := range []struct {
 		pattern string
@@ -140,139 +681,2478 @@ func TestPathValue(t *testing.T) {
 			},
 		},
 	} {
-		mux := NewServeMux()
-		mux.Handle(test.pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			for name, want := range test.want {
-				got := mux.PathValue(r, name)
-				if got != want {
-					t.Errorf("%q, %q: got %q, want %q", test.pattern, name, got, want)
-				}
-			}
-		}))
-		server := httptest.NewServer(mux)
-		defer server.Close()
-		_, err := http.Get(server.URL + test.url)
-		if err != nil {
-			t.Fatal(err)
+		mux := NewServeMux()
+		mux.Handle(test.pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, want := range test.want {
+				got := mux.PathValue(r, name)
+				if got != want {
+					t.Errorf("%q, %q: got %q, want %q", test.pattern, name, got, want)
+				}
+			}
+		}))
+		server := httptest.NewServer(mux)
+		defer server.Close()
+		_, err := http.Get(server.URL + test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSetPathValue(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/a/{b}/c/{d...}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kvs := map[string]string{
+			"b": "X",
+			"d": "Y",
+			"a": "Z",
+		}
+		for k, v := range kvs {
+			mux.SetPathValue(r, k, v)
+		}
+		for k, w := range kvs {
+			if g := mux.PathValue(r, k); g != w {
+				t.Errorf("got %q, want %q", g, w)
+			}
+		}
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	_, err := http.Get(server.URL + "/a/b/c/d/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBindingsFromContext(t *testing.T) {
+	mux := NewServeMux()
+	var got map[string]string
+	var gotOK bool
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("set") {
+			SetPathValue(r, "extra", "E")
+		}
+		got, gotOK = BindingsFromContext(r.Context())
+	})
+	mux.Handle("/a/{b}/c/{d...}", h)
+	mux.Handle("/opt/{x?}", h)
+	mux.Handle("/static", h)
+
+	for _, test := range []struct {
+		path   string
+		want   map[string]string
+		wantOK bool
+	}{
+		{"/a/b%20c/c/d/e", map[string]string{"b": "b c", "d": "d/e"}, true},
+		{"/a/b/c/d?set", map[string]string{"b": "b", "d": "d", "extra": "E"}, true},
+		{"/opt", map[string]string{"x": ""}, true},
+		{"/opt/v", map[string]string{"x": "v"}, true},
+		{"/static", map[string]string{}, true},
+	} {
+		got, gotOK = nil, false
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+		if gotOK != test.wantOK || !maps.Equal(got, test.want) {
+			t.Errorf("%s: got (%v, %t), want (%v, %t)", test.path, got, gotOK, test.want, test.wantOK)
+		}
+	}
+
+	if _, ok := BindingsFromContext(context.Background()); ok {
+		t.Error("background context: got true, want false")
+	}
+	var sawFalse bool
+	mux.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := BindingsFromContext(r.Context())
+		sawFalse = !ok
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nothing", nil))
+	if !sawFalse {
+		t.Error("no match: got true, want false")
+	}
+}
+
+func TestPatternMeta(t *testing.T) {
+	type scopeKey struct{}
+	mux := NewServeMux()
+	admin, err := mux.HandlePattern("/admin/{page?}", http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.SetMeta(scopeKey{}, "admin")
+	if _, err := mux.HandlePattern("/public", http.NotFoundHandler()); err != nil {
+		t.Fatal(err)
+	}
+	var got any
+	mux.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = nil
+			if p, _ := mux.Match(r.Method, r.Host, r.URL.Path); p != nil {
+				got = p.Meta(scopeKey{})
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	for _, test := range []struct {
+		path string
+		want any
+	}{
+		{"/admin", "admin"},
+		{"/admin/users", "admin"},
+		{"/public", nil},
+	} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.path, got, test.want)
+		}
+	}
+	if got := admin.Meta("other"); got != nil {
+		t.Errorf("unset key: got %v, want nil", got)
+	}
+	renamed, err := admin.WithRenamedWildcards(map[string]string{"page": "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := renamed.Meta(scopeKey{}); got != nil {
+		t.Errorf("renamed: got %v, want nil", got)
+	}
+	var zero Pattern
+	zero.SetMeta(scopeKey{}, "zero")
+	if got := zero.Meta(scopeKey{}); got != "zero" {
+		t.Errorf("zero Pattern: got %v, want zero", got)
+	}
+}
+
+func TestEscapedPath(t *testing.T) {
+	mux := NewServeMux()
+	var gotPattern, gotMatch string
+	pat1 := "/a/b/c"
+	mux.Handle(pat1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPattern = pat1
+		gotMatch = ""
+	}))
+	pat2 := "/{x}/c"
+	mux.Handle(pat2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPattern = pat2
+		gotMatch = mux.PathValue(r, "x")
+	}))
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, test := range []struct {
+		path        string
+		wantPattern string
+		wantMatch   string
+	}{
+		{"/a/b/c", pat1, ""},
+		{"/a%2Fb/c", pat2, "a/b"},
+	} {
+		gotPattern = ""
+		gotMatch = ""
+		res, err := http.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 200 {
+			t.Errorf("got code %d, want 200", res.StatusCode)
+		}
+		if g, w := gotPattern, test.wantPattern; g != w {
+			t.Errorf("pattern: got %q, want %q", g, w)
+		}
+		if g, w := gotMatch, test.wantMatch; g != w {
+			t.Errorf("match: got %q, want %q", g, w)
+		}
+	}
+}
+
+func TestRawPath(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/a/b/c", http.NotFoundHandler())
+	var got string
+	mux.HandleFunc("/{x}/c", func(w http.ResponseWriter, r *http.Request) {
+		got = mux.PathValue(r, "x")
+	})
+	for _, test := range []struct {
+		path, rawPath string
+		want          string
+	}{
+		{"/a/b/c", "/a%2Fb/c", "a/b"},
+		{"/a b/c", "/a%20b/c", "a b"},
+		// An invalid RawPath is ignored.
+		{"/a/b/c", "/x%2Fy/c", ""},
+	} {
+		got = ""
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = test.path
+		req.URL.RawPath = test.rawPath
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+		if got != test.want {
+			t.Errorf("Path %q, RawPath %q: got %q, want %q", test.path, test.rawPath, got, test.want)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	mux := NewServeMux()
+	mux.Handle("GET /g", h)
+	mux.Handle("POST /p", h)
+	mux.Handle("PATCH /p", h)
+	mux.Handle("PUT /r", h)
+	mux.Handle("GET /r/", h)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, test := range []struct {
+		method, path string
+		wantStatus   int
+		wantAllow    string
+	}{
+		{"GET", "/g", 200, ""},
+		{"HEAD", "/g", 200, ""},
+		{"POST", "/g", 405, "GET, HEAD"},
+		{"GET", "/x", 404, ""},
+		{"GET", "/p", 405, "PATCH, POST"},
+		{"GET", "/./p", 405, "PATCH, POST"},
+		{"GET", "/r/", 200, ""},
+		{"GET", "/r", 200, ""}, // redirected
+		{"HEAD", "/r/", 200, ""},
+		{"HEAD", "/r", 200, ""}, // redirected
+		{"PUT", "/r/", 405, "GET, HEAD"},
+		{"PUT", "/r", 200, ""},
+	} {
+		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g, w := res.StatusCode, test.wantStatus; g != w {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.path, g, w)
+		}
+		if g, w := res.Header.Get("Allow"), test.wantAllow; g != w {
+			t.Errorf("%s %s, Allow: got %q, want %q", test.method, test.path, g, w)
+		}
+	}
+}
+
+func TestMultipleMethods(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("GET,POST /items", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, test := range []struct {
+		method     string
+		wantStatus int
+		wantAllow  string
+	}{
+		{"GET", 200, ""},
+		{"HEAD", 200, ""},
+		{"POST", 200, ""},
+		{"DELETE", 405, "GET, HEAD, POST"},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(test.method, "/items", nil))
+		if g, w := rec.Code, test.wantStatus; g != w {
+			t.Errorf("%s: got %d, want %d", test.method, g, w)
+		}
+		if g, w := rec.Header().Get("Allow"), test.wantAllow; g != w {
+			t.Errorf("%s, Allow: got %q, want %q", test.method, g, w)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"/a/{x}", "GET /a/{x}/{y...}", "/b/{$}"} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		method, path string
+		wantPat      string
+		wantValues   map[string]string
+	}{
+		{"GET", "/a/1", "/a/{x}", map[string]string{"x": "1"}},
+		{"GET", "/a/1/2/3", "GET /a/{x}/{y...}", map[string]string{"x": "1", "y": "2/3"}},
+		{"POST", "/a/1/2/3", "", nil},
+		{"GET", "/b/", "/b/{$}", nil},
+	} {
+		gotPat, gotValues := mux.Match(test.method, "", test.path)
+		got := ""
+		if gotPat != nil {
+			got = gotPat.String()
+		}
+		if got != test.wantPat {
+			t.Errorf("%s %s: got %q, want %q", test.method, test.path, got, test.wantPat)
+		}
+		if !maps.Equal(gotValues, test.wantValues) {
+			t.Errorf("%s %s: got %v, want %v", test.method, test.path, gotValues, test.wantValues)
+		}
+		if g, w := mux.Matches(test.method, "", test.path), test.wantPat != ""; g != w {
+			t.Errorf("%s %s: Matches = %t, want %t", test.method, test.path, g, w)
+		}
+	}
+}
+
+func TestMatchRelativePath(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"/users/{id}", "/{x}", "/{rest...}"} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, path := range []string{"users/1", "x", "*"} {
+		if p, m := mux.Match("GET", "", path); p != nil {
+			t.Errorf("Match(%q): got (%s, %v), want nil", path, p, m)
+		}
+		if p, _ := mux.MatchInto("GET", "", path, nil); p != nil {
+			t.Errorf("MatchInto(%q): got %s, want nil", path, p)
+		}
+		if mux.Matches("GET", "", path) {
+			t.Errorf("Matches(%q): got true, want false", path)
+		}
+		if p, _ := mux.MatchStatic("GET", "", path); p != nil {
+			t.Errorf("MatchStatic(%q): got %s, want nil", path, p)
+		}
+	}
+	// The same paths with a leading slash match.
+	if p, m := mux.Match("GET", "", "/users/1"); p == nil || m["id"] != "1" {
+		t.Errorf("Match(/users/1): got (%v, %v)", p, m)
+	}
+}
+
+func TestSegmentDelimiter(t *testing.T) {
+	mux := NewServeMux(WithSegmentDelimiter('.'))
+	mux.HandleNamed("service", "com.example.{service}", http.NotFoundHandler())
+	mux.Handle("com.{rest...}", http.NotFoundHandler())
+	mux.Handle("org.{name}.", http.NotFoundHandler())
+
+	for _, test := range []struct {
+		path       string
+		wantPat    string
+		wantValues map[string]string
+	}{
+		{"com.example.api", "com.example.{service}", map[string]string{"service": "api"}},
+		{"com.example.a/b", "com.example.{service}", map[string]string{"service": "a/b"}},
+		{"com.other.x.y", "com.{rest...}", map[string]string{"rest": "other.x.y"}},
+		{"org.go.", "org.{name}.", map[string]string{"name": "go"}},
+		{"org.go.x", "org.{name}.", map[string]string{"name": "go"}},
+		{"net.x", "", nil},
+		{"/com/example/api", "", nil},
+	} {
+		var got string
+		p, values := mux.Match("GET", "", test.path)
+		if p != nil {
+			got = p.String()
+		}
+		if got != test.wantPat {
+			t.Errorf("%s: got %q, want %q", test.path, got, test.wantPat)
+		}
+		if !maps.Equal(values, test.wantValues) {
+			t.Errorf("%s: got %v, want %v", test.path, values, test.wantValues)
+		}
+	}
+
+	if m := mux.MatchResult("GET", "", "com.other.x"); m == nil || m.Tail != "other.x" {
+		t.Errorf("MatchResult: got %+v, want Tail other.x", m)
+	}
+	if _, spans := mux.MatchSpans("GET", "", "com.example.api"); !slices.Equal(spans, []Span{{"service", 12, 15}}) {
+		t.Errorf("MatchSpans: got %v", spans)
+	}
+	if _, matches := mux.MatchInto("GET", "", "com.a.b", nil); !slices.Equal(matches, []string{"a.b"}) {
+		t.Errorf("MatchInto: got %v", matches)
+	}
+	if got, err := mux.URL("service", map[string]string{"service": "api"}); err != nil || got != "com.example.api" {
+		t.Errorf("URL: got (%q, %v), want com.example.api", got, err)
+	}
+}
+
+func TestHandleMediaType(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleMediaType("GET /items/{id}", "application/json", bodyHandler("json"))
+	mux.HandleMediaType("GET /items/{id}", "text/html", bodyHandler("html"))
+	mux.Handle("GET /items/{id}", bodyHandler("any"))
+	mux.HandleMediaType("GET /only/json", "application/json", bodyHandler("json"))
+	for _, test := range []struct {
+		path, accept string
+		want         string
+		wantCode     int
+	}{
+		{"/items/1", "application/json", "json", 200},
+		{"/items/1", "text/html", "html", 200},
+		{"/items/1", "text/html;q=0.5, application/json", "json", 200},
+		{"/items/1", "application/*", "json", 200},
+		{"/items/1", "text/*, application/json;q=0.1", "html", 200},
+		{"/items/1", "*/*", "json", 200}, // earliest registered wins a tie
+		{"/items/1", "", "json", 200},
+		{"/items/1", "image/png", "any", 200},
+		{"/items/1", "application/json;q=0, */*", "html", 200},
+		{"/only/json", "application/json", "json", 200},
+		{"/only/json", "text/html", "", http.StatusNotAcceptable},
+	} {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != test.wantCode {
+			t.Errorf("%s, Accept %q: got code %d, want %d", test.path, test.accept, rec.Code, test.wantCode)
+		} else if got := rec.Body.String(); test.wantCode == 200 && got != test.want {
+			t.Errorf("%s, Accept %q: got %q, want %q", test.path, test.accept, got, test.want)
+		}
+	}
+
+	// A request that accepts none of the media types at the best match
+	// goes to a less specific pattern that serves it.
+	mux2 := NewServeMux()
+	mux2.HandleMediaType("GET /docs/{name}", "application/json", bodyHandler("json"))
+	mux2.Handle("/docs/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "any ", PathValue(r, "name") == "")
+	}))
+	for _, test := range []struct {
+		accept, want string
+	}{
+		{"application/json", "json"},
+		{"text/html", "any true"},
+	} {
+		req := httptest.NewRequest("GET", "/docs/a", nil)
+		req.Header.Set("Accept", test.accept)
+		rec := httptest.NewRecorder()
+		mux2.ServeHTTP(rec, req)
+		if got := rec.Body.String(); rec.Code != 200 || got != test.want {
+			t.Errorf("fallback, Accept %q: got %d %q, want 200 %q", test.accept, rec.Code, got, test.want)
+		}
+	}
+
+	// The same pattern can't be registered twice for one media type.
+	defer func() {
+		if recover() == nil {
+			t.Error("got no panic, want one for a duplicate media type")
+		}
+	}()
+	mux.HandleMediaType("GET /items/{x}", "application/json", bodyHandler("again"))
+}
+
+func TestHandleHeaders(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleHeaders("GET /status", map[string]string{"x-internal": "true"}, bodyHandler("internal"))
+	mux.HandleHeaders("GET /status", map[string]string{"X-Internal": "true", "X-Debug": ""}, bodyHandler("debug"))
+	mux.Handle("GET /status", bodyHandler("public"))
+	mux.HandleHeaders("GET /admin/", map[string]string{"X-Internal": "true"}, bodyHandler("admin"))
+	mux.HandleHeaders("GET /feed", map[string]string{"X-Internal": ""}, bodyHandler("internal"))
+	mux.HandleMediaType("GET /feed", "application/json", bodyHandler("json"))
+	for _, test := range []struct {
+		path     string
+		headers  map[string]string
+		want     string
+		wantCode int
+	}{
+		{"/status", nil, "public", 200},
+		{"/status", map[string]string{"X-Internal": "true"}, "internal", 200},
+		{"/status", map[string]string{"X-Internal": "false"}, "public", 200},
+		{"/status", map[string]string{"X-Internal": "true", "X-Debug": "1"}, "debug", 200},
+		{"/status", map[string]string{"X-Debug": "1"}, "public", 200},
+		{"/admin/users", map[string]string{"X-Internal": "true"}, "admin", 200},
+		{"/admin/users", nil, "", http.StatusNotFound},
+		// More headers win over a media type.
+		{"/feed", map[string]string{"X-Internal": "1", "Accept": "application/json"}, "internal", 200},
+		{"/feed", map[string]string{"Accept": "application/json"}, "json", 200},
+		{"/feed", map[string]string{"Accept": "text/html"}, "", http.StatusNotAcceptable},
+	} {
+		req := httptest.NewRequest("GET", test.path, nil)
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != test.wantCode {
+			t.Errorf("%s, %v: got code %d, want %d", test.path, test.headers, rec.Code, test.wantCode)
+		} else if got := rec.Body.String(); test.wantCode == 200 && got != test.want {
+			t.Errorf("%s, %v: got %q, want %q", test.path, test.headers, got, test.want)
+		}
+	}
+
+	// A request that doesn't meet the headers falls through to the patterns
+	// of lower precedence that match it.
+	mux2 := NewServeMux()
+	mux2.HandleHeaders("GET /admin/", map[string]string{"X-Internal": "true"}, bodyHandler("admin"))
+	mux2.HandleHeaders("/admin/{x...}", map[string]string{"X-Debug": ""}, bodyHandler("debug"))
+	mux2.Handle("/{path...}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "catch-all ", PathValue(r, "path"))
+	}))
+	for _, test := range []struct {
+		headers map[string]string
+		want    string
+	}{
+		{map[string]string{"X-Internal": "true"}, "admin"},
+		{map[string]string{"X-Debug": "1"}, "debug"},
+		{nil, "catch-all admin/users"},
+	} {
+		req := httptest.NewRequest("GET", "/admin/users", nil)
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		mux2.ServeHTTP(rec, req)
+		if got := rec.Body.String(); rec.Code != 200 || got != test.want {
+			t.Errorf("fallback, %v: got %d %q, want 200 %q", test.headers, rec.Code, got, test.want)
+		}
+	}
+
+	// The same pattern can't be registered twice with the same headers.
+	defer func() {
+		if recover() == nil {
+			t.Error("got no panic, want one for duplicate headers")
+		}
+	}()
+	mux.HandleHeaders("GET /status", map[string]string{"X-INTERNAL": "true"}, bodyHandler("again"))
+}
+
+func TestHandleExact(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleExact("/static/index.html", bodyHandler("pinned"))
+	mux.HandleExact("a.com/x", bodyHandler("a.com pinned"))
+	mux.HandleExact("/x", bodyHandler("x pinned"))
+	mux.Handle("/static/{path...}", bodyHandler("static"))
+	mux.Handle("example.com/{path...}", bodyHandler("example.com"))
+	mux.Handle("a.com/{path...}", bodyHandler("a.com"))
+	for _, test := range []struct {
+		url, want string
+	}{
+		{"http://other.com/static/index.html", "pinned"},
+		{"http://other.com/static/a.css", "static"},
+		{"http://example.com/static/index.html", "pinned"},
+		{"https://example.com/static/index.html", "pinned"},
+		{"http://example.com/static/a.css", "example.com"},
+		{"http://a.com/x", "a.com pinned"},
+		{"http://a.com/static/index.html", "pinned"},
+		{"http://a.com/y", "a.com"},
+		{"http://other.com/x", "x pinned"},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if got := w.Body.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.url, got, test.want)
+		}
+	}
+	if p, _ := mux.Match("GET", "example.com", "/static/index.html"); p == nil || p.String() != "/static/index.html" {
+		t.Errorf("Match: got %v, want /static/index.html", p)
+	}
+
+	mux.ReHandle("/static/index.html", bodyHandler("new"))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/static/index.html", nil))
+	if got := w.Body.String(); got != "new" {
+		t.Errorf("after ReHandle: got %q, want %q", got, "new")
+	}
+
+	for _, test := range []struct {
+		pat  string
+		want string // panic substring
+	}{
+		{"/a/{x}", "has a wildcard or trailing slash"},
+		{"/dir/", "has a wildcard or trailing slash"},
+		{"/opt/{x?}", "has a wildcard or trailing slash"},
+		{"*.b.com/x", "has a wildcard or CIDR host"},
+		{"[10.0.0.0/8]/x", "has a wildcard or CIDR host"},
+		{"https:///x", "exact pattern has a scheme"},
+		{"/static/index.html", "conflicts"},
+	} {
+		func() {
+			defer func() {
+				r := recover()
+				if r == nil {
+					t.Errorf("%q: got no panic", test.pat)
+				} else if got := fmt.Sprint(r); !strings.Contains(got, test.want) {
+					t.Errorf("%q: got panic %q, want one containing %q", test.pat, got, test.want)
+				}
+			}()
+			mux.HandleExact(test.pat, bodyHandler("bad"))
+		}()
+	}
+
+	// The pinned pattern wins over a match of the other slash form, too.
+	mux = NewServeMux()
+	mux.MergeTrailingSlash = true
+	mux.HandleExact("/b/c", bodyHandler("exact"))
+	mux.Handle("example.com/b/{x...}", bodyHandler("host"))
+	for _, path := range []string{"/b/c", "/b/c/"} {
+		if p, _ := mux.Match("GET", "example.com", path); p == nil || p.String() != "/b/c" {
+			t.Errorf("MergeTrailingSlash, %s: got %v, want /b/c", path, p)
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	mux := NewServeMux()
+	a, _ := mux.HandlePattern("GET /a/{x}", http.NotFoundHandler())
+	b, _ := mux.HandlePattern("/b", http.NotFoundHandler())
+	mux.Handle("/c", http.NotFoundHandler())
+	if got := mux.Counts(); got != nil {
+		t.Fatalf("before EnableCounters: got %v, want nil", got)
+	}
+	mux.Match("GET", "", "/a/1") // not counted
+	mux.EnableCounters()
+
+	const goroutines, iters = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iters; j++ {
+				mux.Match("GET", "", "/a/1")
+				mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/b", nil))
+				mux.Match("GET", "", "/nothing")
+			}
+		}()
+	}
+	wg.Wait()
+	counts := mux.Counts()
+	if len(counts) != 3 {
+		t.Errorf("got %d patterns, want 3", len(counts))
+	}
+	for _, test := range []struct {
+		pat  *Pattern
+		want uint64
+	}{
+		{a, goroutines * iters},
+		{b, goroutines * iters},
+	} {
+		if got := counts[test.pat]; got != test.want {
+			t.Errorf("%s: got %d, want %d", test.pat, got, test.want)
+		}
+	}
+	// Explain and LongestPrefixMatch don't count.
+	mux.Explain("GET", "", "/a/1")
+	mux.LongestPrefixMatch("GET", "", "/b/c")
+	if got, want := mux.Counts(), counts; !maps.Equal(got, want) {
+		t.Errorf("after Explain and LongestPrefixMatch: got %v, want %v", got, want)
+	}
+}
+
+func TestReHandle(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("GET /items/{id}", bodyHandler("old"))
+	mux.Handle("/a/{x?}", bodyHandler("old"))
+	serve := func(path string) string {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Body.String()
+	}
+	if got, want := serve("/items/1"), "old"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	mux.ReHandle("GET /items/{id}", bodyHandler("new"))
+	if got, want := serve("/items/1"), "new"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// An equivalent pattern replaces the handler, and the registered
+	// pattern's wildcard names are kept.
+	mux.ReHandle("GET /items/{other}", bodyHandler("newer"))
+	if got, want := serve("/items/2"), "newer"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, vals := mux.Match("GET", "", "/items/2"); vals["id"] != "2" {
+		t.Errorf("got values %v, want id=2", vals)
+	}
+	mux.ReHandle("/a/{y?}", bodyHandler("new"))
+	for _, path := range []string{"/a", "/a/b"} {
+		if got := serve(path); !strings.HasPrefix(got, "new") {
+			t.Errorf("%s: got %q, want the new handler", path, got)
+		}
+	}
+	// One form of an optional pattern replaces only that form's handler.
+	mux.ReHandle("/a", bodyHandler("newer"))
+	if got, want := serve("/a"), "newer"; got != want {
+		t.Errorf("/a: got %q, want %q", got, want)
+	}
+	if got, want := serve("/a/b"), "new"; got != want {
+		t.Errorf("/a/b: got %q, want %q", got, want)
+	}
+	// Middleware from HandleWith wraps the new handler.
+	tag := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "mw:")
+			h.ServeHTTP(w, r)
+		})
+	}
+	mux.HandleWith("/m/{id}", bodyHandler("old"), tag)
+	mux.ReHandle("/m/{id}", bodyHandler("new"))
+	if got, want := serve("/m/3"), "mw:new"; got != want {
+		t.Errorf("HandleWith: got %q, want %q", got, want)
+	}
+
+	for _, pat := range []string{"GET /items/{id}/x", "/items/{id}", "POST /items/{id}"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%q: got no panic, want one for an unregistered pattern", pat)
+				}
+			}()
+			mux.ReHandle(pat, bodyHandler("bad"))
+		}()
+	}
+}
+
+func TestWildcardHost(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"*.example.com/a", "*.example.com/{x}", "api.example.com/a",
+		"*.api.example.com/a", "/b", "*.com/b"} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		host, path string
+		want       string
+	}{
+		{"www.example.com", "/a", "*.example.com/a"},
+		{"www.example.com", "/c", "*.example.com/{x}"},
+		{"api.example.com", "/a", "api.example.com/a"},
+		{"api.example.com", "/c", "*.example.com/{x}"},
+		{"v1.api.example.com", "/a", "*.api.example.com/a"},
+		{"example.com", "/a", ""},
+		{"example.com", "/b", "*.com/b"},
+		{"example.org", "/b", "/b"},
+		{"www.example.com", "/b", "*.example.com/{x}"},
+	} {
+		var got string
+		if p, _ := mux.Match("GET", test.host, test.path); p != nil {
+			got = p.String()
+		}
+		if got != test.want {
+			t.Errorf("%s%s: got %q, want %q", test.host, test.path, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeMethod(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("GET /a", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "GET /a")
+	})
+	for _, normalize := range []bool{false, true} {
+		mux.NormalizeMethod = normalize
+		for _, method := range []string{"get", "Get", "head"} {
+			want := ""
+			if normalize {
+				want = "GET /a"
+			}
+			var got string
+			if p, _ := mux.Match(method, "", "/a"); p != nil {
+				got = p.String()
+			}
+			if got != want {
+				t.Errorf("normalize=%t, %s: Match got %q, want %q", normalize, method, got, want)
+			}
+		}
+		req := httptest.NewRequest("get", "/a", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		wantCode := http.StatusMethodNotAllowed
+		if normalize {
+			wantCode = http.StatusOK
+		}
+		if rec.Code != wantCode {
+			t.Errorf("normalize=%t: ServeHTTP got code %d, want %d", normalize, rec.Code, wantCode)
+		}
+	}
+}
+
+func TestRepeatedWildcards(t *testing.T) {
+	mux := NewServeMux(WithRepeatedWildcards())
+	org, err := mux.HandlePattern("/{org}/repos/{org}/settings", http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle("/{a}/repos/{b}/{c...}", http.NotFoundHandler())
+	for _, test := range []struct {
+		path       string
+		want       string
+		wantValues map[string]string
+	}{
+		{"/go/repos/go/settings", org.String(), map[string]string{"org": "go"}},
+		{"/go/repos/tools/settings", "/{a}/repos/{b}/{c...}", map[string]string{"a": "go", "b": "tools", "c": "settings"}},
+	} {
+		p, values := mux.Match("GET", "", test.path)
+		if p == nil || p.String() != test.want || !maps.Equal(values, test.wantValues) {
+			t.Errorf("%s: got (%v, %v), want (%s, %v)", test.path, p, values, test.want, test.wantValues)
+		}
+	}
+	if got, want := org.Canonical(), "/{w1}/repos/{w1}/settings"; got != want {
+		t.Errorf("Canonical: got %q, want %q", got, want)
+	}
+	// A repeated name counts once.
+	if got, want := org.Wildcards(), []string{"org"}; !slices.Equal(got, want) {
+		t.Errorf("Wildcards: got %q, want %q", got, want)
+	}
+	if got, want := org.OpenAPIParameters(), []string{"org"}; !slices.Equal(got, want) {
+		t.Errorf("OpenAPIParameters: got %q, want %q", got, want)
+	}
+	if got := org.NumWildcards(); got != 1 {
+		t.Errorf("NumWildcards: got %d, want 1", got)
+	}
+	if err := org.Validate(ValidateOptions{MaxWildcards: 1}); err != nil {
+		t.Errorf("Validate with MaxWildcards 1: %v", err)
+	}
+	_, vals := mux.MatchInto("GET", "", "/go/repos/go/settings", nil)
+	if got, want := org.BindSlice(vals), []Binding{{"org", "go"}}; !slices.Equal(got, want) {
+		t.Errorf("BindSlice: got %v, want %v", got, want)
+	}
+	if got, want := mux.MatchResult("GET", "", "/go/repos/go/settings").Bindings(), []Binding{{"org", "go"}}; !slices.Equal(got, want) {
+		t.Errorf("Bindings: got %v, want %v", got, want)
+	}
+
+	for _, pat := range []string{"/{x}/{x...}", "/{x:2}/{x}", "/{x...}/{x}", "/a/{x}/{x?}"} {
+		if _, err := mux.HandlePattern(pat, http.NotFoundHandler()); err == nil {
+			t.Errorf("%q: got nil, want error", pat)
+		}
+	}
+	if _, err := NewServeMux().HandlePattern("/{x}/{x}", http.NotFoundHandler()); err == nil {
+		t.Error("without WithRepeatedWildcards: got nil, want error")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	mux := NewServeMux()
+	h := http.NotFoundHandler()
+	v1 := mux.Group("/api/v1")
+	v1.Handle("/users", h)
+	v1.Handle("POST /users/{id}", h)
+	admin := v1.Group("GET /admin/")
+	admin.HandleFunc("/stats", func(http.ResponseWriter, *http.Request) {})
+	admin.Handle("PUT /stats", h)
+	mux.Group("api.example.com").Handle("/{$}", h)
+
+	for _, test := range []struct {
+		method, host, path string
+		want               string
+	}{
+		{"GET", "", "/api/v1/users", "/api/v1/users"},
+		{"POST", "", "/api/v1/users/3", "POST /api/v1/users/{id}"},
+		{"GET", "", "/api/v1/admin/stats", "GET /api/v1/admin/stats"},
+		{"PUT", "", "/api/v1/admin/stats", "PUT /api/v1/admin/stats"},
+		{"GET", "api.example.com", "/", "api.example.com/{$}"},
+		{"GET", "", "/users", ""},
+	} {
+		var got string
+		if p, _ := mux.Match(test.method, test.host, test.path); p != nil {
+			got = p.String()
+		}
+		if got != test.want {
+			t.Errorf("%s %s%s: got %q, want %q", test.method, test.host, test.path, got, test.want)
+		}
+	}
+
+	for _, f := range []func(){
+		func() { mux.Group("GET") },
+		func() { v1.Handle("users", h) },
+		func() { v1.Handle("/users", h) }, // already registered
+		func() { mux.Group("/files/{path...}").Handle("/{x}", h) },
+		func() { NewServeMux(WithSegmentDelimiter('.')).Group("com").Handle(".x", h) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("got no panic, want one")
+				}
+			}()
+			f()
+		}()
+	}
+
+	// With a delimiter, paths are joined with it.
+	dmux := NewServeMux(WithSegmentDelimiter('.'))
+	com := dmux.Group("GET com.example.")
+	com.Handle("users.{id}", h)
+	com.Group("POST api").Handle("a/b", h)
+	com.Handle("x.a b", h)
+	for _, test := range []struct {
+		method, path, want string
+	}{
+		{"GET", "com.example.users.3", "GET com.example.users.{id}"},
+		{"POST", "com.example.api.a/b", "POST com.example.api.a/b"},
+		{"GET", "com.example.api.a/b", ""},
+		{"GET", "com.example.x.a b", "GET com.example.x.a b"},
+	} {
+		var got string
+		if p, _ := dmux.Match(test.method, "", test.path); p != nil {
+			got = p.String()
+		}
+		if got != test.want {
+			t.Errorf("%s %s: got %q, want %q", test.method, test.path, got, test.want)
+		}
+	}
+}
+
+func TestMergeTrailingSlash(t *testing.T) {
+	mux := NewServeMux()
+	mux.MergeTrailingSlash = true
+	for _, p := range []string{"/items/{id}", "/dir/", "/both", "/both/", "/{path...}"} {
+		p := p
+		mux.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s id=%s", p, mux.PathValue(r, "id"))
+		})
+	}
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		{"/items/3", "/items/{id} id=3"},
+		{"/items/3/", "/items/{id} id=3"},
+		{"/dir/", "/dir/ id="},
+		{"/dir", "/dir/ id="}, // no redirect
+		{"/both", "/both id="},
+		{"/both/", "/both/ id="},
+		{"/items/3/4", "/{path...} id="},
+		{"/other/", "/{path...} id="},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != 200 {
+			t.Errorf("%s: got code %d, want 200", test.path, rec.Code)
+		} else if got := rec.Body.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.path, got, test.want)
+		}
+	}
+
+	m := mux.MatchResult("GET", "", "/dir")
+	if m == nil || m.Pattern.String() != "/dir/" || m.Tail != "" {
+		t.Errorf("MatchResult(/dir): got %+v, want /dir/ with an empty tail", m)
+	}
+	if p, values := mux.Match("GET", "", "/items/5/"); p == nil || values["id"] != "5" {
+		t.Errorf("Match(/items/5/): got (%v, %v), want /items/{id} with id=5", p, values)
+	}
+	// The other Match methods merge the two forms, too.
+	if p, vals := mux.MatchInto("GET", "", "/items/5/", nil); p == nil || p.String() != "/items/{id}" || !slices.Equal(vals, []string{"5"}) {
+		t.Errorf("MatchInto(/items/5/): got (%v, %q), want /items/{id} with 5", p, vals)
+	}
+	if p, values, err := mux.MatchContext(context.Background(), "GET", "", "/items/5/"); err != nil || p == nil || values["id"] != "5" {
+		t.Errorf("MatchContext(/items/5/): got (%v, %v, %v), want /items/{id} with id=5", p, values, err)
+	}
+	if p, spans := mux.MatchSpans("GET", "", "/items/5/"); p == nil || !slices.Equal(spans, []Span{{"id", 7, 8}}) {
+		t.Errorf("MatchSpans(/items/5/): got (%v, %v), want /items/{id} with id at 7:8", p, spans)
+	}
+	if p := mux.LongestPrefixMatch("GET", "", "/items/5/"); p == nil || p.String() != "/items/{id}" {
+		t.Errorf("LongestPrefixMatch(/items/5/): got %v, want /items/{id}", p)
+	}
+	mux2 := NewServeMux()
+	mux2.MergeTrailingSlash = true
+	mux2.Handle("/dir/", http.NotFoundHandler())
+	if !mux2.Matches("GET", "", "/dir") {
+		t.Error("Matches(/dir): got false, want true")
+	}
+}
+
+func TestHostOnlyPattern(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("maintenance.example.com", http.NotFoundHandler())
+	mux.Handle("maintenance.example.com/status", http.NotFoundHandler())
+	mux.Handle("/a/{x}", http.NotFoundHandler())
+	for _, test := range []struct {
+		host, path string
+		want       string
+	}{
+		{"maintenance.example.com", "/", "maintenance.example.com"},
+		{"maintenance.example.com", "/a/1", "maintenance.example.com"},
+		{"maintenance.example.com", "/x/y/z", "maintenance.example.com"},
+		{"maintenance.example.com", "/status", "maintenance.example.com/status"},
+		{"other.com", "/a/1", "/a/{x}"},
+		{"other.com", "/x", ""},
+	} {
+		var got string
+		if p, _ := mux.Match("GET", test.host, test.path); p != nil {
+			got = p.String()
+		}
+		if got != test.want {
+			t.Errorf("%s%s: got %q, want %q", test.host, test.path, got, test.want)
+		}
+	}
+	// It conflicts with the explicit form.
+	if err := mux.CanRegister(mustParse(t, "maintenance.example.com/")); err == nil {
+		t.Error("got nil, want conflict")
+	}
+}
+
+func TestRegisterAll(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/existing/{x}", http.NotFoundHandler())
+	if err := mux.RegisterAll(mustRoutes(t, "GET /a/{x}", "GET /a/b", "/items/{id?}")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a/1", "/a/b", "/items", "/items/3", "/existing/1"} {
+		if p, _ := mux.Match("GET", "", path); p == nil {
+			t.Errorf("%s: no match", path)
+		}
+	}
+
+	// A batch doesn't change a tree that was loaded before it.
+	old := mux.tree.Load()
+	if err := mux.RegisterAll(mustRoutes(t, "GET /a/c", "GET /a/d/{y}", "/items/{id}/x")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a/c", "/a/d/1", "/items/3/x"} {
+		if p, _ := mux.Match("GET", "", path); p == nil || p.String() == "GET /a/{x}" {
+			t.Errorf("%s: got %v, want the new pattern", path, p)
+		}
+		if n, _ := old.match("GET", "", path); n != nil && n.pattern.String() != "GET /a/{x}" {
+			t.Errorf("%s: older tree matched %s", path, n.pattern)
+		}
+	}
+
+	before := mux.String()
+	for _, test := range []struct {
+		name   string
+		routes []Route
+		want   string // error substring
+	}{
+		{"internal", mustRoutes(t, "/b/{x}/d", "/c", "/{y}/c/d"), `"/{y}/c/d" (registered at routes[2]) conflicts with pattern "/b/{x}/d" (registered at routes[0])`},
+		{"existing", mustRoutes(t, "/b", "/{x}/1"), `"/{x}/1" (registered at routes[1]) conflicts with pattern "/existing/{x}"`},
+		{"duplicate", mustRoutes(t, "/b", "/b"), "conflicts"},
+		{"optional", mustRoutes(t, "/b/{x?}", "/b"), "conflicts"},
+		{"nil handler", []Route{{mustParse(t, "/b"), http.NotFoundHandler()}, {mustParse(t, "/c"), nil}}, `routes[1] "/c": nil handler`},
+	} {
+		err := mux.RegisterAll(test.routes)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want error containing %q", test.name, err, test.want)
+		}
+		// Nothing in the batch was registered.
+		if after := mux.String(); after != before {
+			t.Errorf("%s: patterns changed from\n%s\nto\n%s", test.name, before, after)
+		}
+	}
+}
+
+func TestMaxPatterns(t *testing.T) {
+	mux := NewServeMux()
+	mux.MaxPatterns = 3
+	for _, p := range []string{"/a", "/b", "/c/{x?}"} {
+		if _, err := mux.HandlePattern(p, http.NotFoundHandler()); err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+	}
+	_, err := mux.HandlePattern("/d", http.NotFoundHandler())
+	if !errors.Is(err, ErrTooManyPatterns) {
+		t.Fatalf("/d: got %v, want ErrTooManyPatterns", err)
+	}
+	if mux.Matches("GET", "", "/d") {
+		t.Error("/d was registered")
+	}
+
+	// RegisterAll registers none of the routes if they don't all fit.
+	mux.Reset()
+	err = mux.RegisterAll(mustRoutes(t, "/a", "/b", "/c", "/d"))
+	if !errors.Is(err, ErrTooManyPatterns) || !strings.Contains(err.Error(), `"/d"`) {
+		t.Errorf("RegisterAll: got %v, want ErrTooManyPatterns for /d", err)
+	}
+	if mux.Matches("GET", "", "/a") {
+		t.Error("/a was registered")
+	}
+	if err := mux.RegisterAll(mustRoutes(t, "/a", "/b", "/c")); err != nil {
+		t.Errorf("RegisterAll after Reset: %v", err)
+	}
+
+	// Lowering MaxPatterns below the number registered refuses more.
+	mux.MaxPatterns = 1
+	_, err = mux.HandlePattern("/e", http.NotFoundHandler())
+	if !errors.Is(err, ErrTooManyPatterns) || !strings.Contains(err.Error(), `"/e"`) {
+		t.Errorf("/e after lowering MaxPatterns: got %v, want ErrTooManyPatterns", err)
+	}
+}
+
+func TestFirstMatchWins(t *testing.T) {
+	patterns := []string{"/{path...}", "/a/{x}", "GET /a/b", "example.com/c"}
+	for _, test := range []struct {
+		method, host, path string
+		want, wantFirst    string
+	}{
+		{"GET", "", "/a/1", "/a/{x}", "/{path...}"},
+		{"HEAD", "", "/a/b", "GET /a/b", "/{path...}"},
+		{"GET", "example.com", "/c", "example.com/c", "/{path...}"},
+		{"GET", "", "/b", "/{path...}", "/{path...}"},
+	} {
+		for _, first := range []bool{false, true} {
+			var opts []Option
+			want := test.want
+			if first {
+				opts = append(opts, WithFirstMatchWins())
+				want = test.wantFirst
+			}
+			mux := NewServeMux(opts...)
+			for _, p := range patterns {
+				mux.Handle(p, http.NotFoundHandler())
+			}
+			var got string
+			if p, _ := mux.Match(test.method, test.host, test.path); p != nil {
+				got = p.String()
+			}
+			if got != want {
+				t.Errorf("first=%t, %s %s%s: got %q, want %q", first, test.method, test.host, test.path, got, want)
+			}
+		}
+	}
+
+	// Conflicting patterns can be registered, and the earliest wins.
+	// Wildcard values come from it.
+	mux := NewServeMux(WithFirstMatchWins())
+	mux.Handle("/{y}/d", http.NotFoundHandler())
+	mux.Handle("/c/{z}", http.NotFoundHandler())
+	mux.Handle("/c/", http.NotFoundHandler())
+	p, values := mux.Match("GET", "", "/c/d")
+	if p == nil || p.String() != "/{y}/d" || values["y"] != "c" {
+		t.Errorf("got (%v, %v), want /{y}/d with y=c", p, values)
+	}
+	if p, _ := mux.Match("GET", "", "/c/e/f"); p == nil || p.String() != "/c/" {
+		t.Errorf("got %v, want /c/", p)
+	}
+	if err := mux.CanRegister(mustParse(t, "/{a}/{b}")); err != nil {
+		t.Errorf("CanRegister: %v", err)
+	}
+	if _, err := mux.HandlePattern("/{a}/d", http.NotFoundHandler()); err == nil {
+		t.Error("got nil, want error registering an equivalent pattern")
+	}
+}
+
+func TestStrictShadowing(t *testing.T) {
+	for _, test := range []struct {
+		first, second string
+		want          bool // error
+	}{
+		{"/a/{x}", "example.com/{path...}", true},
+		{"example.com/{path...}", "/a/{x}", true},
+		{"GET /a/{x}", "example.com/", true},
+		{"/a/{x}", "https:///{path...}", true},
+		{"/a/{x}", "https://example.com/a/{y}", false}, // same path: an override
+		{"/a/{x}", "/{path...}", false},                // /a/{x} wins
+		{"example.com/a/{x}", "/{path...}", false},
+		{"example.com/a/{x}", "other.com/{path...}", false},
+		{"/a/{x}", "example.com/b/{path...}", false},
+		{"[10.1.0.0/16]/a", "10.1.2.3/", true},
+		{"[10.1.0.0/16]/a", "[10.0.0.0/8]/", false},
+	} {
+		for _, strict := range []bool{false, true} {
+			mux := NewServeMux()
+			mux.StrictShadowing = strict
+			mux.Handle(test.first, http.NotFoundHandler())
+			_, err := mux.HandlePattern(test.second, http.NotFoundHandler())
+			if got, want := err != nil, test.want && strict; got != want {
+				t.Errorf("%q then %q, strict=%t: got error %v, want error: %t", test.first, test.second, strict, err, want)
+			}
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleNamed("a", "/a/{x}", http.NotFoundHandler())
+	mux.Handle("GET /b", http.NotFoundHandler())
+	mux.Reset()
+	for _, path := range []string{"/a/1", "/b"} {
+		if p, _ := mux.Match("GET", "", path); p != nil {
+			t.Errorf("%s: got %s after Reset, want no match", path, p)
+		}
+	}
+	if _, err := mux.URL("a", map[string]string{"x": "1"}); err == nil {
+		t.Error("URL: got nil, want error after Reset")
+	}
+	if s := mux.String(); s != "" {
+		t.Errorf("String: got %q, want empty", s)
+	}
+
+	// Patterns that conflicted with the old ones can now be registered.
+	mux.HandleNamed("a", "/a/{y}", http.NotFoundHandler())
+	if p, _ := mux.Match("GET", "", "/a/1"); p == nil || p.String() != "/a/{y}" {
+		t.Errorf("got %v, want /a/{y}", p)
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/a/{x}", http.NotFoundHandler())
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"/a/b", "/a/b"},
+		{"/a/b?x=1", "/a/b"},
+		{"/a/b#frag", "/a/b"},
+		{"/a/b?x=1#frag", "/a/b"},
+		{"/a/b#frag?x", "/a/b"},
+		{"/a/%3F?q", "/a/%3F"},
+		{"?x", ""},
+	} {
+		got := SplitPath(test.in)
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+	r := httptest.NewRequest("GET", "/a/b?x=1", nil)
+	p, values := mux.Match("GET", "", SplitPath(r.URL.RequestURI()))
+	if p == nil || values["x"] != "b" {
+		t.Errorf("got (%v, %v), want /a/{x} with x=b", p, values)
+	}
+}
+
+func TestMatchSpans(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"/users/{id}/posts/{rest...}", "/archive/{date:3}/{slug}", "/static/", "/items/{id?}"} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		path string
+		want []Span
+	}{
+		{"/users/17/posts/a/b", []Span{{"id", 7, 9}, {"rest", 16, 19}}},
+		{"/users/17/posts/", []Span{{"id", 7, 9}, {"rest", 16, 16}}},
+		{"/users/a%2Fb/posts/x", []Span{{"id", 7, 12}, {"rest", 19, 20}}},
+		{"/archive/2024/01/15/hello", []Span{{"date", 9, 19}, {"slug", 20, 25}}},
+		{"/static/css/a.css", nil},
+		{"/items", nil},
+		{"/items/4", []Span{{"id", 7, 8}}},
+	} {
+		p, got := mux.MatchSpans("GET", "", test.path)
+		if p == nil {
+			t.Errorf("%s: no match", test.path)
+			continue
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.path, got, test.want)
+		}
+		_, values := mux.Match("GET", "", test.path)
+		for _, s := range got {
+			if g, w := matchValue(test.path[s.Start:s.End]), values[s.Name]; g != w {
+				t.Errorf("%s: %s: span value %q, Match value %q", test.path, s.Name, g, w)
+			}
+		}
+	}
+	if p, spans := mux.MatchSpans("GET", "", "/nope"); p != nil || spans != nil {
+		t.Errorf("got (%v, %v), want no match", p, spans)
+	}
+}
+
+func TestMatchEmptyMethod(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("GET /x", http.NotFoundHandler())
+	mux.Handle("/y", http.NotFoundHandler())
+	if p, _ := mux.Match("", "", "/x"); p != nil {
+		t.Errorf("/x: got %s, want nil", p)
+	}
+	if p, _ := mux.Match("", "", "/y"); p == nil || p.String() != "/y" {
+		t.Errorf("/y: got %v, want /y", p)
+	}
+	if mux.Matches("", "", "/x") {
+		t.Error("Matches: got true, want false")
+	}
+}
+
+func TestMatchResult(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"/static/", "/files/{path...}", "/users/{id}", "/a/{x}/{rest...}"} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		path    string
+		pattern string
+		tail    string
+	}{
+		{"/static/", "/static/", ""},
+		{"/static/css/main.css", "/static/", "css/main.css"},
+		{"/files/a/b%20c", "/files/{path...}", "a/b c"},
+		{"/users/17", "/users/{id}", ""},
+		{"/a/b/c/d", "/a/{x}/{rest...}", "c/d"},
+	} {
+		m := mux.MatchResult("GET", "", test.path)
+		if m == nil {
+			t.Errorf("%s: no match", test.path)
+			continue
+		}
+		if got := m.Pattern.String(); got != test.pattern {
+			t.Errorf("%s: got pattern %q, want %q", test.path, got, test.pattern)
+		}
+		if m.Tail != test.tail {
+			t.Errorf("%s: got tail %q, want %q", test.path, m.Tail, test.tail)
+		}
+		if m.Pattern.HasMultiWildcard() {
+			if v := m.Values[m.Pattern.lastSegment().s]; v != m.Tail {
+				t.Errorf("%s: multi wildcard value %q differs from tail %q", test.path, v, m.Tail)
+			}
+		}
+		if p, tail := mux.MatchStatic("GET", "", test.path); p != m.Pattern || tail != m.Tail {
+			t.Errorf("%s: MatchStatic: got (%v, %q), want (%v, %q)", test.path, p, tail, m.Pattern, m.Tail)
+		}
+	}
+	if m := mux.MatchResult("GET", "", "/other"); m != nil {
+		t.Errorf("got %v, want nil", m)
+	}
+	if p, tail := mux.MatchStatic("GET", "", "/other"); p != nil || tail != "" {
+		t.Errorf("MatchStatic: got (%v, %q), want (nil, \"\")", p, tail)
+	}
+}
+
+// errAfterContext is a context whose Err method starts returning
+// context.Canceled after it has been called n times.
+type errAfterContext struct {
+	context.Context
+	n int
+}
+
+func (c *errAfterContext) Err() error {
+	if c.n <= 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestMatchContext(t *testing.T) {
+	// Each pattern is all "a"s except for one wildcard, so matching a path
+	// of "a"s that ends differently backtracks through many nodes.
+	const depth = 12
+	mux := NewServeMux()
+	for i := 0; i < depth; i++ {
+		segs := make([]string, depth)
+		for j := range segs {
+			segs[j] = "a"
+		}
+		segs[i] = "{x}"
+		mux.Handle(fmt.Sprintf("/%s/end%d", strings.Join(segs, "/"), i), http.NotFoundHandler())
+	}
+	path := strings.Repeat("/a", depth) + "/other"
+
+	p, _, err := mux.MatchContext(context.Background(), "GET", "", path)
+	if p != nil || err != nil {
+		t.Fatalf("got (%v, %v), want no match and no error", p, err)
+	}
+	p, _, err = mux.MatchContext(context.Background(), "GET", "", strings.Repeat("/a", depth)+"/end0")
+	if p == nil || err != nil {
+		t.Fatalf("got (%v, %v), want a match", p, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := mux.MatchContext(ctx, "GET", "", path); err != context.Canceled {
+		t.Errorf("canceled context: got %v, want %v", err, context.Canceled)
+	}
+
+	// A context canceled during the match stops it.
+	actx := &errAfterContext{Context: context.Background(), n: 1}
+	if _, _, err := mux.MatchContext(actx, "GET", "", path); err != context.Canceled {
+		t.Errorf("canceled during match: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestMaxSegments(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/{x...}", http.NotFoundHandler())
+	mux.MaxSegments = 4
+	for _, test := range []struct {
+		path  string
+		match bool
+		code  int
+	}{
+		{"/a/b/c", true, 404},
+		{"/a/b/c/d", true, 404},
+		{"/a/b/c/", true, 404},
+		{"/a/b/c/d/e", false, http.StatusRequestURITooLong},
+		{"/a/b/c/d/", false, http.StatusRequestURITooLong},
+	} {
+		if p, _ := mux.Match("GET", "", test.path); (p != nil) != test.match {
+			t.Errorf("%s: Match got %v, want match %t", test.path, p, test.match)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.code {
+			t.Errorf("%s: got code %d, want %d", test.path, rec.Code, test.code)
+		}
+	}
+}
+
+func TestMatchDecoding(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/users/{name}", http.NotFoundHandler())
+	mux.Handle("/files/{rest...}", http.NotFoundHandler())
+	for _, test := range []struct {
+		path    string
+		name    string
+		want    string
+		wantRaw string
+	}{
+		{"/users/john%20doe", "name", "john doe", "john%20doe"},
+		{"/users/a%2Fb", "name", "a/b", "a%2Fb"},
+		{"/users/100%", "name", "100%", "100%"}, // malformed escape
+		{"/files/a%2Fb/c%20d", "rest", "a/b/c d", "a%2Fb/c%20d"},
+		{"/files/bad%/c%20d", "rest", "bad%/c d", "bad%/c%20d"},
+	} {
+		_, values := mux.Match("GET", "", test.path)
+		if got := values[test.name]; got != test.want {
+			t.Errorf("%s: got %q, want %q", test.path, got, test.want)
+		}
+		_, raw := mux.MatchInto("GET", "", test.path, nil)
+		if got := raw[0]; got != test.wantRaw {
+			t.Errorf("%s raw: got %q, want %q", test.path, got, test.wantRaw)
+		}
+	}
+}
+
+func TestRawBindings(t *testing.T) {
+	mux := NewServeMux()
+	var got string
+	mux.Handle("/users/{name}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = PathValue(r, "name")
+	}))
+	for _, test := range []struct {
+		raw  bool
+		want string
+	}{
+		{false, "a/b c"},
+		{true, "a%2Fb%20c"},
+	} {
+		mux.RawBindings = test.raw
+		_, values := mux.Match("GET", "", "/users/a%2Fb%20c")
+		if g := values["name"]; g != test.want {
+			t.Errorf("raw=%t: Match: got %q, want %q", test.raw, g, test.want)
+		}
+		got = ""
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/a%2Fb%20c", nil))
+		if got != test.want {
+			t.Errorf("raw=%t: PathValue: got %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestMatchInto(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/{a}/x/{b...}", http.NotFoundHandler())
+	buf := make([]string, 0, 4)
+	pat, values := mux.MatchInto("GET", "", "/1/x/2/3", buf)
+	if pat == nil {
+		t.Fatal("no match")
+	}
+	if got, want := values, []string{"1", "2/3"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := pat.Wildcards(), []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if &values[0] != &buf[:1][0] {
+		t.Error("values do not share buf's storage")
+	}
+	if pat, _ := mux.MatchInto("GET", "", "/1/y", buf); pat != nil {
+		t.Errorf("got %s, want no match", pat)
+	}
+}
+
+func TestBindMulti(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/files/{rest...}", http.NotFoundHandler())
+	mux.Handle("/dir/", http.NotFoundHandler())
+	for _, test := range []struct {
+		path string
+		want map[string][]string
+	}{
+		{"/files/a/b/c", map[string][]string{"rest": {"a", "b", "c"}}},
+		{"/files/a", map[string][]string{"rest": {"a"}}},
+		{"/files/", map[string][]string{"rest": {}}},
+		{"/files/a%2Fb/c%20d", map[string][]string{"rest": {"a/b", "c d"}}},
+		{"/dir/a/b", nil},
+	} {
+		pat, values := mux.MatchInto("GET", "", test.path, nil)
+		if pat == nil {
+			t.Fatalf("%s: no match", test.path)
+		}
+		got := pat.BindMulti(values)
+		if !maps.EqualFunc(got, test.want, slices.Equal[string]) {
+			t.Errorf("%s: got %#v, want %#v", test.path, got, test.want)
+		}
+		if got != nil && got["rest"] == nil {
+			t.Errorf("%s: got nil slice, want empty", test.path)
+		}
+	}
+}
+
+func TestBindSlice(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{
+		"/p/{z}/a/{y}/{x...}",
+		"/d/{date:3}/{id}",
+		"/items/{id?}",
+		"/static/",
+	} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		path string
+		want []Binding
+	}{
+		{"/p/1/a/2/3/4", []Binding{{"z", "1"}, {"y", "2"}, {"x", "3/4"}}},
+		{"/p/1%202/a/b%2Fc/", []Binding{{"z", "1 2"}, {"y", "b/c"}, {"x", ""}}},
+		{"/d/2024/01/15/7", []Binding{{"date", "2024/01/15"}, {"id", "7"}}},
+		{"/items/4", []Binding{{"id", "4"}}},
+		{"/items", []Binding{{"id", ""}}},
+		{"/static/a", nil},
+	} {
+		pat, values := mux.MatchInto("GET", "", test.path, nil)
+		if pat == nil {
+			t.Fatalf("%s: no match", test.path)
+		}
+		if got := pat.BindSlice(values); !slices.Equal(got, test.want) {
+			t.Errorf("%s: BindSlice: got %v, want %v", test.path, got, test.want)
+		}
+		m := mux.MatchResult("GET", "", test.path)
+		got := m.Bindings()
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: Match.Bindings: got %v, want %v", test.path, got, test.want)
+		}
+		// The names are those of the pattern, in order.
+		p, err := Parse(m.Pattern.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, b := range got {
+			names = append(names, b.Name)
+		}
+		if want := p.Wildcards(); !slices.Equal(names, want) {
+			t.Errorf("%s: got names %v, want %v", test.path, names, want)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"/a/{x}", "GET /a/b/", "/", "a.com/c", "GET,POST /{y}"} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	var got []string
+	err := mux.Walk(func(p *Pattern, depth int) error {
+		got = append(got, fmt.Sprintf("%s@%d", p, depth))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"/@3",
+		"/a/{x}@4",
+		"GET,POST /{y}@3",
+		"GET /a/b/@5",
+		"GET,POST /{y}@3",
+		"a.com/c@3",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+
+	// Walk stops at the first error.
+	errStop := errors.New("stop")
+	n := 0
+	err = mux.Walk(func(*Pattern, int) error {
+		n++
+		if n == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || n != 2 {
+		t.Errorf("got %v after %d calls, want %v after 2", err, n, errStop)
+	}
+}
+
+func TestCanRegister(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/a/{x}", http.NotFoundHandler())
+
+	err := mux.CanRegister(mustParse(t, "/a/{y}"))
+	if err == nil || !strings.Contains(err.Error(), "conflicts with") {
+		t.Errorf("got %v, want conflict", err)
+	}
+	if p, _ := mux.Match("GET", "", "/a/1"); p == nil || p.String() != "/a/{x}" {
+		t.Errorf("after failed CanRegister, got %v, want /a/{x}", p)
+	}
+
+	if err := mux.CanRegister(mustParse(t, "/b")); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := mux.Match("GET", "", "/b"); p != nil {
+		t.Errorf("CanRegister registered %s", p)
+	}
+	// The pattern can still be registered.
+	mux.Handle("/b", http.NotFoundHandler())
+}
+
+// Run with -race.
+func TestConcurrentRegisterAndMatch(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/a/{x}", http.NotFoundHandler())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			mux.Handle(fmt.Sprintf("/b%d/{x...}", i), http.NotFoundHandler())
+		}
+	}()
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if p, _ := mux.Match("GET", "", "/a/1"); p == nil {
+					t.Error("no match")
+					return
+				}
+				mux.MatchInto("GET", "", fmt.Sprintf("/b%d/c", i), nil)
+				mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/b1/c", nil))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMiddleware(t *testing.T) {
+	var log []string
+	logger := func(name string) Middleware {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				log = append(log, name)
+				h.ServeHTTP(w, r)
+			})
+		}
+	}
+	mux := NewServeMux()
+	mux.Use(logger("g1"))
+	mux.HandleWith("/a", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log = append(log, "h")
+	}), logger("r1"), logger("r2"))
+	mux.Use(logger("g2"))
+
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		{"/a", "g1 g2 r1 r2 h"},
+		{"/b", "g1 g2"}, // not found
+	} {
+		log = nil
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+		if got := strings.Join(log, " "); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.path, got, test.want)
+		}
+	}
+
+	// The chain is built by Use, not for each request.
+	calls := 0
+	mux.Use(func(h http.Handler) http.Handler {
+		calls++
+		return h
+	})
+	for i := 0; i < 3; i++ {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/a", nil))
+	}
+	if calls != 1 {
+		t.Errorf("middleware called %d times, want 1", calls)
+	}
+}
+
+func TestMethodlessFallback(t *testing.T) {
+	// The tree tries the request's method before patterns without one.
+	// That is right only if no method-less pattern can take precedence over
+	// a pattern with a method that also matches; conflict checking ensures it.
+	mux := NewServeMux()
+	for _, p := range []string{
+		"/a",
+		"GET /a",
+		"POST,PUT /a",
+		"/b/{x}",
+		"GET /b/{x}",
+		"DELETE /b/c",
+		"/c/",
+		"GET /c/{x}/d",
+		"HEAD /c/x/d",
+		"/d/{x}",
+		"GET /d/e",
+	} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/a", "GET /a"},
+		{"HEAD", "/a", "GET /a"},
+		{"PUT", "/a", "POST,PUT /a"},
+		{"PATCH", "/a", "/a"},
+		{"GET", "/b/c", "GET /b/{x}"},
+		{"DELETE", "/b/c", "DELETE /b/c"},
+		{"DELETE", "/b/d", "/b/{x}"},
+		{"POST", "/b/c", "/b/{x}"},
+		{"GET", "/c/x/d", "GET /c/{x}/d"},
+		{"GET", "/c/x/e", "/c/"},
+		{"HEAD", "/c/x/d", "HEAD /c/x/d"},
+		{"HEAD", "/c/y/d", "GET /c/{x}/d"},
+		{"HEAD", "/c/x", "/c/"},
+		{"GET", "/d/e", "GET /d/e"},
+		{"POST", "/d/e", "/d/{x}"},
+		{"GET", "/d/f", "/d/{x}"},
+		{"GET", "/e", ""},
+	} {
+		var got string
+		if p, _ := mux.Match(test.method, "", test.path); p != nil {
+			got = p.String()
+		}
+		if got != test.want {
+			t.Errorf("%s %s: got %q, want %q", test.method, test.path, got, test.want)
+		}
+	}
+	// A method-less pattern that would win over a GET pattern on some
+	// requests, and lose on others, conflicts with it.
+	if _, err := mux.HandlePattern("/b/c", http.NotFoundHandler()); err == nil {
+		t.Error("/b/c: got no conflict with GET /b/{x}, want one")
+	}
+}
+
+func TestHostFallback(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"a.com/x", "/x", "/y", "*.b.com/x", "b.com/z/{p...}", "/z/{q}"} {
+		p := p
+		mux.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, p)
+		})
+	}
+	for _, test := range []struct {
+		host, path, want string
+	}{
+		{"a.com", "/x", "a.com/x"},
+		{"a.com", "/y", "/y"},
+		{"other.com", "/x", "/x"},
+		{"c.b.com", "/x", "*.b.com/x"},
+		{"c.b.com", "/y", "/y"},
+		{"b.com", "/z/1", "b.com/z/{p...}"},
+		{"b.com", "/y", "/y"},
+		{"", "/z/1", "/z/{q}"},
+	} {
+		p, _ := mux.Match("GET", test.host, test.path)
+		if p == nil || p.String() != test.want {
+			t.Errorf("Match(%s%s): got %v, want %s", test.host, test.path, p, test.want)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Host = test.host
+		mux.ServeHTTP(w, r)
+		if got := w.Body.String(); got != test.want {
+			t.Errorf("ServeHTTP(%s%s): got %q, want %q", test.host, test.path, got, test.want)
+		}
+	}
+}
+
+func TestStrictHost(t *testing.T) {
+	mux := NewServeMux()
+	mux.StrictHost = true
+	for _, p := range []string{
+		"a.com/x",
+		"*.b.com/y",
+		"[10.0.0.0/8]/z",
+		"https://c.com/w",
+		"/",
+		"POST /v",
+	} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		host, path string
+		want       string
+	}{
+		{"a.com", "/x", "a.com/x"},
+		{"a.com", "/q", "/"},
+		{"x.b.com", "/y", "*.b.com/y"},
+		{"x.b.com", "/q", "/"},
+		{"10.1.2.3", "/q", "/"},
+		{"c.com", "/q", "/"},
+		{"", "/q", "/"},
+		{"d.com", "/x", ""},
+		{"d.com", "/q", ""},
+		{"b.com", "/q", ""},
+		{"11.1.2.3", "/q", ""},
+	} {
+		var got string
+		if p, _ := mux.Match("GET", test.host, test.path); p != nil {
+			got = p.String()
+		}
+		if got != test.want {
+			t.Errorf("%s%s: got %q, want %q", test.host, test.path, got, test.want)
+		}
+	}
+
+	// An unregistered host gets a 404, even if a pattern with another method
+	// matches its path.
+	r := httptest.NewRequest("GET", "/v", nil)
+	r.Host = "d.com:8080"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET d.com/v: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	mux.StrictHost = false
+	if p, _ := mux.Match("GET", "d.com", "/q"); p == nil || p.String() != "/" {
+		t.Errorf("without StrictHost: got %v, want /", p)
+	}
+}
+
+func TestLongestPrefixMatch(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{
+		"/a/",
+		"/a/b/",
+		"/a/b/c/{rest...}",
+		"/a/b/c/d/e",
+		"GET /x/y",
+		"a.com/h/",
+	} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		method, host, path string
+		want               string
+	}{
+		{"GET", "", "/a/b/c/d/e", "/a/b/c/d/e"},
+		{"GET", "", "/a/b/c/d/f", "/a/b/c/{rest...}"},
+		{"GET", "", "/a/b/c/d/e/f", "/a/b/c/{rest...}"},
+		{"GET", "", "/a/b/c", "/a/b/"},
+		{"GET", "", "/a/b/q/r", "/a/b/"},
+		{"GET", "", "/a/b", "/a/"},
+		{"GET", "", "/a/z", "/a/"},
+		{"GET", "", "/a", ""},
+		{"GET", "", "/x/y/z", "GET /x/y"},
+		{"POST", "", "/x/y/z", ""},
+		{"GET", "a.com", "/h/i/j", "a.com/h/"},
+		{"GET", "b.com", "/h/i/j", ""},
+		{"GET", "b.com", "/a/b/c/d", "/a/b/c/{rest...}"},
+		{"GET", "", "/q", ""},
+	} {
+		var got string
+		if p := mux.LongestPrefixMatch(test.method, test.host, test.path); p != nil {
+			got = p.String()
+		}
+		if got != test.want {
+			t.Errorf("%s %s%s: got %q, want %q", test.method, test.host, test.path, got, test.want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{
+		"GET /users/{id}",
+		"POST /users/{id}/posts",
+		"a.com/users/{id}/posts",
+		"/users/{id}/",
+		"/static/",
+		"/",
+	} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	mux2 := NewServeMux()
+	mux2.Handle("GET /users/{id}", http.NotFoundHandler())
+	mux2.Handle("POST /users/{id}/posts", http.NotFoundHandler())
+	mux2.Handle("/static/", http.NotFoundHandler())
+	mux2.Handle("https:///admin", http.NotFoundHandler())
+
+	loc := func(mux *ServeMux, pat string) string {
+		var l string
+		mux.Walk(func(p *Pattern, _ int) error {
+			if p.String() == pat {
+				l = p.location()
+			}
+			return nil
+		})
+		return l
+	}
+	for _, test := range []struct {
+		mux                *ServeMux
+		method, host, path string
+		want               string // with %[1]s etc. for locations in order
+		pats               []string
+	}{
+		{
+			mux, "GET", "", "/users/17",
+			"GET /users/17 matches GET /users/{id} (%s)\n\tid = \"17\"\n",
+			[]string{"GET /users/{id}"},
+		},
+		{
+			mux, "GET", "", "/users/17/posts",
+			"GET /users/17/posts matches /users/{id}/ (%s)\n\tid = \"17\"\n",
+			[]string{"/users/{id}/"},
+		},
+		{
+			mux2, "GET", "b.com", "/users/17/posts",
+			"GET b.com/users/17/posts matches no pattern\n" +
+				"\tPOST /users/{id}/posts (%s): matches the path, but method GET is not POST\n" +
+				"\tGET /users/{id} (%s): matches only the prefix \"/users/17\"\n",
+			[]string{"POST /users/{id}/posts", "GET /users/{id}"},
+		},
+		{
+			mux2, "GET", "", "/users/17/x",
+			"GET /users/17/x matches no pattern\n" +
+				"\tGET /users/{id} (%s): matches only the prefix \"/users/17\"\n",
+			[]string{"GET /users/{id}"},
+		},
+		{
+			mux2, "GET", "", "/admin",
+			"GET /admin matches no pattern\n" +
+				"\thttps:///admin (%s): matches the path, but only secure requests match\n",
+			[]string{"https:///admin"},
+		},
+	} {
+		var locs []any
+		for _, p := range test.pats {
+			locs = append(locs, loc(test.mux, p))
+		}
+		want := fmt.Sprintf(test.want, locs...)
+		if got := test.mux.Explain(test.method, test.host, test.path); got != want {
+			t.Errorf("%s %s%s:\ngot\n%s\nwant\n%s", test.method, test.host, test.path, got, want)
+		}
+	}
+
+	// A request for another host lists the pattern with a host.
+	mux3 := NewServeMux()
+	mux3.Handle("a.com/x", http.NotFoundHandler())
+	mux3.Handle("*.b.com/x", http.NotFoundHandler())
+	got := mux3.Explain("GET", "c.com", "/x")
+	for _, want := range []string{
+		`a.com/x (` + loc(mux3, "a.com/x") + `): matches the path, but host "c.com" is not a.com`,
+		`*.b.com/x (` + loc(mux3, "*.b.com/x") + `): matches the path, but host "c.com" is not *.b.com`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got\n%s\nwant it to contain\n%s", got, want)
+		}
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{
+		"GET a.com/x",
+		"PUT a.com/x",
+		"POST /x",
+		"DELETE b.com/x/",
+		"/y",
+		"GET /y/{z}",
+	} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		method, host, path string
+		want               []string
+	}{
+		{"GET", "a.com", "/x", []string{"GET", "HEAD", "POST", "PUT"}},
+		{"GET", "a.com:8080", "/x", []string{"GET", "HEAD", "POST", "PUT"}},
+		{"POST", "a.com", "/x", []string{"GET", "HEAD", "POST", "PUT"}},
+		{"GET", "c.com", "/x", []string{"POST"}},
+		{"GET", "a.com", "/a/../x", []string{"GET", "HEAD", "POST", "PUT"}},
+		// The trailing-slash redirect counts.
+		{"GET", "b.com", "/x", []string{"DELETE", "POST"}},
+		{"GET", "b.com:443", "/x/", []string{"DELETE"}},
+		{"GET", "c.com", "/y", nil},
+		{"GET", "c.com", "/y/1", []string{"GET", "HEAD"}},
+		{"GET", "c.com", "/z", nil},
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Host = test.host
+		got := mux.AllowedMethods(r)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s %s%s: got %q, want %q", test.method, test.host, test.path, got, test.want)
+		}
+	}
+
+	r := httptest.NewRequest("PATCH", "/x", nil)
+	r.Host = "a.com:80"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("PATCH a.com/x: got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if got, want := w.Header().Get("Allow"), "GET, HEAD, POST, PUT"; got != want {
+		t.Errorf("PATCH a.com/x: got Allow %q, want %q", got, want)
+	}
+
+	// A CONNECT request is matched with r.Host, and so are its allowed methods.
+	r = httptest.NewRequest("CONNECT", "/x", nil)
+	r.Host = "a.com"
+	r.URL.Host = "c.com"
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if got, want := w.Header().Get("Allow"), "GET, HEAD, POST, PUT"; got != want {
+		t.Errorf("CONNECT a.com/x: got Allow %q, want %q", got, want)
+	}
+	if got, want := mux.AllowedMethods(r), []string{"GET", "HEAD", "POST", "PUT"}; !slices.Equal(got, want) {
+		t.Errorf("AllowedMethods(CONNECT a.com/x): got %q, want %q", got, want)
+	}
+}
+
+func TestOptionsStar(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{"GET /a", "POST /a", "example.com/b", "DELETE example.com/c/{x}"} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	serve := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, "*", nil))
+		return w
+	}
+
+	w := serve("OPTIONS")
+	if w.Code != http.StatusOK {
+		t.Errorf("OPTIONS *: got status %d, want 200", w.Code)
+	}
+	if got, want := w.Header().Get("Allow"), "DELETE, GET, HEAD, OPTIONS, POST"; got != want {
+		t.Errorf("OPTIONS *: got Allow %q, want %q", got, want)
+	}
+	if w := serve("GET"); w.Code != http.StatusBadRequest {
+		t.Errorf("GET *: got status %d, want 400", w.Code)
+	}
+	if p, _ := mux.Match("OPTIONS", "", "*"); p != nil {
+		t.Errorf("Match: got %s, want nil", p)
+	}
+
+	var called bool
+	mux.OptionsStar = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	serve("OPTIONS")
+	if !called {
+		t.Error("OptionsStar was not called")
+	}
+	if _, pat := mux.Handler(httptest.NewRequest("OPTIONS", "*", nil)); pat != "*" {
+		t.Errorf("Handler: got pattern %q, want \"*\"", pat)
+	}
+}
+
+func TestNotFoundAndMethodNotAllowed(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("GET /x", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, test := range []struct {
+		name         string
+		custom       bool
+		method, path string
+		wantStatus   int
+		wantBody     string
+		wantAllow    string
+	}{
+		{"default 404", false, "GET", "/y", 404, "404 page not found\n", ""},
+		{"default 405", false, "POST", "/x", 405, "Method Not Allowed\n", "GET, HEAD"},
+		{"custom 404", true, "GET", "/y", 404, "custom not found", ""},
+		{"custom 405", true, "POST", "/x", 405, "custom not allowed", "GET, HEAD"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mux.NotFound = nil
+			mux.MethodNotAllowed = nil
+			if test.custom {
+				mux.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, "custom not found")
+				})
+				mux.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					fmt.Fprint(w, "custom not allowed")
+				})
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(test.method, test.path, nil))
+			if g, w := rec.Code, test.wantStatus; g != w {
+				t.Errorf("status: got %d, want %d", g, w)
+			}
+			if g, w := rec.Body.String(), test.wantBody; g != w {
+				t.Errorf("body: got %q, want %q", g, w)
+			}
+			if g, w := rec.Header().Get("Allow"), test.wantAllow; g != w {
+				t.Errorf("Allow: got %q, want %q", g, w)
+			}
+		})
+	}
+}
+
+func TestHandlePattern(t *testing.T) {
+	mux := NewServeMux()
+	pat, err := mux.HandlePattern("GET /users/{id}/files/{path...}", http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := pat.Build(map[string]string{"id": "u 1", "path": "a/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/users/u%201/files/a/b"; path != want {
+		t.Fatalf("got %q, want %q", path, want)
+	}
+	got, vals := mux.Match("GET", "", path)
+	if got != pat {
+		t.Errorf("built path %q matched %v, want %v", path, got, pat)
+	}
+	if g, w := vals["id"], "u 1"; g != w {
+		t.Errorf("id: got %q, want %q", g, w)
+	}
+
+	if _, err := mux.HandlePattern("GET /users/{x}/files/{y...}", http.NotFoundHandler()); err == nil {
+		t.Error("got nil, want conflict error")
+	}
+	if _, err := mux.HandlePattern("GET /users/{id}/files/{path...}", http.NotFoundHandler()); err == nil {
+		t.Error("duplicate: got nil, want error")
+	}
+	if _, err := mux.HandlePattern("/{", http.NotFoundHandler()); err == nil {
+		t.Error("got nil, want parse error")
+	}
+}
+
+func TestSpanWildcard(t *testing.T) {
+	mux := NewServeMux()
+	var got string
+	mux.HandleFunc("/archive/{date:3}/article", func(w http.ResponseWriter, r *http.Request) {
+		got = PathValue(r, "date")
+	})
+	mux.Handle("/archive/{slug}", http.NotFoundHandler())
+
+	for _, test := range []struct {
+		path string
+		want string // pattern
+	}{
+		{"/archive/2024/01/15/article", "/archive/{date:3}/article"},
+		{"/archive/2024/01/article", ""},
+		{"/archive/2024/01/15/16/article", ""},
+		{"/archive/2024", "/archive/{slug}"},
+	} {
+		var g string
+		if p, _ := mux.Match("GET", "", test.path); p != nil {
+			g = p.String()
+		}
+		if g != test.want {
+			t.Errorf("%s: got %q, want %q", test.path, g, test.want)
+		}
+	}
+
+	_, values := mux.Match("GET", "", "/archive/2024/a%20b/15/article")
+	if g, w := values["date"], "2024/a b/15"; g != w {
+		t.Errorf("Match: got %q, want %q", g, w)
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/archive/2024/01/15/article", nil))
+	if w := "2024/01/15"; got != w {
+		t.Errorf("PathValue: got %q, want %q", got, w)
+	}
+	if g, w := mustParse(t, "/a/{d:2}/{x}").debugString(), "/a/{d:2}/{x}"; g != w {
+		t.Errorf("debugString: got %q, want %q", g, w)
+	}
+}
+
+func TestMultiSuffix(t *testing.T) {
+	mux := NewServeMux()
+	for _, p := range []string{
+		"/files/{path...}/download",
+		"/files/{path...}/a/download",
+		"/files/{name}/download",
+		"/files/{path...}",
+	} {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	for _, test := range []struct {
+		path   string
+		want   string // pattern
+		values map[string]string
+	}{
+		{"/files/a/b/c/download", "/files/{path...}/download", map[string]string{"path": "a/b/c"}},
+		{"/files/a/download", "/files/{name}/download", map[string]string{"name": "a"}},
+		{"/files/a/b/a/download", "/files/{path...}/a/download", map[string]string{"path": "a/b"}},
+		{"/files/a/b/%64ownload", "/files/{path...}/download", map[string]string{"path": "a/b"}},
+		{"/files/download", "/files/{path...}", map[string]string{"path": "download"}},
+		{"/files/a/b/download/", "/files/{path...}", map[string]string{"path": "a/b/download/"}},
+		{"/files/a/download/b", "/files/{path...}", map[string]string{"path": "a/download/b"}},
+	} {
+		p, values := mux.Match("GET", "", test.path)
+		if p == nil || p.String() != test.want {
+			t.Errorf("%s: got %v, want %q", test.path, p, test.want)
+			continue
 		}
+		if !maps.Equal(values, test.values) {
+			t.Errorf("%s: got values %v, want %v", test.path, values, test.values)
+		}
+	}
+
+	_, spans := mux.MatchSpans("GET", "", "/files/a/b/download")
+	if want := []Span{{"path", 7, 10}}; !slices.Equal(spans, want) {
+		t.Errorf("MatchSpans: got %v, want %v", spans, want)
+	}
+	if m := mux.MatchResult("GET", "", "/files/a/b/download"); m.Tail != "" {
+		t.Errorf("MatchResult: got tail %q, want none", m.Tail)
+	}
+	// "/files/a/download" matches both.
+	if _, err := mux.HandlePattern("/files/a/{x}", http.NotFoundHandler()); err == nil {
+		t.Error("got no conflict, want one")
 	}
 }
 
-func TestSetPathValue(t *testing.T) {
+func TestMultiSuffixPrecedence(t *testing.T) {
+	// The multi wildcard followed by a literal is more specific, though the
+	// other pattern has a single wildcard in its place.
 	mux := NewServeMux()
-	mux.Handle("/a/{b}/c/{d...}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		kvs := map[string]string{
-			"b": "X",
-			"d": "Y",
-			"a": "Z",
+	mux.Handle("/files/{p...}/download", http.NotFoundHandler())
+	mux.Handle("/files/{x}/{y...}", http.NotFoundHandler())
+	for _, test := range []struct {
+		path   string
+		want   string // pattern
+		values map[string]string
+	}{
+		{"/files/a/download", "/files/{p...}/download", map[string]string{"p": "a"}},
+		{"/files/a/b/download", "/files/{p...}/download", map[string]string{"p": "a/b"}},
+		{"/files/a/b", "/files/{x}/{y...}", map[string]string{"x": "a", "y": "b"}},
+		{"/files/a/download/b", "/files/{x}/{y...}", map[string]string{"x": "a", "y": "download/b"}},
+	} {
+		p, values := mux.Match("GET", "", test.path)
+		if p == nil || p.String() != test.want {
+			t.Errorf("%s: got %v, want %q", test.path, p, test.want)
+			continue
 		}
-		for k, v := range kvs {
-			mux.SetPathValue(r, k, v)
+		if !maps.Equal(values, test.values) {
+			t.Errorf("%s: got values %v, want %v", test.path, values, test.values)
 		}
-		for k, w := range kvs {
-			if g := mux.PathValue(r, k); g != w {
-				t.Errorf("got %q, want %q", g, w)
-			}
+	}
+}
+
+func TestCaseInsensitivePath(t *testing.T) {
+	mux := NewServeMux(WithCaseInsensitivePath())
+	var got string
+	mux.HandleFunc("GET /api/users/{name}", func(w http.ResponseWriter, r *http.Request) {
+		got = PathValue(r, "name")
+	})
+	mux.Handle("/Docs/{rest...}", http.NotFoundHandler())
+	mux.Handle("/Files/{path...}/Raw", http.NotFoundHandler())
+
+	for _, test := range []struct {
+		path string
+		want string // pattern
+	}{
+		{"/api/users/Bob", "GET /api/users/{name}"},
+		{"/API/Users/Bob", "GET /api/users/{name}"},
+		{"/docs/a/B", "/Docs/{rest...}"},
+		{"/DOCS/", "/Docs/{rest...}"},
+		{"/files/a/b/RAW", "/Files/{path...}/Raw"},
+		{"/api/user/Bob", ""},
+	} {
+		var g string
+		if p, _ := mux.Match("GET", "", test.path); p != nil {
+			g = p.String()
 		}
-	}))
-	server := httptest.NewServer(mux)
-	defer server.Close()
-	_, err := http.Get(server.URL + "/a/b/c/d/e")
+		if g != test.want {
+			t.Errorf("%s: got %q, want %q", test.path, g, test.want)
+		}
+	}
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/API/Users/BoB", nil))
+	if want := "BoB"; got != want {
+		t.Errorf("PathValue: got %q, want %q", got, want)
+	}
+	if err := mux.CanRegister(mustParse(t, "GET /API/users/{n}")); err == nil {
+		t.Error("got nil, want conflict for pattern differing only in case")
+	}
+	// The registered pattern keeps its case, and is what Match returns.
+	pat, err := mux.HandlePattern("GET /Items/{id}", http.NotFoundHandler())
 	if err != nil {
 		t.Fatal(err)
 	}
-}
+	if p, _ := mux.Match("GET", "", "/items/1"); p != pat {
+		t.Errorf("Match returned %v, not the registered pattern", p)
+	}
+	if u, err := pat.Build(map[string]string{"id": "1"}); err != nil || u != "/Items/1" {
+		t.Errorf("Build: got %q, %v, want \"/Items/1\"", u, err)
+	}
 
-func TestEscapedPath(t *testing.T) {
-	mux := NewServeMux()
-	var gotPattern, gotMatch string
-	pat1 := "/a/b/c"
-	mux.Handle(pat1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		gotPattern = pat1
-		gotMatch = ""
-	}))
-	pat2 := "/{x}/c"
-	mux.Handle(pat2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		gotPattern = pat2
-		gotMatch = mux.PathValue(r, "x")
-	}))
+	// Without the option, case matters.
+	mux = NewServeMux()
+	mux.Handle("/api/users", http.NotFoundHandler())
+	mux.Handle("/API/Users", http.NotFoundHandler())
+	if p, _ := mux.Match("GET", "", "/Api/Users"); p != nil {
+		t.Errorf("got %s, want no match", p)
+	}
+}
 
-	server := httptest.NewServer(mux)
-	defer server.Close()
+func TestUnicodeNormalization(t *testing.T) {
+	const (
+		composed   = "caf\u00e9"  // "café" with U+00E9
+		decomposed = "cafe\u0301" // "café" with "e" and U+0301
+	)
+	mux := NewServeMux(WithUnicodeNormalization())
+	var got string
+	mux.HandleFunc("/"+composed+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		got = PathValue(r, "name")
+	})
+	mux.Handle("/"+decomposed+"/menu", http.NotFoundHandler())
+	mux.Handle("/files/{path...}/"+composed, http.NotFoundHandler())
 
 	for _, test := range []struct {
-		path        string
-		wantPattern string
-		wantMatch   string
+		path string
+		want string // pattern
 	}{
-		{"/a/b/c", pat1, ""},
-		{"/a%2Fb/c", pat2, "a/b"},
+		{"/" + composed + "/x", "/" + composed + "/{name}"},
+		{"/" + decomposed + "/x", "/" + composed + "/{name}"},
+		{"/" + composed + "/menu", "/" + decomposed + "/menu"},
+		{"/" + url.PathEscape(decomposed) + "/x", "/" + composed + "/{name}"},
+		{"/files/a/b/" + decomposed, "/files/{path...}/" + composed},
+		{"/cafe/x", ""},
 	} {
-		gotPattern = ""
-		gotMatch = ""
-		res, err := http.Get(server.URL + test.path)
-		if err != nil {
-			t.Fatal(err)
+		var g string
+		if p, _ := mux.Match("GET", "", test.path); p != nil {
+			g = p.String()
 		}
-		if res.StatusCode != 200 {
-			t.Errorf("got code %d, want 200", res.StatusCode)
+		if g != test.want {
+			t.Errorf("%+q: got %+q, want %+q", test.path, g, test.want)
 		}
-		if g, w := gotPattern, test.wantPattern; g != w {
-			t.Errorf("pattern: got %q, want %q", g, w)
+	}
+
+	// Wildcards keep the form of the path.
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+url.PathEscape(composed)+"/"+url.PathEscape(decomposed), nil))
+	if got != decomposed {
+		t.Errorf("PathValue: got %+q, want %+q", got, decomposed)
+	}
+	if err := mux.CanRegister(mustParse(t, "/"+decomposed+"/{n}")); err == nil {
+		t.Error("got nil, want conflict for pattern differing only in normalization")
+	}
+
+	// Without the option, the forms differ.
+	mux = NewServeMux()
+	mux.Handle("/"+composed, http.NotFoundHandler())
+	if p, _ := mux.Match("GET", "", "/"+decomposed); p != nil {
+		t.Errorf("without normalization: got %s, want no match", p)
+	}
+}
+
+func TestStats(t *testing.T) {
+	patterns := []string{"/a", "/a/b", "GET /c/{x}", "example.com/d"}
+	for _, test := range []struct {
+		opts []Option
+		want TreeStats
+	}{
+		{nil, TreeStats{MaxDepth: 4, Nodes: 11, Leaves: 3, SliceNodes: 6}},
+		{[]Option{WithMaxSlice(0)}, TreeStats{MaxDepth: 4, Nodes: 11, Leaves: 3, MapNodes: 6}},
+	} {
+		mux := NewServeMux(test.opts...)
+		for _, p := range patterns {
+			mux.Handle(p, http.NotFoundHandler())
 		}
-		if g, w := gotMatch, test.wantMatch; g != w {
-			t.Errorf("match: got %q, want %q", g, w)
+		if got := mux.Stats(); got != test.want {
+			t.Errorf("got %+v, want %+v", got, test.want)
 		}
 	}
+	if got, want := NewServeMux().Stats(), (TreeStats{Nodes: 1, Leaves: 1}); got != want {
+		t.Errorf("empty: got %+v, want %+v", got, want)
+	}
 }
 
-func TestStatus(t *testing.T) {
-	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+func TestHandlePanicLeavesMuxUnchanged(t *testing.T) {
+	// A registration that panics must not leave part of its pattern behind,
+	// in the tree or in the index used for conflict checks.
 	mux := NewServeMux()
-	mux.Handle("GET /g", h)
-	mux.Handle("POST /p", h)
-	mux.Handle("PATCH /p", h)
-	mux.Handle("PUT /r", h)
-	mux.Handle("GET /r/", h)
-	server := httptest.NewServer(mux)
-	defer server.Close()
+	var served string
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = name })
+	}
+	mux.Handle("/a/{x}/b", handler("a"))
+	mux.Handle("POST /a/{x}/b", handler("p"))
+	mux.HandleMediaType("/m", "text/html", handler("html"))
+	mustPanic := func(f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Error("got no panic")
+			}
+		}()
+		f()
+	}
+	mustPanic(func() { mux.Handle("/a/c/{y}", handler("c")) })
+	// The pattern for GET could be added, but not the one for POST.
+	mustPanic(func() { mux.Handle("GET,POST /a/{z}/b", handler("d")) })
+	mustPanic(func() { mux.HandleMediaType("/m", "text/html", handler("html2")) })
 
 	for _, test := range []struct {
 		method, path string
-		wantStatus   int
-		wantAllow    string
+		want         string
 	}{
-		{"GET", "/g", 200, ""},
-		{"HEAD", "/g", 200, ""},
-		{"POST", "/g", 405, "GET, HEAD"},
-		{"GET", "/x", 404, ""},
-		{"GET", "/p", 405, "PATCH, POST"},
-		{"GET", "/./p", 405, "PATCH, POST"},
-		{"GET", "/r/", 200, ""},
-		{"GET", "/r", 200, ""}, // redirected
-		{"HEAD", "/r/", 200, ""},
-		{"HEAD", "/r", 200, ""}, // redirected
-		{"PUT", "/r/", 405, "GET, HEAD"},
-		{"PUT", "/r", 200, ""},
+		{"GET", "/a/c/b", "a"},
+		{"POST", "/a/c/b", "p"},
+		{"GET", "/a/c/d", ""},
+		{"GET", "/m", "html"},
 	} {
-		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
-		if err != nil {
-			t.Fatal(err)
+		served = ""
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set("Accept", "text/html")
+		mux.ServeHTTP(httptest.NewRecorder(), r)
+		if served != test.want {
+			t.Errorf("%s %s: served by %q, want %q", test.method, test.path, served, test.want)
 		}
-		res, err := http.DefaultClient.Do(req)
+	}
+	var n int
+	if err := mux.Walk(func(*Pattern, int) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d patterns, want 3", n)
+	}
+	// "/{p}/c/e" conflicts with "/a/c/{y}", but not with "/a/{x}/b", so it can
+	// only be registered if the failed pattern was not kept.
+	if _, err := mux.HandlePattern("/{p}/c/e", handler("e")); err != nil {
+		t.Errorf("after failed registrations: %v", err)
+	}
+}
+
+func TestHandleNamed(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleNamed("user", "GET /users/{id}", http.NotFoundHandler())
+	mux.HandleNamed("file", "/users/{id}/files/{path...}", http.NotFoundHandler())
+
+	for _, test := range []struct {
+		name   string
+		values map[string]string
+		want   string
+	}{
+		{"user", map[string]string{"id": "17"}, "/users/17"},
+		{"file", map[string]string{"id": "a b", "path": "x/y.txt"}, "/users/a%20b/files/x/y.txt"},
+	} {
+		got, err := mux.URL(test.name, test.values)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if g, w := res.StatusCode, test.wantStatus; g != w {
-			t.Errorf("%s %s: got %d, want %d", test.method, test.path, g, w)
-		}
-		if g, w := res.Header.Get("Allow"), test.wantAllow; g != w {
-			t.Errorf("%s %s, Allow: got %q, want %q", test.method, test.path, g, w)
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
 		}
 	}
+
+	if _, err := mux.URL("user", nil); err == nil {
+		t.Error("missing value: got nil, want error")
+	}
+	if _, err := mux.URL("nope", nil); err == nil {
+		t.Error("unknown name: got nil, want error")
+	}
+
+	// A duplicate name panics, and does not register the pattern.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("duplicate name: got no panic")
+			}
+		}()
+		mux.HandleNamed("user", "/other", http.NotFoundHandler())
+	}()
+	if p, _ := mux.Match("GET", "", "/other"); p != nil {
+		t.Errorf("/other matched %s", p)
+	}
+
+	// A name whose registration fails can be reused.
+	func() {
+		defer func() { recover() }()
+		mux.HandleNamed("bad", "GET /users/{x}", http.NotFoundHandler())
+	}()
+	mux.HandleNamed("bad", "/bad", http.NotFoundHandler())
+	if got, err := mux.URL("bad", nil); err != nil || got != "/bad" {
+		t.Errorf("bad: got (%q, %v), want \"/bad\"", got, err)
+	}
 }
 
-func BenchmarkRegister(b *testing.B) {
+// readTestPatterns returns the patterns in testdata/patterns.txt.
+func readTestPatterns(b *testing.B) []string {
 	f, err := os.Open(filepath.Join("testdata", "patterns.txt"))
 	if err != nil {
 		b.Fatal(err)
@@ -290,6 +3170,11 @@ func BenchmarkRegister(b *testing.B) {
 	if scan.Err() != nil {
 		b.Fatal(scan.Err())
 	}
+	return patterns
+}
+
+func BenchmarkRegister(b *testing.B) {
+	patterns := readTestPatterns(b)
 	b.Logf("benchmarking with %d patterns", len(patterns))
 	// To make path comparison harder, move API name to the end.
 	for i, p := range patterns {
@@ -301,7 +3186,7 @@ func BenchmarkRegister(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		mux := NewServeMux()
 		for _, p := range patterns {
-			if err := mux.register(p, http.NotFoundHandler()); err != nil {
+			if _, err := mux.register(p, http.NotFoundHandler(), nil); err != nil {
 				b.Fatal(err)
 			}
 		}
@@ -309,6 +3194,186 @@ func BenchmarkRegister(b *testing.B) {
 	}
 }
 
+// Benchmark matching the patterns in testdata with and without Compile.
+func BenchmarkCompile(b *testing.B) {
+	patterns := readTestPatterns(b)
+	type request struct{ method, path string }
+	var reqs []request
+	for _, p := range patterns {
+		pat, err := Parse(p)
+		if err != nil {
+			b.Fatal(err)
+		}
+		reqs = append(reqs, request{pat.Method(), pat.ExamplePath()})
+	}
+	for _, compile := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compiled=%t", compile), func(b *testing.B) {
+			mux := NewServeMux()
+			for _, p := range patterns {
+				mux.Handle(p, http.NotFoundHandler())
+			}
+			if compile {
+				mux.Compile()
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, r := range reqs {
+					mux.Matches(r.method, "", r.path)
+				}
+			}
+		})
+	}
+}
+
+// Benchmark matching a path with many wildcards, with and without pooling
+// the slice of wildcard values.
+func BenchmarkMatchWildcards(b *testing.B) {
+	mux := NewServeMux()
+	mux.Handle("/{a}/{b}/{c}/{d}/{e}/{f}", http.NotFoundHandler())
+	path := "/1/2/3/4/5/6"
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			mux.tree.Load().match("GET", "", path)
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bp := getMatches()
+			_, matches := mux.tree.Load().matchInto("GET", "", path, *bp)
+			putMatches(bp, matches)
+		}
+	})
+}
+
+func BenchmarkMatchInto(b *testing.B) {
+	mux := NewServeMux()
+	mux.Handle("/users/{user}/posts/{post}", http.NotFoundHandler())
+	path := "/users/jba/posts/17"
+	b.Run("Match", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			mux.Match("GET", "", path)
+		}
+	})
+	b.Run("MatchInto", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]string, 0, 4)
+		for i := 0; i < b.N; i++ {
+			_, buf = mux.MatchInto("GET", "", path, buf)
+		}
+	})
+	b.Run("Matches", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			mux.Matches("GET", "", path)
+		}
+	})
+}
+
+func BenchmarkMatchStatic(b *testing.B) {
+	mux := NewServeMux()
+	mux.Handle("/{path...}", http.NotFoundHandler())
+	path := "/assets/img/icons/2023/logo.png"
+	b.Run("Match", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			mux.Match("GET", "", path)
+		}
+	})
+	b.Run("MatchStatic", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			mux.MatchStatic("GET", "", path)
+		}
+	})
+}
+
+func BenchmarkConcurrentMatch(b *testing.B) {
+	mux := NewServeMux()
+	for i := 0; i < 100; i++ {
+		mux.Handle(fmt.Sprintf("/r%d/{id}", i), http.NotFoundHandler())
+	}
+	path := "/r50/17"
+	b.Run("snapshot", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			buf := make([]string, 0, 4)
+			for pb.Next() {
+				_, buf = mux.MatchInto("GET", "", path, buf)
+			}
+		})
+	})
+	// For comparison, the same matching with a read lock around each match.
+	b.Run("rwmutex", func(b *testing.B) {
+		var mu sync.RWMutex
+		tree := mux.tree.Load()
+		b.RunParallel(func(pb *testing.PB) {
+			buf := make([]string, 0, 4)
+			for pb.Next() {
+				mu.RLock()
+				_, buf = tree.matchInto("GET", "", path, buf)
+				mu.RUnlock()
+			}
+		})
+	})
+}
+
+// Benchmark registering many patterns in one RegisterAll batch
+// and one at a time.
+func BenchmarkRegisterAll(b *testing.B) {
+	const n = 5000
+	routes := make([]Route, n)
+	for i := range routes {
+		pat, err := Parse(fmt.Sprintf("GET /api/r%d/{id}/items%d", i%100, i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		routes[i] = Route{pat, http.NotFoundHandler()}
+	}
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := NewServeMux().RegisterAll(routes); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("single", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			mux := NewServeMux()
+			for j := range routes {
+				if err := mux.RegisterAll(routes[j : j+1]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkRegisterCapacityHint(b *testing.B) {
+	const n = 10000
+	patterns := make([]string, n)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf("GET /api/r%d/{id}/items%d", i%100, i)
+	}
+	for _, hint := range []int{0, n} {
+		b.Run(fmt.Sprintf("hint=%d", hint), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				mux := NewServeMux(WithCapacityHint(hint))
+				for _, p := range patterns {
+					if _, err := mux.register(p, http.NotFoundHandler(), nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
 func moveFirstSegmentToEnd(pat string) string {
 	method, path, found := strings.Cut(pat, " ")
 	if !found {
@@ -545,3 +3610,27 @@ func (m *mockResponseWriter) WriteString(s string) (n int, err error) {
 }
 
 func (m *mockResponseWriter) WriteHeader(int) {}
+
+func BenchmarkServeHTTPMethods(b *testing.B) {
+	mux := NewServeMux()
+	for _, p := range []string{"GET /items/{id}", "PUT /items/{id}", "GET /static/{path...}", "/about"} {
+		mux.HandleFunc(p, httpHandlerFunc)
+	}
+	for _, test := range []struct {
+		name, method, path string
+	}{
+		{"match", "GET", "/items/3"},
+		{"multi", "GET", "/static/css/site.css"},
+		{"notAllowed", "DELETE", "/items/3"},
+		{"notFound", "GET", "/nothing"},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			r := httptest.NewRequest(test.method, test.path, nil)
+			w := new(mockResponseWriter)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				mux.ServeHTTP(w, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file compares the paths of patterns in which a multi wildcard is
+// followed by literals, like "/files/{path...}/download". The comparisons
+// in pattern.go assume that a multi wildcard ends its pattern.
+
+package muxpatterns
+
+import "strings"
+
+// hasSuffix reports whether p has a multi wildcard followed by literals.
+func (p *Pattern) hasSuffix() bool {
+	return p.lastSegment().suffix != ""
+}
+
+// A pathToken matches one segment of a path, where a trailing slash counts
+// as the segment "/", or, for tokStar, any number of them.
+type pathToken struct {
+	kind tokenKind
+	s    string // literal, or wildcard name for an example path
+}
+
+type tokenKind int
+
+const (
+	tokLit    tokenKind = iota // the segment s
+	tokSingle                  // any segment but "/"
+	tokAny                     // any segment
+	tokStar                    // zero or more segments
+)
+
+// tokens returns p's path as tokens. A multi wildcard matches one or more
+// segments, so it becomes a tokAny and a tokStar. If literals follow it, the
+// first segment it matches can't be a trailing slash, so it begins with a
+// tokSingle instead.
+func (p *Pattern) tokens() []pathToken {
+	var toks []pathToken
+	for _, s := range p.segments {
+		switch {
+		case s.suffix != "":
+			toks = append(toks, pathToken{tokSingle, s.s}, pathToken{kind: tokStar})
+			for _, lit := range s.suffixLits() {
+				toks = append(toks, pathToken{tokLit, lit})
+			}
+		case s.multi:
+			toks = append(toks, pathToken{tokAny, s.s}, pathToken{kind: tokStar})
+		case s.wild:
+			toks = append(toks, pathToken{tokSingle, s.s})
+		default:
+			toks = append(toks, pathToken{tokLit, s.s})
+		}
+	}
+	return toks
+}
+
+// covers reports whether every segment that t2 matches is matched by t1.
+// Neither is a tokStar.
+func (t1 pathToken) covers(t2 pathToken) bool {
+	switch t1.kind {
+	case tokLit:
+		return t2.kind == tokLit && t2.s == t1.s
+	case tokSingle:
+		return t2.kind == tokSingle || t2.kind == tokLit && t2.s != "/"
+	default:
+		return true
+	}
+}
+
+// compareTokens returns the relationship between the paths that toks1 and
+// toks2 match.
+func compareTokens(toks1, toks2 []pathToken) relationship {
+	sub, super := coverTokens(toks2, toks1), coverTokens(toks1, toks2)
+	switch {
+	case sub && super:
+		return equivalent
+	case sub:
+		return moreSpecific
+	case super:
+		return moreGeneral
+	}
+	if _, ok := intersectTokens(toks1, toks2); ok {
+		return overlaps
+	}
+	return disjoint
+}
+
+// coverTokens reports whether gen matches every path that spec matches.
+func coverTokens(gen, spec []pathToken) bool {
+	if len(gen) == 0 {
+		return len(spec) == 0
+	}
+	if gen[0].kind == tokStar {
+		return coverTokens(gen[1:], spec) || len(spec) > 0 && coverTokens(gen, spec[1:])
+	}
+	if len(spec) == 0 {
+		return false
+	}
+	if spec[0].kind == tokStar {
+		// Cover the paths where spec's star matches nothing, and those where
+		// it matches a segment and then more. Only literals follow a star in
+		// a pattern's tokens, so unless the star is last, that segment isn't
+		// a trailing slash.
+		first := pathToken{kind: tokAny}
+		if len(spec) > 1 {
+			first.kind = tokSingle
+		}
+		return coverTokens(gen, spec[1:]) &&
+			coverTokens(gen, append([]pathToken{first}, spec...))
+	}
+	if !gen[0].covers(spec[0]) {
+		return false
+	}
+	return coverTokens(gen[1:], spec[1:])
+}
+
+// intersectTokens returns literal tokens for a path that both toks1 and
+// toks2 match. The second result is false if there is none.
+func intersectTokens(toks1, toks2 []pathToken) ([]pathToken, bool) {
+	switch {
+	case len(toks1) == 0 && len(toks2) == 0:
+		return nil, true
+	case len(toks1) > 0 && toks1[0].kind == tokStar:
+		if w, ok := intersectTokens(toks1[1:], toks2); ok {
+			return w, true
+		}
+		if len(toks2) > 0 {
+			// Let the star match toks2[0].
+			if w, ok := intersectTokens(toks1, toks2[1:]); ok {
+				return withExample(toks2[0], w), true
+			}
+		}
+		return nil, false
+	case len(toks2) > 0 && toks2[0].kind == tokStar:
+		return intersectTokens(toks2, toks1)
+	case len(toks1) == 0 || len(toks2) == 0:
+		return nil, false
+	}
+	// One token must cover the other, and then the segments that the
+	// covered one matches are those that both do.
+	t1, t2 := toks1[0], toks2[0]
+	if !t1.covers(t2) {
+		if !t2.covers(t1) {
+			return nil, false
+		}
+		t2 = t1
+	}
+	w, ok := intersectTokens(toks1[1:], toks2[1:])
+	if !ok {
+		return nil, false
+	}
+	return withExample(t2, w), true
+}
+
+// withExample returns toks with a literal token matched by t prepended,
+// or if t is a tokStar, which can match nothing, toks unchanged.
+func withExample(t pathToken, toks []pathToken) []pathToken {
+	if t.kind == tokStar {
+		return toks
+	}
+	if t.kind != tokLit {
+		t = pathToken{tokLit, tokenValue(t.s)}
+	}
+	return append([]pathToken{t}, toks...)
+}
+
+// differenceTokens returns a path that toks1 matches and toks2 doesn't.
+// It assumes there is one. It tries paths with wildcard values that are
+// none of toks2's literals, and each number of segments for the tokStar.
+func differenceTokens(toks1, toks2 []pathToken) string {
+	lits := map[string]bool{}
+	for _, t := range toks2 {
+		if t.kind == tokLit {
+			lits[t.s] = true
+		}
+	}
+	fresh := func(name string) pathToken {
+		v := tokenValue(name)
+		for lits[v] {
+			v += "x"
+		}
+		return pathToken{tokLit, v}
+	}
+	for n := 0; n <= len(toks2)+1; n++ {
+		var path []pathToken
+		for _, t := range toks1 {
+			switch t.kind {
+			case tokLit:
+				path = append(path, t)
+			case tokStar:
+				for i := 0; i < n; i++ {
+					path = append(path, fresh(""))
+				}
+			default:
+				path = append(path, fresh(t.s))
+			}
+		}
+		if !coverTokens(toks2, path) {
+			return tokensPath(path)
+		}
+	}
+	return tokensPath(toks1)
+}
+
+// tokensPath returns a path that toks match, in which a tokStar matches
+// nothing.
+func tokensPath(toks []pathToken) string {
+	var b strings.Builder
+	for _, t := range toks {
+		switch {
+		case t.kind == tokStar:
+		case t.kind != tokLit:
+			b.WriteByte('/')
+			b.WriteString(tokenValue(t.s))
+		case t.s == "/":
+			b.WriteByte('/')
+		default:
+			b.WriteByte('/')
+			b.WriteString(t.s)
+		}
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
+
+// tokenValue returns a value for the wildcard name in an example path.
+func tokenValue(name string) string {
+	if name == "" {
+		return "x"
+	}
+	return name
+}
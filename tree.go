@@ -8,9 +8,18 @@
 package muxpatterns
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/text/unicode/norm"
 )
 
 // A node is a node in the decision tree.
@@ -21,67 +30,419 @@ type node struct {
 	pattern *Pattern
 	handler http.Handler
 
+	// A leaf may also hold patterns with media types or header constraints,
+	// in registration order. Then pattern is the one without either, or if
+	// there is none, the first of variants.
+	variants []variant
+
 	// An interior node maps parts of the incoming request to child nodes.
 	// special children keys:
 	//     "/"	trailing slash (resulting from {$})
 	//	   ""   single wildcard
 	//	   "*"  multi wildcard
+	//	   "*/a/b"  multi wildcard followed by the literals a and b
 	children   mapping[string, *node]
 	emptyChild *node // optimization: child with key ""
+	// The keys of the children for multi wildcards followed by literals,
+	// those with more literals first.
+	suffixes []string
+
+	opts *treeOptions // shared by all nodes of a tree; nil for defaults
+
+	// batch identifies the batch of patterns being added by
+	// ServeMux.registerRoutes that n was made for. Until the tree is stored,
+	// no other tree has n, so the rest of the batch changes n in place rather
+	// than copying it again. It is 0 if n was made outside of a batch.
+	batch int
+
+	// In the root, the children whose keys are CIDR hosts, most specific
+	// first.
+	cidrs []cidrHost
+	// In the root, the keys of the children that are wildcard hosts.
+	hosts *hostTree[string]
+	// In the root, a tree like the root itself holding only the patterns
+	// registered with HandleExact, which are also in the root. It is tried
+	// first. Walk and the like don't visit it.
+	pinned *node
+	// In the root, the middleware from ServeMux.Use wrapped around
+	// serveChosen, or nil if there is none. It is built once for each call
+	// to Use, so that ServeHTTP needn't build it for each request.
+	chain http.Handler
+	// In the root, the handlers from ServeMux.HandleNotFound, by host.
+	// The map is replaced, not modified, when one is set.
+	notFound map[string]http.Handler
+}
+
+// treeOptions configure the construction of a tree.
+type treeOptions struct {
+	maxSlice         int         // see [mapping]
+	lookup           ChildLookup // see [WithChildLookup]
+	caseInsensitive  bool        // literal keys are lower case; see [WithCaseInsensitivePath]
+	normalizeUnicode bool        // literal keys are in NFC; see [WithUnicodeNormalization]
+	firstMatchWins   bool        // see [WithFirstMatchWins]
+}
+
+func (n *node) maxSlice() int {
+	if n.opts == nil {
+		return maxSlice
+	}
+	switch n.opts.lookup {
+	case LinearLookup:
+		return math.MaxInt
+	case MapLookup:
+		return 0
+	}
+	return n.opts.maxSlice
+}
+
+// addPattern returns a tree that is like the one rooted at root, but with p
+// and its handler added. The original tree is unchanged; the new one shares
+// all of its nodes except those on the paths to the new leaves.
+// So a tree can be read without locking while a new one is being built.
+// It returns an error if root already has a pattern that matches exactly
+// the same requests as p. Callers should check for conflicts first, so that
+// cannot happen.
+// If batch is not 0, the nodes made for the same batch by earlier calls are
+// changed in place; see [node.batch].
+func (root *node) addPattern(batch int, p *Pattern, h http.Handler) (*node, error) {
+	return root.withLeaves(batch, p, func(n *node) error { return n.set(p, h) })
+}
+
+// replaceHandler returns a tree that is like the one rooted at root, but with
+// h as the handler of the pattern that matches exactly the same requests as p.
+// That pattern stays in the tree. It returns an error if there is no such
+// pattern.
+func (root *node) replaceHandler(p *Pattern, h http.Handler) (*node, error) {
+	pinned := false
+	set := func(n *node) error {
+		if n.pattern == nil || n.pattern.constrained() {
+			return fmt.Errorf("pattern %q is not registered", p)
+		}
+		pinned = n.pattern.pinned
+		n.handler = chain(h, n.pattern.middleware)
+		return nil
+	}
+	root, err := root.withLeaves(0, p, set)
+	if err != nil || !pinned {
+		return root, err
+	}
+	root.pinned, err = root.pinned.withLeaves(0, p, set)
+	return root, err
+}
+
+// addPinned is like addPattern, but also adds p to root.pinned.
+func (root *node) addPinned(batch int, p *Pattern, h http.Handler) (*node, error) {
+	root, err := root.addPattern(batch, p, h)
+	if err != nil {
+		return nil, err
+	}
+	pinned := root.pinned
+	if pinned == nil {
+		pinned = &node{opts: root.opts, batch: batch}
+	}
+	root.pinned, err = pinned.addPattern(batch, p, h)
+	return root, err
+}
+
+// withLeaves returns a copy of the tree rooted at root, with f applied to a
+// copy of each leaf for p, which may be new. The copies are made for batch.
+func (root *node) withLeaves(batch int, p *Pattern, f func(*node) error) (*node, error) {
+	// A pattern with several methods is added under each of them.
+	methods := p.methods
+	if len(methods) == 0 {
+		methods = []string{""}
+	}
+	for _, m := range methods {
+		// First level of tree is host, prefixed with "https://"
+		// for patterns that require it.
+		host := p.host
+		if p.scheme != "" {
+			host = httpsPrefix + host
+		}
+		var err error
+		root, err = root.withChild(batch, host, func(n *node) (*node, error) {
+			// Second level of tree is method.
+			return n.withChild(batch, m, func(n *node) (*node, error) {
+				// Remaining levels are path.
+				return n.withSegments(batch, p.segments, p, f)
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.prefix.IsValid() {
+		root.cidrs = withCIDR(root.cidrs, cidrHost{p.prefix, p.host})
+	}
+	if isWildcardHost(p.host) {
+		root.hosts = root.hosts.with(p.host, p.host)
+	}
+	return root, nil
+}
+
+// compile returns a copy of the tree rooted at root whose nodes are stored
+// together in one slice, in breadth-first order, so that the children of a
+// node are next to each other in memory. The copy matches exactly as root
+// does; the order of each node's children is kept.
+func (root *node) compile() *node {
+	// The slice must not grow, so that pointers into it stay valid.
+	arena := make([]node, 1, root.countNodes())
+	arena[0] = *root
+	for i := 0; i < len(arena); i++ {
+		n := &arena[i]
+		if n.emptyChild != nil {
+			arena = append(arena, *n.emptyChild)
+			n.emptyChild = &arena[len(arena)-1]
+		}
+		children := mapping[string, *node]{sorted: n.children.sorted}
+		if n.children.m != nil {
+			children.m = make(map[string]*node, len(n.children.m))
+			for k, c := range n.children.m {
+				arena = append(arena, *c)
+				children.m[k] = &arena[len(arena)-1]
+			}
+		} else if len(n.children.s) > 0 {
+			children.s = make([]entry[string, *node], len(n.children.s))
+			for j, e := range n.children.s {
+				arena = append(arena, *e.value)
+				children.s[j] = entry[string, *node]{e.key, &arena[len(arena)-1]}
+			}
+		}
+		n.children = children
+	}
+	return &arena[0]
+}
+
+// countNodes returns the number of nodes in the tree rooted at n.
+func (n *node) countNodes() int {
+	count := 1
+	if n.emptyChild != nil {
+		count += n.emptyChild.countNodes()
+	}
+	n.children.pairs(func(_ string, c *node) bool {
+		count += c.countNodes()
+		return true
+	})
+	return count
+}
+
+// A cidrHost is a CIDR block and its key in the root of a routing tree.
+type cidrHost struct {
+	prefix netip.Prefix
+	key    string
 }
 
-func (root *node) addPattern(p *Pattern, h http.Handler) {
-	// First level of tree is host.
-	n := root.addChild(p.host)
-	// Second level of tree is method.
-	n = n.addChild(p.method)
-	// Remaining levels are path.
-	n.addSegments(p.segments, p, h)
+// withCIDR returns a copy of cs with c added, unless it is already present.
+func withCIDR(cs []cidrHost, c cidrHost) []cidrHost {
+	i := 0
+	for ; i < len(cs); i++ {
+		if cs[i] == c {
+			return cs
+		}
+		if cs[i].prefix.Bits() < c.prefix.Bits() {
+			break
+		}
+	}
+	r := make([]cidrHost, 0, len(cs)+1)
+	r = append(r, cs[:i]...)
+	r = append(r, c)
+	return append(r, cs[i:]...)
 }
 
-func (n *node) addSegments(segs []segment, p *Pattern, h http.Handler) {
+// withSegments returns a copy of n with f applied to a copy of the node at
+// the end of segs. The copies are made for batch. The pattern p is for error
+// messages.
+func (n *node) withSegments(batch int, segs []segment, p *Pattern, f func(*node) error) (*node, error) {
 	if len(segs) == 0 {
-		n.set(p, h)
-		return
+		c := n.own(batch)
+		if err := f(c); err != nil {
+			return nil, err
+		}
+		return c, nil
 	}
 	seg := segs[0]
 	if seg.multi {
 		if len(segs) != 1 {
-			panic("multi wildcard not last")
+			return nil, fmt.Errorf("pattern %q: multi wildcard not last", p)
 		}
-		if n.findChild("*") != nil {
-			panic("dup multi wildcards")
+		key := "*" + seg.suffix
+		// Look before withChild, which may add the child to n itself.
+		isNew := n.findChild(key) == nil
+		c, err := n.withChild(batch, key, func(c *node) (*node, error) { return c.withSegments(batch, nil, p, f) })
+		if err == nil && seg.suffix != "" && isNew {
+			c.suffixes = withSuffix(c.suffixes, key)
 		}
-		c := n.addChild("*")
-		c.set(p, h)
-	} else if seg.wild {
-		n.addChild("").addSegments(segs[1:], p, h)
-	} else {
-		n.addChild(seg.s).addSegments(segs[1:], p, h)
+		return c, err
+	}
+	key := seg.s
+	if seg.wild {
+		key = ""
 	}
+	return n.withChild(batch, key, func(c *node) (*node, error) { return c.withSegments(batch, segs[1:], p, f) })
 }
 
-func (n *node) set(p *Pattern, h http.Handler) {
-	if n.pattern != nil || n.handler != nil {
-		panic("non-nil leaf fields")
+// withSuffix returns a copy of keys with key added before the keys with
+// fewer literals.
+func withSuffix(keys []string, key string) []string {
+	n := strings.Count(key, "/")
+	i := 0
+	for i < len(keys) && strings.Count(keys[i], "/") >= n {
+		i++
+	}
+	r := make([]string, 0, len(keys)+1)
+	r = append(r, keys[:i]...)
+	r = append(r, key)
+	return append(r, keys[i:]...)
+}
+
+// set makes n a leaf for p and h. It fails if n already has a pattern with
+// the same media type and header constraints.
+func (n *node) set(p *Pattern, h http.Handler) error {
+	var dup *Pattern
+	if n.pattern != nil && !n.pattern.constrained() && !p.constrained() {
+		dup = n.pattern
+	}
+	for _, v := range n.variants {
+		if v.pattern.mediaType == p.mediaType && slices.Equal(v.pattern.headers, p.headers) {
+			dup = v.pattern
+		}
+	}
+	if dup != nil {
+		return fmt.Errorf("pattern %q (registered at %s) is already registered as %q (registered at %s)",
+			p, p.location(), dup, dup.location())
+	}
+	if p.constrained() {
+		// Copy variants, since n may share it with an older tree.
+		n.variants = append(n.variants[:len(n.variants):len(n.variants)], variant{p, h})
+		if n.pattern != nil {
+			return nil
+		}
 	}
 	n.pattern = p
 	n.handler = h
+	return nil
+}
+
+// A variant is a pattern with a media type or header constraints, and its
+// handler.
+type variant struct {
+	pattern *Pattern
+	handler http.Handler
+}
+
+// choose returns the pattern and handler of leaf n that best suit a request
+// with the given header. It considers only the patterns whose header
+// constraints the request meets, those with the most constraints first.
+// Of those with the same number of constraints, it chooses the one whose
+// media type the Accept header gives the highest quality, the earliest
+// registered on a tie, or if the header accepts none of them, the one
+// without a media type.
+// If no pattern is chosen, choose returns nil. It also reports whether that
+// is because of the Accept header.
+func (n *node) choose(header http.Header) (p *Pattern, h http.Handler, notAcceptable bool) {
+	if len(n.variants) == 0 {
+		return n.pattern, n.handler, false
+	}
+	var cands []variant
+	if !n.pattern.constrained() {
+		cands = append(cands, variant{n.pattern, n.handler})
+	}
+	for _, v := range n.variants {
+		if v.pattern.headersMatch(header) {
+			cands = append(cands, v)
+		}
+	}
+	// Try the candidates with the most header constraints first.
+	sort.SliceStable(cands, func(i, j int) bool {
+		return len(cands[i].pattern.headers) > len(cands[j].pattern.headers)
+	})
+	var ranges []acceptRange
+	for len(cands) > 0 {
+		k := len(cands[0].pattern.headers)
+		var best, plain *variant
+		bestQ := 0.0
+		for i := 0; i < len(cands) && len(cands[i].pattern.headers) == k; i++ {
+			c := &cands[i]
+			if c.pattern.mediaType == "" {
+				if plain == nil {
+					plain = c
+				}
+				continue
+			}
+			if ranges == nil {
+				ranges = parseAccept(header.Get("Accept"))
+			}
+			if q := acceptQuality(ranges, c.pattern.mediaType); q > bestQ {
+				best, bestQ = c, q
+			}
+			notAcceptable = true
+		}
+		if best == nil {
+			best = plain
+		}
+		if best != nil {
+			return best.pattern, best.handler, false
+		}
+		for len(cands) > 0 && len(cands[0].pattern.headers) == k {
+			cands = cands[1:]
+		}
+	}
+	return nil, nil, notAcceptable
 }
 
-func (n *node) addChild(key string) *node {
+// withChild returns a copy of n, made for batch, whose child at key is
+// replaced by the result of calling f on it. If n has no such child, f is
+// passed a new, empty node. If f fails, withChild returns its error.
+func (n *node) withChild(batch int, key string, f func(*node) (*node, error)) (*node, error) {
 	if key == "" {
-		if n.emptyChild == nil {
-			n.emptyChild = &node{}
+		old := n.emptyChild
+		if old == nil {
+			old = &node{opts: n.opts, batch: batch}
+		}
+		nc, err := f(old)
+		if err != nil {
+			return nil, err
 		}
-		return n.emptyChild
+		c := n.own(batch)
+		c.emptyChild = nc
+		return c, nil
+	}
+	old := n.findChild(key)
+	if old == nil {
+		old = &node{opts: n.opts, batch: batch}
+	}
+	nc, err := f(old)
+	if err != nil {
+		return nil, err
 	}
-	if c := n.findChild(key); c != nil {
-		return c
+	c := n.own(batch)
+	sorted := n.opts != nil && n.opts.lookup == SortedLookup
+	switch {
+	case batch != 0 && sorted:
+		c.children.setSorted(key, nc)
+	case batch != 0:
+		c.children.set(key, nc, n.maxSlice())
+	case sorted:
+		c.children = n.children.withSorted(key, nc)
+	default:
+		c.children = n.children.with(key, nc, n.maxSlice())
 	}
-	c := &node{}
-	n.children.add(key, c)
-	return c
+	return c, nil
+}
+
+// own returns a node like n that can be changed for batch: n itself if it
+// was made for batch, and otherwise a copy. If batch is not 0, the copy's
+// children share no storage with n's, so they too can be changed in place.
+func (n *node) own(batch int) *node {
+	if batch != 0 && n.batch == batch {
+		return n
+	}
+	c := *n
+	c.batch = batch
+	if batch != 0 {
+		c.children = n.children.clone()
+	}
+	return &c
 }
 
 func (n *node) findChild(key string) *node {
@@ -89,99 +450,485 @@ func (n *node) findChild(key string) *node {
 	return r
 }
 
-// If method is non-empty, match returns the leaf node that matches the
-// arguments, and a list of values for pattern wildcards in the order that the
-// wildcards appear.
-//
-// If method is empty, the
+// findLiteral returns the child of n for the literal path segment seg.
+func (n *node) findLiteral(seg string) *node {
+	return n.findChild(n.opts.literalKey(seg))
+}
+
+// literalKey returns the key for the literal seg in a tree built with o,
+// which may be nil.
+func (o *treeOptions) literalKey(seg string) string {
+	if o == nil {
+		return seg
+	}
+	if o.caseInsensitive {
+		seg = strings.ToLower(seg)
+	}
+	if o.normalizeUnicode {
+		seg = norm.NFC.String(seg)
+	}
+	return seg
+}
+
+// match returns the leaf node that matches the arguments, and a list of
+// values for pattern wildcards in the order that the wildcards appear.
+// The values are substrings of path; they are not percent-decoded.
+// If method is empty, only patterns without a method can match.
 func (root *node) match(method, host, path string) (*node, []string) {
+	return root.matchInto(method, host, path, nil)
+}
+
+// matchInto is like match, but appends the wildcard values to buf[:0].
+func (root *node) matchInto(method, host, path string, buf []string) (*node, []string) {
+	return root.matchSchemeInto(nil, false, method, host, path, buf)
+}
+
+// matchSchemeInto is like matchInto, but if secure is true it first tries
+// the patterns that require https. If cc is non-nil, it stops early, with no
+// match, when cc's context is done.
+func (root *node) matchSchemeInto(cc *cancelCheck, secure bool, method, host, path string, buf []string) (*node, []string) {
+	if path != "" && path[0] != '/' {
+		// A relative path, or the "*" of a server-wide OPTIONS request.
+		// Without the slash, nextSegment would drop a byte of the first
+		// segment.
+		return nil, nil
+	}
+	if root.pinned != nil {
+		if host != "" {
+			if p, m := root.pinned.matchHostInto(cc, secure, host, method, path, buf); p != nil {
+				return p, m
+			}
+		}
+		if p, m := root.pinned.matchHostInto(cc, secure, "", method, path, buf); p != nil {
+			return p, m
+		}
+	}
+	if root.opts != nil && root.opts.firstMatchWins {
+		return root.matchFirstInto(cc, secure, method, host, path, buf)
+	}
 	if host != "" {
 		// There is a host. If there is a pattern that specifies that host and it
-		// matches, we are done. If the pattern doesn't match, fall through to
-		// try patterns with no host.
-		if p, m := root.findChild(host).matchMethodAndPath(method, path); p != nil {
+		// matches, we are done. If the pattern doesn't match, try the wildcard
+		// hosts and CIDR blocks containing the host, then fall through to try
+		// patterns with no host.
+		if p, m := root.matchHostInto(cc, secure, host, method, path, buf); p != nil {
+			return p, m
+		}
+		for _, k := range root.broaderHostKeys(host) {
+			if p, m := root.matchHostInto(cc, secure, k, method, path, buf); p != nil {
+				return p, m
+			}
+		}
+	}
+	return root.matchHostInto(cc, secure, "", method, path, buf)
+}
+
+// matchHostInto matches against the patterns whose host is key. If secure is
+// true, it first tries those of them that require https.
+func (root *node) matchHostInto(cc *cancelCheck, secure bool, key, method, path string, buf []string) (*node, []string) {
+	if secure {
+		if p, m := root.findChild(httpsPrefix+key).matchMethodAndPath(cc, method, path, buf); p != nil {
 			return p, m
 		}
 	}
-	return root.emptyChild.matchMethodAndPath(method, path)
+	c := root.emptyChild
+	if key != "" {
+		c = root.findChild(key)
+	}
+	return c.matchMethodAndPath(cc, method, path, buf)
+}
+
+// hasHost reports whether the host of some pattern in the tree rooted at
+// root contains host.
+func (root *node) hasHost(host string) bool {
+	return root.findChild(host) != nil || root.findChild(httpsPrefix+host) != nil ||
+		len(root.broaderHostKeys(host)) > 0
+}
+
+// broaderHostKeys returns the keys of the children of root, other than host
+// itself, whose hosts contain host: first the wildcard hosts, longest suffix
+// first, then the CIDR blocks, most specific first.
+func (root *node) broaderHostKeys(host string) []string {
+	var keys []string
+	if root.hosts != nil {
+		keys = root.hosts.lookup(host)
+	}
+	for _, c := range root.cidrsContaining(host) {
+		keys = append(keys, c.key)
+	}
+	return keys
+}
+
+// cidrsContaining returns the CIDR hosts of root that contain host,
+// most specific first.
+func (root *node) cidrsContaining(host string) []cidrHost {
+	if len(root.cidrs) == 0 {
+		return nil
+	}
+	a, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return nil
+	}
+	var cs []cidrHost
+	for _, c := range root.cidrs {
+		if c.prefix.Contains(a) {
+			cs = append(cs, c)
+		}
+	}
+	return cs
 }
 
-func (n *node) matchMethodAndPath(method, path string) (*node, []string) {
+// matchMethodAndPath matches method and path against the method children of
+// n, a host node. It tries the child for method before the one for patterns
+// without a method. That respects precedence, because a pattern without a
+// method never takes precedence over one with a method that also matches
+// the request: if its path were more specific, the two would conflict.
+func (n *node) matchMethodAndPath(cc *cancelCheck, method, path string, buf []string) (*node, []string) {
 	if n == nil {
 		return nil, nil
 	}
-	if p, m := n.findChild(method).matchPath(path, nil); p != nil {
+	if p, m := n.findChild(method).matchPath(cc, path, buf[:0]); p != nil {
 		// Exact match of method name.
 		return p, m
 	}
 	if method == "HEAD" {
 		// GET matches HEAD too.
-		if p, m := n.findChild("GET").matchPath(path, nil); p != nil {
+		if p, m := n.findChild("GET").matchPath(cc, path, buf[:0]); p != nil {
 			return p, m
 		}
 	}
-	return n.emptyChild.matchPath(path, nil)
+	return n.emptyChild.matchPath(cc, path, buf[:0])
 }
 
-func (n *node) matchPath(path string, matches []string) (*node, []string) {
-	if n == nil {
+// matchFirstInto is like matchSchemeInto, but of all the patterns that
+// match, it returns the one that was registered first, ignoring precedence.
+func (root *node) matchFirstInto(cc *cancelCheck, secure bool, method, host, path string, buf []string) (*node, []string) {
+	var best *node
+	root.matchAll(cc, secure, method, host, path, func(n *node, matches []string) {
+		if best == nil || n.pattern.seq < best.pattern.seq {
+			best = n
+			buf = append(buf[:0], matches...)
+		}
+	})
+	if best == nil || (cc != nil && cc.err != nil) {
+		return nil, nil
+	}
+	return best, buf
+}
+
+// matchAll calls f on each leaf of root that matches the arguments, along
+// with its matches, in no particular order. f must copy the matches to keep
+// them. Unlike matchSchemeInto, matchAll ignores root.pinned.
+func (root *node) matchAll(cc *cancelCheck, secure bool, method, host, path string, f func(*node, []string)) {
+	if path != "" && path[0] != '/' {
+		return
+	}
+	keys := []string{""}
+	if host != "" {
+		keys = append([]string{host}, root.broaderHostKeys(host)...)
+		keys = append(keys, "")
+	}
+	for _, k := range keys {
+		hosts := []*node{root.findChild(k)}
+		if k == "" {
+			hosts[0] = root.emptyChild
+		}
+		if secure {
+			hosts = append(hosts, root.findChild(httpsPrefix+k))
+		}
+		for _, h := range hosts {
+			if h == nil {
+				continue
+			}
+			h.findChild(method).matchPathAll(cc, path, nil, f)
+			if method == "HEAD" {
+				h.findChild("GET").matchPathAll(cc, path, nil, f)
+			}
+			h.emptyChild.matchPathAll(cc, path, nil, f)
+		}
+	}
+}
+
+// matchPathAll is like matchPath, but instead of returning the first leaf
+// that matches path, it calls f on each of them, along with its matches.
+func (n *node) matchPathAll(cc *cancelCheck, path string, matches []string, f func(*node, []string)) {
+	if n == nil || cc.stop() {
+		return
+	}
+	if path == "" {
+		if n.pattern != nil && n.pattern.repeatsAgree(matches) {
+			f(n, matches)
+		}
+		return
+	}
+	seg, rest := nextSegment(path)
+	n.findLiteral(seg).matchPathAll(cc, rest, matches, f)
+	if strings.IndexByte(seg, '%') >= 0 {
+		if u := unescapeSegment(seg); u != seg && u != "*" && strings.IndexByte(u, '/') < 0 {
+			n.findLiteral(u).matchPathAll(cc, rest, matches, f)
+		}
+	}
+	if seg != "/" {
+		n.emptyChild.matchPathAll(cc, rest, append(matches, seg), f)
+	}
+	for _, k := range n.suffixes {
+		if v, ok := n.cutSuffix(path, k[1:]); ok {
+			c := n.findChild(k)
+			if m := append(matches, v[1:]); c.pattern.repeatsAgree(m) {
+				f(c, m)
+			}
+		}
+	}
+	if c := n.findChild("*"); c != nil {
+		if c.pattern.lastSegment().s != "" {
+			matches = append(matches, path[1:])
+		}
+		if c.pattern.repeatsAgree(matches) {
+			f(c, matches)
+		}
+	}
+}
+
+// A cancelCheck stops a match when its context is done. To keep matching
+// fast, it checks the context only every cancelCheckInterval steps.
+// A nil *cancelCheck never stops.
+type cancelCheck struct {
+	ctx   context.Context
+	steps int
+	err   error // the context's error, once it is done
+}
+
+const cancelCheckInterval = 64
+
+func (c *cancelCheck) stop() bool {
+	if c == nil {
+		return false
+	}
+	if c.err == nil {
+		c.steps++
+		if c.steps%cancelCheckInterval == 0 {
+			c.err = c.ctx.Err()
+		}
+	}
+	return c.err != nil
+}
+
+func (n *node) matchPath(cc *cancelCheck, path string, matches []string) (*node, []string) {
+	if n == nil || cc.stop() {
 		return nil, nil
 	}
 	// If path is empty, then return the node, whose pattern may be nil.
 	if path == "" {
-		if n.pattern == nil {
+		if n.pattern == nil || !n.pattern.repeatsAgree(matches) {
 			return nil, nil
 		}
 		return n, matches
 	}
 	seg, rest := nextSegment(path)
 	// Match literal.
-	if n, m := n.findChild(seg).matchPath(rest, matches); n != nil {
+	if n, m := n.findLiteral(seg).matchPath(cc, rest, matches); n != nil {
 		return n, m
 	}
+	// Literals are unescaped, but the path may not be. For example, the
+	// literal "{a}" matches "%7Ba%7D", the escaped form of the path "/{a}".
+	// Skip decoded segments that look like the keys for "{$}" and multis.
+	if strings.IndexByte(seg, '%') >= 0 {
+		if u := unescapeSegment(seg); u != "*" && strings.IndexByte(u, '/') < 0 {
+			if n, m := n.findLiteral(u).matchPath(cc, rest, matches); n != nil {
+				return n, m
+			}
+		}
+	}
 	// Match single wildcard, but not on a trailing slash.
 	if seg != "/" {
-		if n, m := n.emptyChild.matchPath(rest, append(matches, matchValue(seg))); n != nil {
-			return n, m
+		if wn, wm := n.emptyChild.matchPath(cc, rest, append(matches, seg)); wn != nil {
+			// A multi wildcard followed by literals can still be more
+			// specific, as "/a/{x...}/b" is more specific than "/a/{y}/{z...}".
+			// Match it in a copy of matches so as not to overwrite wm.
+			if c, m := n.matchSuffixes(path, matches[:len(matches):len(matches)]); c != nil && c.pattern.HigherPrecedence(wn.pattern) {
+				return c, m
+			}
+			return wn, wm
 		}
 	}
+	if c, m := n.matchSuffixes(path, matches); c != nil {
+		return c, m
+	}
 	// Match multi wildcard to the rest of the pattern.
 	if c := n.findChild("*"); c != nil {
 		// Don't record a match for a nameless wildcard (which arises from a
 		// trailing slash in the pattern).
 		if c.pattern.lastSegment().s != "" {
-			matches = append(matches, matchValue(path[1:])) // remove initial slash
+			matches = append(matches, path[1:]) // remove initial slash
+		}
+		if !c.pattern.repeatsAgree(matches) {
+			return nil, nil
 		}
 		return c, matches
 	}
 	return nil, nil
 }
 
+// matchSuffixes matches the multi wildcards of n that are followed by
+// literals to the rest of path before those literals. It returns the first
+// child that matches, which has the most literals.
+func (n *node) matchSuffixes(path string, matches []string) (*node, []string) {
+	for _, k := range n.suffixes {
+		if v, ok := n.cutSuffix(path, k[1:]); ok {
+			c := n.findChild(k)
+			if m := append(matches, v[1:]); c.pattern.repeatsAgree(m) {
+				return c, m
+			}
+		}
+	}
+	return nil, nil
+}
+
+// walk calls f on n and each of its descendants that holds a pattern, along
+// with its depth, where n is at the given depth.
+// A node's own pattern comes first, then its wildcard child, then its other
+// children in key order. If f returns an error, walk stops and returns it.
+func (n *node) walk(depth int, f func(*node, int) error) error {
+	if n.pattern != nil {
+		if err := f(n, depth); err != nil {
+			return err
+		}
+	}
+	if n.emptyChild != nil {
+		if err := n.emptyChild.walk(depth+1, f); err != nil {
+			return err
+		}
+	}
+	var err error
+	n.children.pairsSorted(func(_ string, c *node) bool {
+		err = c.walk(depth+1, f)
+		return err == nil
+	})
+	return err
+}
+
+// stats adds the statistics of the tree rooted at n, which is at the
+// given depth, to s.
+func (n *node) stats(depth int, s *TreeStats) {
+	s.Nodes++
+	if depth > s.MaxDepth {
+		s.MaxDepth = depth
+	}
+	switch {
+	case n.children.m != nil:
+		s.MapNodes++
+	case len(n.children.s) > 0:
+		s.SliceNodes++
+	case n.emptyChild == nil:
+		s.Leaves++
+	}
+	if n.emptyChild != nil {
+		n.emptyChild.stats(depth+1, s)
+	}
+	n.children.pairs(func(_ string, c *node) bool {
+		c.stats(depth+1, s)
+		return true
+	})
+}
+
 // matchingMethods returns a sorted list of all methods that, if passed to node.match
 // with the given host and path, would result in a match.
-func (root *node) matchingMethods(host, path string, methodSet map[string]bool) {
+func (root *node) matchingMethods(secure bool, host, path string, methodSet map[string]bool) {
+	if path != "" && path[0] != '/' {
+		return
+	}
+	// The wildcard values are discarded, so collect them in a pooled slice
+	// rather than allocating for each match.
+	bp := getMatches()
+	buf := *bp
 	if host != "" {
-		root.findChild(host).matchingMethodsPath(path, methodSet)
+		keys := append([]string{host}, root.broaderHostKeys(host)...)
+		for _, k := range keys {
+			if secure {
+				buf = root.findChild(httpsPrefix+k).matchingMethodsPath(path, buf, methodSet)
+			}
+			buf = root.findChild(k).matchingMethodsPath(path, buf, methodSet)
+		}
+	}
+	if secure {
+		buf = root.findChild(httpsPrefix).matchingMethodsPath(path, buf, methodSet)
 	}
-	root.emptyChild.matchingMethodsPath(path, methodSet)
+	buf = root.emptyChild.matchingMethodsPath(path, buf, methodSet)
+	putMatches(bp, buf)
 	if methodSet["GET"] {
 		methodSet["HEAD"] = true
 	}
 }
 
-func (n *node) matchingMethodsPath(path string, set map[string]bool) {
+// methods adds to set the methods of all the patterns in the tree rooted at
+// root that have one.
+func (root *node) methods(set map[string]bool) {
+	add := func(n *node) {
+		n.children.pairs(func(method string, _ *node) bool {
+			set[method] = true
+			return true
+		})
+	}
+	if root.emptyChild != nil {
+		add(root.emptyChild)
+	}
+	root.children.pairs(func(_ string, c *node) bool {
+		add(c)
+		return true
+	})
+	if set["GET"] {
+		set["HEAD"] = true
+	}
+}
+
+// matchingMethodsPath adds to set the methods of n's children that match
+// path. It collects wildcard values in buf, and returns buf or the larger
+// slice that matching grew it into, for putMatches.
+func (n *node) matchingMethodsPath(path string, buf []string, set map[string]bool) []string {
 	if n == nil {
-		return
+		return buf
 	}
 	n.children.pairs(func(method string, c *node) bool {
-		if p, _ := c.matchPath(path, nil); p != nil {
+		p, m := c.matchPath(nil, path, buf[:0])
+		if p != nil {
 			set[method] = true
 		}
+		if cap(m) > cap(buf) {
+			buf = m
+		}
 		return true
 	})
 	// Don't look at the empty child. If there were an empty
 	// child, it would match on any method, but we only
 	// call this when we fail to match on a method.
+	return buf
+}
+
+// cutSuffix reports whether path ends in the literal segments of suffix,
+// which begins with a slash, after at least one other segment, and returns
+// the path before them. Segments of path are unescaped as needed, and
+// compared case-insensitively if n's tree is.
+func (n *node) cutSuffix(path, suffix string) (string, bool) {
+	for suffix != "" {
+		i := strings.LastIndexByte(path, '/')
+		j := strings.LastIndexByte(suffix, '/')
+		if i < 0 {
+			return "", false
+		}
+		seg := path[i+1:]
+		if strings.IndexByte(seg, '%') >= 0 {
+			seg = unescapeSegment(seg)
+		}
+		if n.opts.literalKey(seg) != suffix[j+1:] {
+			return "", false
+		}
+		path, suffix = path[:i], suffix[:j]
+	}
+	if len(path) < 2 {
+		// The multi wildcard would match nothing.
+		return "", false
+	}
+	return path, true
 }
 
 // returns segment, "/" for trailing slash, or "" for done.
@@ -198,11 +945,53 @@ func nextSegment(path string) (seg, rest string) {
 	return path[:i], path[i:]
 }
 
+// matchesPool holds slices for collecting wildcard values during a match,
+// so that matching doesn't allocate as the values are appended.
+// Slices from the pool must not escape to callers.
+var matchesPool = sync.Pool{
+	New: func() any {
+		s := make([]string, 0, 8)
+		return &s
+	},
+}
+
+// getMatches returns an empty slice from matchesPool.
+func getMatches() *[]string {
+	bp := matchesPool.Get().(*[]string)
+	*bp = (*bp)[:0]
+	return bp
+}
+
+// putMatches returns bp to matchesPool. If matching grew the slice,
+// the larger one is kept.
+func putMatches(bp *[]string, matches []string) {
+	if cap(matches) > cap(*bp) {
+		*bp = matches
+	}
+	matchesPool.Put(bp)
+}
+
+// matchValue returns the percent-decoded form of a wildcard value.
+// Each slash-separated segment is decoded separately, so in the value of a
+// multi wildcard, an encoded slash ("%2F") becomes indistinguishable from a
+// separator. Use [Pattern.BindMulti] to keep them apart.
 func matchValue(path string) string {
-	m, err := url.PathUnescape(path)
-	if err != nil {
-		// Path is not properly escaped, so use the original.
+	if strings.IndexByte(path, '%') < 0 {
 		return path
 	}
+	segs := strings.Split(path, "/")
+	for i, s := range segs {
+		segs[i] = unescapeSegment(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+// unescapeSegment percent-decodes a single path segment.
+func unescapeSegment(s string) string {
+	m, err := url.PathUnescape(s)
+	if err != nil {
+		// Segment is not properly escaped, so use the original.
+		return s
+	}
 	return m
 }
@@ -50,15 +50,7 @@ func getTestTree() *node {
 }
 
 func buildTree(pats ...string) *node {
-	root := &node{}
-	for _, p := range pats {
-		pat, err := Parse(p)
-		if err != nil {
-			panic(err)
-		}
-		root.addPattern(pat, nil)
-	}
-	return root
+	return buildTreeOn(&node{}, pats...)
 }
 
 func TestAddPattern(t *testing.T) {
@@ -99,6 +91,65 @@ type testCase struct {
 	wantMatches        []string
 }
 
+func TestAddPatternDuplicate(t *testing.T) {
+	for _, ps := range [][2]string{
+		{"/a/b", "/a/b"},
+		{"GET /a/{x}", "GET /a/{y}"},
+		{"/a/", "/a/{rest...}"},
+		{"/a/{$}", "/a/{$}"},
+	} {
+		root := buildTree(ps[0])
+		if r, err := root.addPattern(0, mustParse(t, ps[1]), nil); err == nil {
+			t.Errorf("%q then %q: got nil, want error", ps[0], ps[1])
+		} else if r != nil {
+			t.Errorf("%q then %q: got a tree with the error", ps[0], ps[1])
+		}
+	}
+}
+
+// TestParseAndMatch checks that patterns from Parse can be added to a tree
+// and matched end to end, and that the tree's leaves hold those patterns.
+func TestParseAndMatch(t *testing.T) {
+	var pats []*Pattern
+	root := &node{}
+	for _, s := range []string{"GET /users/{id}", "/users/{id}/posts/", "example.com/{$}", "/files/{path...}"} {
+		pat := mustParse(t, s)
+		var err error
+		root, err = root.addPattern(0, pat, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pats = append(pats, pat)
+	}
+	for _, test := range []struct {
+		method, host, path string
+		want               int // index in pats, or -1
+		wantMatches        []string
+	}{
+		{"GET", "", "/users/17", 0, []string{"17"}},
+		{"POST", "", "/users/17", -1, nil},
+		{"POST", "", "/users/17/posts/3", 1, []string{"17"}},
+		{"GET", "example.com", "/", 2, nil},
+		{"GET", "", "/", -1, nil},
+		{"PUT", "", "/files/a/b", 3, []string{"a/b"}},
+	} {
+		n, matches := root.match(test.method, test.host, test.path)
+		if test.want < 0 {
+			if n != nil {
+				t.Errorf("%s %s%s: got %s, want no match", test.method, test.host, test.path, n.pattern)
+			}
+			continue
+		}
+		if n == nil || n.pattern != pats[test.want] {
+			t.Errorf("%s %s%s: got %v, want %s", test.method, test.host, test.path, n, pats[test.want])
+			continue
+		}
+		if !slices.Equal(matches, test.wantMatches) {
+			t.Errorf("%s %s%s: got matches %v, want %v", test.method, test.host, test.path, matches, test.wantMatches)
+		}
+	}
+}
+
 func TestNodeMatch(t *testing.T) {
 
 	test := func(tree *node, tests []testCase) {
@@ -210,6 +261,61 @@ func TestNodeMatch(t *testing.T) {
 	})
 }
 
+func TestCompile(t *testing.T) {
+	// With a maxSlice of 1, some nodes use maps.
+	tree := buildTreeOn(&node{opts: &treeOptions{maxSlice: 1}},
+		"/a", "/a/b", "/a/{x}", "GET /a/{x}", "a.com/a/{x...}",
+		"/a/b/{$}", "/c/d/e", "/c/{x}/e", "https:///f/", "/g/1", "/g/2")
+	var s TreeStats
+	tree.stats(0, &s)
+	if s.MapNodes == 0 || s.SliceNodes == 0 {
+		t.Fatalf("got %+v, want both slice and map nodes", s)
+	}
+	ctree := tree.compile()
+
+	var b1, b2 strings.Builder
+	tree.print(&b1, 0)
+	ctree.print(&b2, 0)
+	if b1.String() != b2.String() {
+		t.Errorf("got\n%s\nwant\n%s", &b2, &b1)
+	}
+	if got, want := ctree.countNodes(), tree.countNodes(); got != want {
+		t.Errorf("got %d nodes, want %d", got, want)
+	}
+	for _, test := range []struct{ method, host, path string }{
+		{"GET", "", "/a"},
+		{"GET", "", "/a/z"},
+		{"POST", "", "/a/z"},
+		{"GET", "a.com", "/a/z/y"},
+		{"GET", "", "/a/b/"},
+		{"GET", "", "/c/d/e"},
+		{"GET", "", "/c/x/e"},
+		{"GET", "", "/g/2"},
+		{"GET", "", "/none"},
+	} {
+		n1, m1 := tree.match(test.method, test.host, test.path)
+		n2, m2 := ctree.match(test.method, test.host, test.path)
+		if (n1 == nil) != (n2 == nil) || n1 != nil && n1.pattern != n2.pattern || !slices.Equal(m1, m2) {
+			t.Errorf("%s %s%s: compiled got (%v, %v), want (%v, %v)", test.method, test.host, test.path, n2, m2, n1, m1)
+		}
+	}
+}
+
+// buildTreeOn is like buildTree, but adds the patterns to root.
+func buildTreeOn(root *node, pats ...string) *node {
+	for _, p := range pats {
+		pat, err := Parse(p)
+		if err != nil {
+			panic(err)
+		}
+		root, err = root.addPattern(0, pat, nil)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return root
+}
+
 func TestMatchingMethods(t *testing.T) {
 	hostTree := buildTree("GET a.com/", "PUT b.com/", "POST /foo/{x}")
 	for _, test := range []struct {
@@ -258,7 +364,7 @@ func TestMatchingMethods(t *testing.T) {
 	} {
 		t.Run(test.name, func(t *testing.T) {
 			ms := map[string]bool{}
-			test.tree.matchingMethods(test.host, test.path, ms)
+			test.tree.matchingMethods(false, test.host, test.path, ms)
 			keys := maps.Keys(ms)
 			sort.Strings(keys)
 			got := strings.Join(keys, ",")
@@ -279,16 +385,9 @@ func (n *node) print(w io.Writer, level int) {
 		n.emptyChild.print(w, level+1)
 	}
 
-	var keys []string
-	n.children.pairs(func(k string, _ *node) bool {
-		keys = append(keys, k)
+	n.children.pairsSorted(func(k string, c *node) bool {
+		fmt.Fprintf(w, "%s%q:\n", indent, k)
+		c.print(w, level+1)
 		return true
 	})
-	sort.Strings(keys)
-
-	for _, k := range keys {
-		fmt.Fprintf(w, "%s%q:\n", indent, k)
-		n, _ := n.children.find(k)
-		n.print(w, level+1)
-	}
 }